@@ -0,0 +1,663 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// asset is a stored upload as listed by /api/assets. Its URL, the path it
+// is served under, identifies it in the other asset endpoints.
+type asset struct {
+	URL        string     `json:"url"`
+	Name       string     `json:"name"`
+	Original   string     `json:"original,omitempty"`
+	Size       int64      `json:"size"`
+	Width      int        `json:"width,omitempty"`
+	Height     int        `json:"height,omitempty"`
+	Thumbnail  string     `json:"thumbnail,omitempty"`
+	Modified   time.Time  `json:"modified"`
+	References []assetRef `json:"references"`
+
+	path string
+	refs []docLink
+}
+
+// assetRef is a line of a document that links to an asset.
+type assetRef struct {
+	Doc     string `json:"doc"`  // relative to the document root
+	Line    int    `json:"line"` // one-based
+	Unsaved bool   `json:"unsaved,omitempty"`
+}
+
+// docLink locates a link destination inside a document.
+type docLink struct {
+	doc         string
+	line        int // zero-based
+	start, end  int // byte offsets of the destination within the line
+	destination string
+	unsaved     bool // found in an open document rather than on disk
+}
+
+// assetRoot is a directory holding assets and the URL prefix it is
+// served under. In a sidecar root only files with an upload sidecar are
+// assets; the rest belong to the user.
+type assetRoot struct {
+	dir     string
+	prefix  string
+	sidecar bool
+}
+
+// documentRoot is the directory whose Markdown files are scanned for
+// references: the one holding -file.
+func documentRoot() string {
+	return filepath.Dir(*markdownFile)
+}
+
+// assetRoots returns the upload directory and, with -asset-dir, the asset
+// directory of each document under the document root, cut at the first
+// placeholder that changes between uploads. A template that leaves only a
+// document's own directory or the document root gives no root for that
+// document. Prefixes include -base-path, so asset URLs are the ones the
+// server serves them at.
+func assetRoots() ([]assetRoot, error) {
+	roots := []assetRoot{{dir: *uploadDir, prefix: basePath + "/uploads/"}}
+	if *assetDir == "" {
+		return roots, nil
+	}
+	docRoot, err := filepath.Abs(documentRoot())
+	if err != nil {
+		return nil, err
+	}
+	docs, err := markdownDocuments()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, doc := range docs {
+		fixed := strings.ReplaceAll(*assetDir, "{doc}", docSlug(doc))
+		if i := strings.Index(fixed, "{"); i >= 0 {
+			fixed = path.Dir(fixed[:i] + "x")
+		}
+		fixed = path.Clean(filepath.ToSlash(fixed))
+		if fixed == "." {
+			continue
+		}
+		dir := filepath.Join(filepath.Dir(doc), filepath.FromSlash(fixed))
+		rel, err := filepath.Rel(docRoot, dir)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		roots = append(roots, assetRoot{dir: dir, prefix: basePath + "/" + escapePath(filepath.ToSlash(rel)) + "/", sidecar: true})
+	}
+	return roots, nil
+}
+
+// markdownDocuments returns the absolute paths of the Markdown files under
+// the document root. Hidden directories and node_modules are skipped.
+func markdownDocuments() ([]string, error) {
+	var docs []string
+	err := filepath.WalkDir(documentRoot(), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if p != documentRoot() && (strings.HasPrefix(d.Name(), ".") || d.Name() == "node_modules") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !isMarkdownPath(p) {
+			return nil
+		}
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return err
+		}
+		docs = append(docs, abs)
+		return nil
+	})
+	return docs, err
+}
+
+// listAssets finds every stored asset and the document lines that link
+// to it.
+func listAssets() ([]*asset, error) {
+	var assets []*asset
+	byPath := make(map[string]*asset)
+	roots, err := assetRoots()
+	if err != nil {
+		return nil, err
+	}
+	for _, root := range roots {
+		err := filepath.WalkDir(root.dir, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if strings.HasPrefix(d.Name(), ".") && p != root.dir {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if d.IsDir() || !documentAssetTypes[strings.ToLower(filepath.Ext(p))] {
+				return nil
+			}
+			if root.sidecar {
+				if _, err := os.Stat(sidecarPath(p)); err != nil {
+					return nil
+				}
+			}
+			abs, err := filepath.Abs(p)
+			if err != nil {
+				return err
+			}
+			if byPath[abs] != nil {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root.dir, p)
+			if err != nil {
+				return err
+			}
+			a := &asset{
+				URL:        root.prefix + escapePath(filepath.ToSlash(rel)),
+				Name:       d.Name(),
+				Size:       info.Size(),
+				Modified:   info.ModTime().UTC(),
+				References: []assetRef{},
+				path:       abs,
+			}
+			readAssetDetails(a)
+			if thumbs := thumbnailsOf(abs); len(thumbs) > 0 {
+				a.Thumbnail = path.Dir(a.URL) + "/" + thumbsDir + "/" + url.PathEscape(filepath.Base(thumbs[0]))
+			}
+			assets = append(assets, a)
+			byPath[abs] = a
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	links, err := documentLinks()
+	if err != nil {
+		return nil, err
+	}
+	links = append(links, openDocumentLinks()...)
+	root, err := filepath.Abs(documentRoot())
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range links {
+		target, ok := resolveAssetLink(l.doc, l.destination)
+		if !ok || byPath[target] == nil {
+			continue
+		}
+		a := byPath[target]
+		a.refs = append(a.refs, l)
+		doc, err := filepath.Rel(root, l.doc)
+		if err != nil {
+			doc = l.doc
+		}
+		a.References = append(a.References, assetRef{Doc: filepath.ToSlash(doc), Line: l.line + 1, Unsaved: l.unsaved})
+	}
+
+	sort.Slice(assets, func(i, j int) bool { return assets[i].Modified.After(assets[j].Modified) })
+	return assets, nil
+}
+
+// readAssetDetails fills in what the upload sidecar records, falling back
+// to reading image dimensions from the file.
+func readAssetDetails(a *asset) {
+	if data, err := os.ReadFile(sidecarPath(a.path)); err == nil {
+		var rec uploadRecord
+		if json.Unmarshal(data, &rec) == nil {
+			a.Original, a.Width, a.Height = rec.Name, rec.Width, rec.Height
+			return
+		}
+	}
+	if f, err := os.Open(a.path); err == nil {
+		if cfg, _, err := image.DecodeConfig(f); err == nil {
+			a.Width, a.Height = cfg.Width, cfg.Height
+		}
+		f.Close()
+	}
+}
+
+// htmlSourcePattern finds src and href attributes in raw HTML such as the
+// <video> and <audio> markup inserted for attachments.
+var htmlSourcePattern = regexp.MustCompile(`<[a-zA-Z][^>]*?\s(?:src|href)="([^"]+)"`)
+
+// documentLinks returns every link in the Markdown files under the
+// document root, including src and href attributes of inline HTML.
+func documentLinks() ([]docLink, error) {
+	docs, err := markdownDocuments()
+	if err != nil {
+		return nil, err
+	}
+	var links []docLink
+	for _, doc := range docs {
+		src, err := os.ReadFile(doc)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, linksIn(doc, src)...)
+	}
+	return links, nil
+}
+
+// openDocumentLinks returns the links in what this server is showing but
+// may not have been saved: the document the tabs edit together and the
+// buffer an editor pushed.
+func openDocumentLinks() []docLink {
+	var links []docLink
+	add := func(doc, text string) {
+		abs, err := filepath.Abs(doc)
+		if err != nil {
+			return
+		}
+		for _, l := range linksIn(abs, []byte(text)) {
+			l.unsaved = true
+			links = append(links, l)
+		}
+	}
+	if text := collab.text(); text != "" {
+		add(*markdownFile, text)
+	}
+	if content, ok := buffers.current(); ok {
+		doc := content.Path
+		if doc == "" {
+			doc = *markdownFile
+		}
+		add(doc, content.Text)
+	}
+	return links
+}
+
+// linksIn returns the links in src, the text of doc.
+func linksIn(doc string, src []byte) []docLink {
+	var links []docLink
+	lines := splitSourceLines(src)
+	for _, l := range findLinks(lines) {
+		links = append(links, docLink{doc: doc, line: l.Line, start: l.Start, end: l.End, destination: l.Dest})
+	}
+	for i, l := range lines {
+		if l.InFence {
+			continue
+		}
+		for _, m := range htmlSourcePattern.FindAllStringSubmatchIndex(l.Masked, -1) {
+			links = append(links, docLink{doc: doc, line: i, start: m[2], end: m[3], destination: l.Masked[m[2]:m[3]]})
+		}
+	}
+	return links
+}
+
+// resolveAssetLink returns the absolute file a link destination in doc
+// points at, if it is served by this server.
+func resolveAssetLink(doc, dest string) (string, bool) {
+	dest, _, _ = strings.Cut(dest, "#")
+	dest, _, _ = strings.Cut(dest, "?")
+	if basePath != "" && strings.HasPrefix(dest, basePath+"/") {
+		dest = strings.TrimPrefix(dest, basePath)
+	}
+	var p string
+	switch {
+	case strings.HasPrefix(dest, "/uploads/"):
+		rest, err := url.PathUnescape(strings.TrimPrefix(dest, "/uploads/"))
+		if err != nil {
+			return "", false
+		}
+		p = filepath.Join(*uploadDir, filepath.FromSlash(rest))
+	case strings.HasPrefix(dest, "/"):
+		rest, err := url.PathUnescape(dest)
+		if err != nil {
+			return "", false
+		}
+		p = filepath.Join(documentRoot(), filepath.FromSlash(rest))
+	default:
+		rel, _, ok := splitLinkDest(dest)
+		if !ok || rel == "" {
+			return "", false
+		}
+		p = filepath.Join(filepath.Dir(doc), filepath.FromSlash(rel))
+	}
+	abs, err := filepath.Abs(p)
+	return abs, err == nil
+}
+
+// findAsset looks up an asset by its URL.
+func findAsset(assetURL string) (*asset, error) {
+	assets, err := listAssets()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range assets {
+		if a.URL == assetURL {
+			return a, nil
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+// renameAsset gives an asset a new file name in the same directory and
+// rewrites every link to it.
+func renameAsset(a *asset, name string) error {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid file name %q", name)
+	}
+	if !strings.EqualFold(filepath.Ext(name), filepath.Ext(a.Name)) {
+		return fmt.Errorf("new name must keep the %s extension", filepath.Ext(a.Name))
+	}
+	target := filepath.Join(filepath.Dir(a.path), name)
+	if _, err := os.Stat(target); err == nil {
+		return fmt.Errorf("%s already exists", name)
+	}
+	if err := os.Rename(a.path, target); err != nil {
+		return err
+	}
+	if _, err := os.Stat(sidecarPath(a.path)); err == nil {
+		if err := os.Rename(sidecarPath(a.path), sidecarPath(target)); err != nil {
+			log.Printf("Failed to move sidecar of %s: %v", a.Name, err)
+		}
+	}
+	oldStem := strings.TrimSuffix(a.Name, filepath.Ext(a.Name))
+	newStem := strings.TrimSuffix(name, filepath.Ext(name))
+	for _, thumb := range thumbnailsOf(a.path) {
+		renamed := filepath.Join(filepath.Dir(thumb), newStem+strings.TrimPrefix(filepath.Base(thumb), oldStem))
+		if err := os.Rename(thumb, renamed); err != nil {
+			log.Printf("Failed to move thumbnail of %s: %v", a.Name, err)
+		}
+	}
+	return rewriteLinks(a.refs, func(dest string) string {
+		i := strings.LastIndex(dest, "/") + 1
+		end := len(dest)
+		if j := strings.IndexAny(dest[i:], "?#"); j >= 0 {
+			end = i + j
+		}
+		return dest[:i] + url.PathEscape(name) + dest[end:]
+	})
+}
+
+// rewriteLinks replaces the destination of each link with rewrite(dest).
+// Links in open documents that are not saved are left to the editor.
+func rewriteLinks(links []docLink, rewrite func(string) string) error {
+	dests := make(map[string]map[string]bool)
+	for _, l := range links {
+		if l.unsaved {
+			continue
+		}
+		if dests[l.doc] == nil {
+			dests[l.doc] = make(map[string]bool)
+		}
+		dests[l.doc][l.destination] = true
+	}
+	for doc, want := range dests {
+		info, err := os.Stat(doc)
+		if err != nil {
+			return err
+		}
+		src, err := os.ReadFile(doc)
+		if err != nil {
+			return err
+		}
+		// The file may have been edited since links were listed, so they
+		// are found again in the text just read.
+		var links []docLink
+		for _, l := range linksIn(doc, src) {
+			if want[l.destination] {
+				links = append(links, l)
+			}
+		}
+		if len(links) == 0 {
+			continue
+		}
+		lines := strings.Split(string(src), "\n")
+		// Edit from the end so earlier offsets stay valid.
+		sort.Slice(links, func(i, j int) bool {
+			if links[i].line != links[j].line {
+				return links[i].line > links[j].line
+			}
+			return links[i].start > links[j].start
+		})
+		for _, l := range links {
+			line := lines[l.line]
+			lines[l.line] = line[:l.start] + rewrite(line[l.start:l.end]) + line[l.end:]
+		}
+		if err := os.WriteFile(doc, []byte(strings.Join(lines, "\n")), info.Mode().Perm()); err != nil {
+			return err
+		}
+		log.Printf("Updated %d link(s) in %s", len(links), doc)
+	}
+	return nil
+}
+
+// removeAsset deletes an asset, its sidecar and its thumbnails, or moves
+// the asset and sidecar under trashDir if it is not empty.
+func removeAsset(a *asset, trashDir string) error {
+	files := []string{a.path}
+	if _, err := os.Stat(sidecarPath(a.path)); err == nil {
+		files = append(files, sidecarPath(a.path))
+	}
+	thumbs := thumbnailsOf(a.path)
+	if trashDir == "" {
+		for _, f := range append(files, thumbs...) {
+			if err := os.Remove(f); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Keep the layout under the document root so restoring is a move back.
+	root, err := filepath.Abs(documentRoot())
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(root, a.path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		rel = filepath.Join(filepath.Base(filepath.Dir(a.path)), a.Name)
+	}
+	dst := filepath.Join(trashDir, rel)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	for _, f := range files {
+		target := dst
+		if f != a.path {
+			target = sidecarPath(dst)
+		}
+		if err := os.Rename(f, target); err != nil {
+			return err
+		}
+	}
+	// Thumbnails can be regenerated, so they are not kept in the trash.
+	for _, thumb := range thumbs {
+		os.Remove(thumb)
+	}
+	return nil
+}
+
+// handleAssets lists assets on GET and deletes one on DELETE
+// ?url=...; assets that are still linked are only deleted with force=1.
+func handleAssets(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		assets, err := listAssets()
+		if err != nil {
+			log.Printf("Failed to list assets: %v", err)
+			http.Error(w, "Failed to list assets", http.StatusInternalServerError)
+			return
+		}
+		if assets == nil {
+			assets = []*asset{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(assets)
+	case http.MethodDelete:
+		a, ok := assetFromRequest(w, r.URL.Query().Get("url"))
+		if !ok {
+			return
+		}
+		if len(a.refs) > 0 && r.URL.Query().Get("force") != "1" {
+			http.Error(w, fmt.Sprintf("Asset is linked from %d place(s)", len(a.refs)), http.StatusConflict)
+			return
+		}
+		if err := removeAsset(a, ""); err != nil {
+			log.Printf("Failed to delete %s: %v", a.path, err)
+			http.Error(w, "Failed to delete asset", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAssetRename accepts {"url": ..., "name": ...} and answers with
+// the renamed asset.
+func handleAssetRename(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limitBody(w, r)
+	var req struct {
+		URL  string `json:"url"`
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid rename request", http.StatusBadRequest)
+		return
+	}
+	a, ok := assetFromRequest(w, req.URL)
+	if !ok {
+		return
+	}
+	if err := renameAsset(a, req.Name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	renamed, err := findAsset(path.Join(path.Dir(a.URL), url.PathEscape(req.Name)))
+	if err != nil {
+		http.Error(w, "Failed to rename asset", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(renamed)
+}
+
+func assetFromRequest(w http.ResponseWriter, assetURL string) (*asset, bool) {
+	a, err := findAsset(assetURL)
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, "Asset not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Failed to list assets: %v", err)
+		http.Error(w, "Failed to list assets", http.StatusInternalServerError)
+		return nil, false
+	}
+	return a, true
+}
+
+// runGC implements the gc subcommand, which removes assets that no
+// Markdown file under the document's directory links to. By default they
+// are moved to a trash folder; -delete removes them for good.
+func runGC(args []string) int {
+	fs := flag.NewFlagSet("gc", flag.ContinueOnError)
+	fs.StringVar(markdownFile, "file", *markdownFile, "Markdown file whose directory is scanned for links")
+	fs.StringVar(uploadDir, "upload-dir", *uploadDir, "Directory for uploaded images")
+	fs.StringVar(assetDir, "asset-dir", *assetDir, "Per-document asset directory template")
+	fs.StringVar(basePathFlag, "base-path", *basePathFlag, "Path the server is mounted at, so links that include it count")
+	dryRun := fs.Bool("dry-run", false, "List unreferenced assets without removing them")
+	trash := fs.String("trash", "", "Move unreferenced assets here (default <upload-dir>/.trash/<time>)")
+	del := fs.Bool("delete", false, "Delete unreferenced assets instead of moving them to the trash")
+	force := fs.Bool("force", false, "Run even while a server for the directory is running")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s gc [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	var err error
+	if basePath, err = normalizeBasePath(*basePathFlag); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	// A running server may show documents that link to assets but are
+	// not saved yet, which this process cannot see.
+	if info, ok := liveInstance(); ok {
+		if !*dryRun && !*force {
+			fmt.Fprintf(os.Stderr, "a server for %s is running at %s; stop it first or pass -force\n", info.Root, info.URL)
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "warning: a server for %s is running at %s; unsaved links are not seen\n", info.Root, info.URL)
+	}
+
+	assets, err := listAssets()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	trashDir := *trash
+	if trashDir == "" {
+		trashDir = filepath.Join(*uploadDir, ".trash", time.Now().Format("20060102-150405"))
+	}
+	if *del {
+		trashDir = ""
+	}
+
+	var count int
+	var size int64
+	for _, a := range assets {
+		if len(a.refs) > 0 {
+			continue
+		}
+		count++
+		size += a.Size
+		fmt.Println(a.URL)
+		if *dryRun {
+			continue
+		}
+		if err := removeAsset(a, trashDir); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	switch {
+	case count == 0:
+		fmt.Fprintln(os.Stderr, "no unreferenced assets")
+	case *dryRun:
+		fmt.Fprintf(os.Stderr, "%d unreferenced asset(s), %d bytes\n", count, size)
+	case trashDir == "":
+		fmt.Fprintf(os.Stderr, "deleted %d asset(s), %d bytes\n", count, size)
+	default:
+		fmt.Fprintf(os.Stderr, "moved %d asset(s), %d bytes, to %s\n", count, size, trashDir)
+	}
+	return 0
+}
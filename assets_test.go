@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/yourusername/markdown-preview/wsproto"
+)
+
+// setFlag sets a string flag for the duration of the test.
+func setFlag(t *testing.T, p *string, v string) {
+	t.Helper()
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+func TestListAssetsOnlyUploads(t *testing.T) {
+	for _, tt := range []struct {
+		assetDir string
+		want     string // URL prefix of the upload
+	}{
+		{"", "/uploads/"},
+		{"{doc}-files", "/notes-files/"},
+		{"media/{doc}", "/media/notes/"},
+		{"{doc}/{date}", "/notes/"},
+	} {
+		t.Run(tt.assetDir, func(t *testing.T) {
+			root := t.TempDir()
+			setFlag(t, markdownFile, filepath.Join(root, "notes.md"))
+			setFlag(t, uploadDir, filepath.Join(root, ".uploads"))
+			setFlag(t, assetDir, tt.assetDir)
+			if err := os.MkdirAll(*uploadDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			// The user's own files, some inside what the template makes the
+			// asset directory.
+			for _, name := range []string{"notes.md", "plan.md", "data.csv", "report.pdf", "todo.txt", "sub/scan.png", "notes-files/manual.pdf", "media/notes/clip.mp3"} {
+				p := filepath.Join(root, filepath.FromSlash(name))
+				if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(p, []byte(name), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			u, _, err := storeUpload(bytes.NewReader([]byte("\x89PNG fake")), "image/png", ".png", "diagram.png")
+			if err != nil {
+				t.Fatal(err)
+			}
+			assets, err := listAssets()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var urls []string
+			for _, a := range assets {
+				urls = append(urls, a.URL)
+			}
+			sort.Strings(urls)
+			if len(urls) != 1 || !strings.HasPrefix(urls[0], tt.want) {
+				t.Fatalf("assets = %q, want only the upload under %s", urls, tt.want)
+			}
+			if tt.assetDir != "" && !strings.HasSuffix(urls[0], "/"+u) {
+				t.Errorf("asset URL %q does not match inserted link %q", urls[0], u)
+			}
+		})
+	}
+}
+
+// setupAssetDoc stores one upload and writes doc.md linking to it.
+func setupAssetDoc(t *testing.T, text string) (string, *asset) {
+	t.Helper()
+	root := t.TempDir()
+	setFlag(t, markdownFile, filepath.Join(root, "doc.md"))
+	setFlag(t, uploadDir, filepath.Join(root, "uploads"))
+	setFlag(t, assetDir, "")
+	if err := os.MkdirAll(*uploadDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	u, _, err := storeUpload(bytes.NewReader([]byte("\x89PNG fake")), "image/png", ".png", "a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(*markdownFile, []byte(strings.ReplaceAll(text, "URL", u)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	a, err := findAsset(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u, a
+}
+
+func TestListAssetsCountsOpenDocuments(t *testing.T) {
+	old := buffers
+	buffers = &bufferStore{}
+	t.Cleanup(func() { buffers = old })
+	resetCollab()
+	t.Cleanup(resetCollab)
+
+	u, a := setupAssetDoc(t, "# Nothing linked\n")
+	if len(a.References) != 0 {
+		t.Fatalf("references = %+v, want none", a.References)
+	}
+	text := "# Draft\n\n![a](" + u + ")\n"
+	buffers.apply(wsproto.PushBuffer{Path: *markdownFile, Text: &text})
+	a, err := findAsset(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.References) != 1 || !a.References[0].Unsaved || a.References[0].Line != 3 {
+		t.Errorf("references = %+v, want the unsaved buffer's line 3", a.References)
+	}
+}
+
+func TestRenameAfterDocumentChanged(t *testing.T) {
+	for _, tt := range []struct {
+		name, edited, want string
+	}{
+		{"lines inserted", "# Title\n\nNew text ![b](URL) more\n\n![a](URL)\n", "# Title\n\nNew text ![b](NEW) more\n\n![a](NEW)\n"},
+		{"line shortened", "x\n", "x\n"},
+		{"link moved", "![a](URL) was here\n", "![a](NEW) was here\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			u, a := setupAssetDoc(t, "Some intro text\n\nand then ![a](URL)\n")
+			// Edited after the asset was listed.
+			if err := os.WriteFile(*markdownFile, []byte(strings.ReplaceAll(tt.edited, "URL", u)), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := renameAsset(a, "renamed.png"); err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(*markdownFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := strings.ReplaceAll(tt.want, "NEW", "/uploads/renamed.png"); string(got) != want {
+				t.Errorf("document = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestGCRefusesWhileServerRuns(t *testing.T) {
+	_, a := setupAssetDoc(t, "# Nothing linked\n")
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	path, root, err := instancePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(instanceInfo{URL: srv.URL, Root: root})
+	os.MkdirAll(filepath.Dir(path), 0700)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	args := []string{"-file", *markdownFile, "-upload-dir", *uploadDir, "-delete"}
+	if code := runGC(args); code != 1 {
+		t.Errorf("gc with a live server: exit %d, want 1", code)
+	}
+	if _, err := os.Stat(a.path); err != nil {
+		t.Fatalf("gc removed an asset while a server was running: %v", err)
+	}
+	if code := runGC(append(args, "-force")); code != 0 {
+		t.Errorf("gc -force: exit %d, want 0", code)
+	}
+	if _, err := os.Stat(a.path); !os.IsNotExist(err) {
+		t.Errorf("gc -force kept the unlinked asset: %v", err)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// attachmentType describes a non-image file type /attach accepts. The
+// extension alone never decides: the sniffed content must match too.
+type attachmentType struct {
+	sniffed []string // acceptable http.DetectContentType results (prefixes)
+	mime    string   // type recorded in the sidecar
+	embed   string   // "video", "audio" or "" for a plain link
+}
+
+var attachmentTypes = map[string]attachmentType{
+	".pdf":  {sniffed: []string{"application/pdf"}, mime: "application/pdf"},
+	".csv":  {sniffed: []string{"text/plain"}, mime: "text/csv"},
+	".txt":  {sniffed: []string{"text/plain"}, mime: "text/plain"},
+	".zip":  {sniffed: []string{"application/zip"}, mime: "application/zip"},
+	".mp4":  {sniffed: []string{"video/mp4"}, mime: "video/mp4", embed: "video"},
+	".webm": {sniffed: []string{"video/webm"}, mime: "video/webm", embed: "video"},
+	".mp3":  {sniffed: []string{"audio/mpeg"}, mime: "audio/mpeg", embed: "audio"},
+	".ogg":  {sniffed: []string{"application/ogg", "audio/ogg"}, mime: "audio/ogg", embed: "audio"},
+	".wav":  {sniffed: []string{"audio/wave"}, mime: "audio/wav", embed: "audio"},
+}
+
+// allowedAttachments holds the extensions enabled by -attach-types.
+var allowedAttachments = map[string]bool{}
+
+// parseAttachTypes reads the -attach-types list, such as "pdf,csv,zip".
+func parseAttachTypes(list string) (map[string]bool, error) {
+	allowed := make(map[string]bool)
+	for _, field := range strings.Split(list, ",") {
+		ext := "." + strings.ToLower(strings.TrimPrefix(strings.TrimSpace(field), "."))
+		if ext == "." {
+			continue
+		}
+		if _, ok := attachmentTypes[ext]; !ok {
+			var known []string
+			for k := range attachmentTypes {
+				known = append(known, strings.TrimPrefix(k, "."))
+			}
+			sort.Strings(known)
+			return nil, fmt.Errorf("unknown attachment type %q (known: %s)", field, strings.Join(known, ", "))
+		}
+		allowed[ext] = true
+	}
+	return allowed, nil
+}
+
+// handleAttachment stores a non-image file posted in the "file" form field
+// and answers with the Markdown to insert: a link with the file size, or
+// <video>/<audio> markup for media.
+func handleAttachment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	maxAttach := int64(*maxAttachMB) << 20
+	r.Body = http.MaxBytesReader(w, r.Body, maxAttach+64<<10)
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("Attachment larger than %d MB", *maxAttachMB), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Invalid file upload", http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "Invalid file upload", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	if header.Size > maxAttach {
+		http.Error(w, fmt.Sprintf("Attachment larger than %d MB", *maxAttachMB), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	ext := strings.ToLower(filepath.Ext(header.Filename))
+	typ, known := attachmentTypes[ext]
+	if !known || !allowedAttachments[ext] {
+		http.Error(w, fmt.Sprintf("Attachments of type %q are not allowed", ext), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		http.Error(w, "Invalid file upload", http.StatusBadRequest)
+		return
+	}
+	head = head[:n]
+	sniffed := http.DetectContentType(head)
+	if !matchesSniffed(sniffed, typ.sniffed) {
+		log.Printf("Rejected attachment %q: %s content sniffed as %s", header.Filename, ext, sniffed)
+		http.Error(w, fmt.Sprintf("File content does not look like %s", ext), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	fileURL, _, err := storeUpload(io.MultiReader(bytes.NewReader(head), file), typ.mime, ext, header.Filename)
+	if err != nil {
+		log.Printf("Failed to save attachment: %v", err)
+		http.Error(w, "Failed to save file", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"markdown": attachmentMarkdown(typ.embed, fileURL, header.Filename, header.Size),
+	})
+}
+
+func matchesSniffed(sniffed string, accepted []string) bool {
+	for _, prefix := range accepted {
+		if strings.HasPrefix(sniffed, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// attachmentMarkdown builds the snippet inserted for an attachment.
+func attachmentMarkdown(embed, fileURL, filename string, size int64) string {
+	name := linkText(filepath.Base(strings.ReplaceAll(filename, `\`, "/")))
+	switch embed {
+	case "video", "audio":
+		return fmt.Sprintf(`<%s controls src="%s" title="%s"></%s>`,
+			embed, html.EscapeString(fileURL), html.EscapeString(name), embed)
+	}
+	return fmt.Sprintf("[%s](%s) (%s)", name, fileURL, formatSize(size))
+}
+
+// linkText makes a file name safe to use as Markdown link text.
+func linkText(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune("[]<>\\`", r) || r < ' ' {
+			return -1
+		}
+		return r
+	}, name)
+	if strings.TrimSpace(name) == "" {
+		return "attachment"
+	}
+	return name
+}
+
+// formatSize renders a byte count the way file managers do: "812 B",
+// "14.2 KB", "3.1 MB".
+func formatSize(n int64) string {
+	switch {
+	case n < 1<<10:
+		return fmt.Sprintf("%d B", n)
+	case n < 1<<20:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	case n < 1<<30:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	}
+	return fmt.Sprintf("%.1f GB", float64(n)/(1<<30))
+}
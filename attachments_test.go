@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAttachmentPolicy(t *testing.T) {
+	allowed, err := parseAttachTypes("pdf, .CSV,mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := allowedAttachments
+	allowedAttachments = allowed
+	t.Cleanup(func() { allowedAttachments = old })
+	if _, err := parseAttachTypes("pdf,exe"); err == nil {
+		t.Error("parseAttachTypes accepted exe")
+	}
+
+	pdf := []byte("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n1 0 obj\n<<>>\nendobj\n")
+	mp4 := []byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom")
+	for _, tt := range []struct {
+		name     string
+		filename string
+		data     []byte
+		want     int
+		markdown string // prefix of the inserted snippet
+	}{
+		{"pdf", "Q3 [draft].pdf", pdf, http.StatusOK, "[Q3 draft.pdf](/uploads/"},
+		{"csv", "data.csv", []byte("a,b\n1,2\n"), http.StatusOK, "[data.csv](/uploads/"},
+		{"video", "clip.mp4", mp4, http.StatusOK, `<video controls src="/uploads/`},
+		{"type not enabled", "archive.zip", []byte("PK\x03\x04"), http.StatusUnsupportedMediaType, ""},
+		{"unknown type", "setup.exe", []byte("MZ\x90\x00"), http.StatusUnsupportedMediaType, ""},
+		{"html named pdf", "invoice.pdf", []byte("<html><script>alert(1)</script></html>"), http.StatusUnsupportedMediaType, ""},
+		{"binary named csv", "data.csv", []byte("\x00\x01\x02\x03"), http.StatusUnsupportedMediaType, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, uploadDir, t.TempDir())
+			rec := postFile(t, handleAttachment, "file", tt.filename, tt.data)
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+			var resp struct{ Markdown string }
+			json.Unmarshal(rec.Body.Bytes(), &resp)
+			if !strings.HasPrefix(resp.Markdown, tt.markdown) {
+				t.Errorf("markdown = %q, want prefix %q", resp.Markdown, tt.markdown)
+			}
+		})
+	}
+}
+
+func TestAttachmentTooLarge(t *testing.T) {
+	setFlag(t, uploadDir, t.TempDir())
+	old := *maxAttachMB
+	*maxAttachMB = 1
+	t.Cleanup(func() { *maxAttachMB = old })
+
+	data := append([]byte("%PDF-1.4\n"), bytes.Repeat([]byte{'x'}, 2<<20)...)
+	if rec := postFile(t, handleAttachment, "file", "big.pdf", data); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want 413", rec.Code)
+	}
+}
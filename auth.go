@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// tokenCookie remembers the access token after the first visit so that the
+// token can be dropped from the address bar.
+const tokenCookie = "mdp_token"
+
+// accessToken is the token from -token, or a generated one for -token
+// auto. Empty means token auth is off.
+var accessToken string
+
+// htpasswdUsers maps user names to password hashes read from -htpasswd.
+var htpasswdUsers map[string]string
+
+// setupAuth reads the authentication flags.
+func setupAuth() error {
+	switch *tokenFlag {
+	case "":
+	case "auto":
+		accessToken = newSessionID() + newSessionID()
+	default:
+		accessToken = *tokenFlag
+	}
+	if *htpasswdFile != "" {
+		users, err := loadHtpasswd(*htpasswdFile)
+		if err != nil {
+			return err
+		}
+		htpasswdUsers = users
+	}
+	return nil
+}
+
+func authEnabled() bool {
+	return accessToken != "" || htpasswdUsers != nil
+}
+
+// checkExposure refuses to serve on a non-loopback address without
+// authentication, unless -insecure-no-auth says that is intended. Unix
+// sockets are protected by their file permissions instead.
+func checkExposure(listeners []net.Listener) error {
+	if authEnabled() || *insecureNoAuth {
+		return nil
+	}
+	for _, l := range listeners {
+		addr, ok := l.Addr().(*net.TCPAddr)
+		if ok && !addr.IP.IsLoopback() {
+			return fmt.Errorf("refusing to listen on %s without authentication; pass -token auto or -htpasswd, or -insecure-no-auth to allow it", addr)
+		}
+	}
+	return nil
+}
+
+// withTokenURL adds the access token to a page URL so that opening it logs
+// the browser in.
+func withTokenURL(u string) string {
+	if accessToken == "" || !strings.HasPrefix(u, "http") {
+		return u
+	}
+	if !strings.HasSuffix(u, "/") {
+		u += "/"
+	}
+	return u + "?token=" + accessToken
+}
+
+// requireAuth lets a request through if it carries the access token, as a
+// ?token= parameter, the cookie set from it or a Bearer header, or valid
+// basic auth credentials. A token in the query string of a page load is
+// moved into the cookie and dropped from the address.
+func requireAuth(h http.Handler) http.Handler {
+	if !authEnabled() {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A later invocation hands over its file with the instance token
+		// from the control file instead.
+		if r.URL.Path == "/api/open" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		// Share links carry their own token, which only opens the
+		// read-only viewer.
+		if strings.HasPrefix(r.URL.Path, "/s/") || isSharedUpload(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if accessToken != "" {
+			if token := r.URL.Query().Get("token"); token != "" && validToken(token) {
+				http.SetCookie(w, &http.Cookie{
+					Name:     tokenCookie,
+					Value:    token,
+					Path:     basePath + "/",
+					HttpOnly: true,
+					Secure:   r.TLS != nil,
+					SameSite: http.SameSiteStrictMode,
+				})
+				if r.Method == http.MethodGet && r.Header.Get("Upgrade") == "" {
+					q := r.URL.Query()
+					q.Del("token")
+					target := basePath + r.URL.Path
+					if len(q) > 0 {
+						target += "?" + q.Encode()
+					}
+					http.Redirect(w, r, target, http.StatusFound)
+					return
+				}
+				h.ServeHTTP(w, r)
+				return
+			}
+			if c, err := r.Cookie(tokenCookie); err == nil && validToken(c.Value) {
+				h.ServeHTTP(w, r)
+				return
+			}
+			if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && validToken(token) {
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+		if htpasswdUsers != nil {
+			if user, pass, ok := r.BasicAuth(); ok && checkPassword(user, pass) {
+				h.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="Markdown Preview", charset="UTF-8"`)
+		}
+		http.Error(w, "Unauthorized: open the URL printed when the server started", http.StatusUnauthorized)
+	})
+}
+
+func validToken(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(accessToken)) == 1
+}
+
+// loadHtpasswd reads an htpasswd file. Apache MD5 ($apr1$, the default of
+// "htpasswd -m") and SHA-1 ({SHA}, "htpasswd -s") hashes are supported.
+func loadHtpasswd(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%s:%d: expected user:hash", path, n)
+		}
+		if !strings.HasPrefix(hash, "$apr1$") && !strings.HasPrefix(hash, "{SHA}") {
+			return nil, fmt.Errorf("%s:%d: unsupported hash for %s; create it with htpasswd -m or -s", path, n, user)
+		}
+		users[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, fmt.Errorf("%s: no users", path)
+	}
+	log.Printf("Loaded %d user(s) from %s", len(users), path)
+	return users, nil
+}
+
+func checkPassword(user, pass string) bool {
+	hash, ok := htpasswdUsers[user]
+	if !ok {
+		// Spend the same effort as for a real user.
+		apr1(pass, "00000000")
+		return false
+	}
+	var computed string
+	if strings.HasPrefix(hash, "{SHA}") {
+		sum := sha1.Sum([]byte(pass))
+		computed = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	} else {
+		salt := strings.TrimPrefix(hash, "$apr1$")
+		salt, _, _ = strings.Cut(salt, "$")
+		computed = apr1(pass, salt)
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1
+}
+
+// apr1 computes Apache's variant of the MD5-based crypt(3) hash.
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write([]byte(salt))
+	alt.Write(pw)
+	mixin := alt.Sum(nil)
+
+	d := md5.New()
+	d.Write(pw)
+	d.Write([]byte(magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		d.Write(mixin[:min(i, 16)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			d.Write([]byte{0})
+		} else {
+			d.Write(pw[:1])
+		}
+	}
+	final := d.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		r := md5.New()
+		if i&1 != 0 {
+			r.Write(pw)
+		} else {
+			r.Write(final)
+		}
+		if i%3 != 0 {
+			r.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			r.Write(pw)
+		}
+		if i&1 != 0 {
+			r.Write(final)
+		} else {
+			r.Write(pw)
+		}
+		final = r.Sum(nil)
+	}
+
+	var out strings.Builder
+	out.WriteString(magic + salt + "$")
+	encode := func(v uint, n int) {
+		for ; n > 0; n-- {
+			out.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint(final[g[0]])<<16|uint(final[g[1]])<<8|uint(final[g[2]]), 4)
+	}
+	encode(uint(final[11]), 2)
+	return out.String()
+}
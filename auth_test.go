@@ -0,0 +1,240 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// Expected hashes come from "openssl passwd -apr1 -salt <salt> <password>".
+func TestAPR1(t *testing.T) {
+	for _, tt := range []struct {
+		password, salt, want string
+	}{
+		{"password", "r31.....", "$apr1$r31.....$ARC3pREO82RIm0aQ2zszC0"},
+		{"myPassword", "abcdefgh", "$apr1$abcdefgh$EfExgQSMBXioDhIVk8IOb1"},
+		{"a", "12345678", "$apr1$12345678$68ZQVfPkWX/wcXr/41VxQ."},
+		{"", "xxxxxxxx", "$apr1$xxxxxxxx$AL/DOdqyMUurcg0cPNW/P1"},
+		{"correct horse battery staple", "saltsalt", "$apr1$saltsalt$PU9q8.HoFJEM7m9NSIooE1"},
+		{"pässwörd", "Zz/9.Aa0", "$apr1$Zz/9.Aa0$miZk8lU3qUTYa71ZLcsL./"},
+		{"password", "r31.....toolong", "$apr1$r31.....$ARC3pREO82RIm0aQ2zszC0"},
+	} {
+		if got := apr1(tt.password, tt.salt); got != tt.want {
+			t.Errorf("apr1(%q, %q) = %q, want %q", tt.password, tt.salt, got, tt.want)
+		}
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	content := "# users\nalice:$apr1$r31.....$ARC3pREO82RIm0aQ2zszC0\n\nbob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	users, err := loadHtpasswd(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := htpasswdUsers
+	htpasswdUsers = users
+	t.Cleanup(func() { htpasswdUsers = old })
+
+	for _, tt := range []struct {
+		user, pass string
+		want       bool
+	}{
+		{"alice", "password", true},
+		{"alice", "Password", false},
+		{"alice", "", false},
+		{"bob", "password", true},
+		{"bob", "password ", false},
+		{"carol", "password", false},
+	} {
+		if got := checkPassword(tt.user, tt.pass); got != tt.want {
+			t.Errorf("checkPassword(%q, %q) = %v, want %v", tt.user, tt.pass, got, tt.want)
+		}
+	}
+}
+
+func TestLoadHtpasswdRejectsUnsupportedHashes(t *testing.T) {
+	for _, line := range []string{
+		"alice:$2y$05$c4WoMPo3SXsafkva.HHa6uXQZWr7oboPiC2bT/r7q1BB8I2s0BRqC",
+		"alice:plaintext",
+		"no-colon",
+	} {
+		path := filepath.Join(t.TempDir(), "htpasswd")
+		if err := os.WriteFile(path, []byte(line+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadHtpasswd(path); err == nil || !strings.Contains(err.Error(), ":1:") {
+			t.Errorf("loadHtpasswd(%q) err = %v, want an error for line 1", line, err)
+		}
+	}
+}
+
+// setAccessToken turns token auth on for the test. Handlers must be built
+// afterwards, since requireAuth checks it when wrapping.
+func setAccessToken(t *testing.T, token string) {
+	t.Helper()
+	old := accessToken
+	accessToken = token
+	t.Cleanup(func() { accessToken = old })
+}
+
+func TestRequireAuthToken(t *testing.T) {
+	setAccessToken(t, "tok")
+	srv := newTestServer(t)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	get := func(path string, header http.Header) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := get("/?token=tok&theme=dark", nil)
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/?theme=dark" {
+		t.Errorf("?token=: status %d, Location %q, want a redirect to /?theme=dark", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	var cookie *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == tokenCookie {
+			cookie = c
+		}
+	}
+	if cookie == nil || cookie.Value != "tok" || !cookie.HttpOnly || cookie.SameSite != http.SameSiteStrictMode {
+		t.Fatalf("token cookie = %+v", cookie)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		path   string
+		header http.Header
+		want   int
+	}{
+		{"nothing", "/", nil, http.StatusUnauthorized},
+		{"wrong query token", "/?token=guess", nil, http.StatusUnauthorized},
+		{"cookie", "/", http.Header{"Cookie": {tokenCookie + "=tok"}}, http.StatusOK},
+		{"wrong cookie", "/", http.Header{"Cookie": {tokenCookie + "=guess"}}, http.StatusUnauthorized},
+		{"bearer", "/", http.Header{"Authorization": {"Bearer tok"}}, http.StatusOK},
+		{"wrong bearer", "/", http.Header{"Authorization": {"Bearer guess"}}, http.StatusUnauthorized},
+		{"websocket", "/ws", nil, http.StatusUnauthorized},
+		{"uploads", "/uploads/x.png", nil, http.StatusUnauthorized},
+	} {
+		if resp := get(tt.path, tt.header); resp.StatusCode != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, resp.StatusCode, tt.want)
+		}
+	}
+	if resp := postForm(t, srv, "/upload", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("upload: status %d, want 401", resp.StatusCode)
+	}
+
+	// WebSocket upgrades may carry the token in the query; they are not
+	// redirected.
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": {srv.URL}}); err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("/ws without token: %v", err)
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?token=tok", http.Header{"Origin": {srv.URL}})
+	if err != nil {
+		t.Fatalf("/ws with token: %v", err)
+	}
+	conn.Close()
+
+	// Share links and the hand-over from a later invocation check their
+	// own tokens.
+	if resp := get("/s/unknown/", nil); resp.StatusCode == http.StatusUnauthorized {
+		t.Error("/s/ asked for the access token")
+	}
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/api/open", strings.NewReader("{}"))
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("/api/open: status %d, want 403 from its own check", resp.StatusCode)
+	}
+}
+
+func TestRequireAuthBasic(t *testing.T) {
+	old := htpasswdUsers
+	htpasswdUsers = map[string]string{"alice": "$apr1$r31.....$ARC3pREO82RIm0aQ2zszC0"}
+	t.Cleanup(func() { htpasswdUsers = old })
+	srv := newTestServer(t)
+
+	for _, tt := range []struct {
+		user, pass string
+		want       int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"alice", "wrong", http.StatusUnauthorized},
+		{"alice", "password", http.StatusOK},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/", nil)
+		if tt.user != "" {
+			req.SetBasicAuth(tt.user, tt.pass)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s/%s: status %d, want %d", tt.user, tt.pass, resp.StatusCode, tt.want)
+		}
+		if tt.want == http.StatusUnauthorized && !strings.HasPrefix(resp.Header.Get("WWW-Authenticate"), "Basic ") {
+			t.Errorf("%s/%s: no basic auth challenge", tt.user, tt.pass)
+		}
+	}
+}
+
+// addrListener is a listener that only reports an address.
+type addrListener struct {
+	net.Listener
+	addr net.Addr
+}
+
+func (l addrListener) Addr() net.Addr { return l.addr }
+
+func TestCheckExposure(t *testing.T) {
+	setAccessToken(t, "")
+	loopback := addrListener{addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8080}}
+	loopback6 := addrListener{addr: &net.TCPAddr{IP: net.IPv6loopback, Port: 8080}}
+	lan := addrListener{addr: &net.TCPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 8080}}
+	wildcard := addrListener{addr: &net.TCPAddr{IP: net.IPv4zero, Port: 8080}}
+	unix := addrListener{addr: &net.UnixAddr{Name: "/run/preview.sock", Net: "unix"}}
+
+	if err := checkExposure([]net.Listener{loopback, loopback6, unix}); err != nil {
+		t.Errorf("loopback and unix: %v", err)
+	}
+	for _, l := range []net.Listener{lan, wildcard} {
+		if err := checkExposure([]net.Listener{loopback, l}); err == nil {
+			t.Errorf("%v without auth was allowed", l.Addr())
+		}
+	}
+
+	old := *insecureNoAuth
+	*insecureNoAuth = true
+	if err := checkExposure([]net.Listener{lan}); err != nil {
+		t.Errorf("-insecure-no-auth: %v", err)
+	}
+	*insecureNoAuth = old
+
+	setAccessToken(t, "tok")
+	if err := checkExposure([]net.Listener{lan}); err != nil {
+		t.Errorf("with a token: %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// basePath is the normalized -base-path: empty when the server is mounted
+// at the root, otherwise a path such as "/mdpreview" with no trailing
+// slash. Every route and every URL the server generates starts with it.
+var basePath string
+
+// normalizeBasePath cleans a -base-path value.
+func normalizeBasePath(p string) (string, error) {
+	if p == "" || p == "/" {
+		return "", nil
+	}
+	if strings.ContainsAny(p, "?#") {
+		return "", fmt.Errorf("-base-path must be a plain path, got %q", p)
+	}
+	for _, seg := range strings.Split(p, "/") {
+		if seg == "." || seg == ".." {
+			return "", fmt.Errorf("-base-path must not contain . or .. segments, got %q", p)
+		}
+	}
+	return path.Clean("/" + p), nil
+}
+
+// withBasePath serves h below basePath. The bare base path redirects to
+// the page with a trailing slash so that relative URLs resolve.
+func withBasePath(h http.Handler) http.Handler {
+	if basePath == "" {
+		return h
+	}
+	stripped := http.StripPrefix(basePath, h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == basePath {
+			http.Redirect(w, r, basePath+"/", http.StatusMovedPermanently)
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, basePath+"/") {
+			http.NotFound(w, r)
+			return
+		}
+		stripped.ServeHTTP(w, r)
+	})
+}
+
+// pageURL returns the address of the preview page for a server reached at
+// serverURL.
+func pageURL(serverURL string) string {
+	if basePath == "" || !strings.HasPrefix(serverURL, "http") {
+		return serverURL
+	}
+	return serverURL + basePath + "/"
+}
+
+// basePathScript declares basePath for the page's JavaScript.
+func basePathScript() string {
+	encoded, _ := json.Marshal(basePath)
+	return "\n\t\tconst basePath = " + string(encoded) + ";"
+}
+
+// rootLinkPattern finds src and href attributes holding a root-relative
+// URL, such as the /uploads/ links inserted for pasted images.
+var rootLinkPattern = regexp.MustCompile(`\s(?:src|href)="/[^/"][^"]*"`)
+
+// withBasePathLinks mounts the root-relative links in rendered HTML below
+// basePath. Links that already include it, as uploads inserted by older
+// versions do, are left alone.
+func withBasePathLinks(body string) string {
+	if basePath == "" {
+		return body
+	}
+	return rootLinkPattern.ReplaceAllStringFunc(body, func(attr string) string {
+		i := strings.Index(attr, `"`) + 1
+		if strings.HasPrefix(attr[i:], basePath+"/") {
+			return attr
+		}
+		return attr[:i] + basePath + attr[i:]
+	})
+}
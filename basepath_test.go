@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWithBasePathLinks(t *testing.T) {
+	old := basePath
+	basePath = "/mdp"
+	t.Cleanup(func() { basePath = old })
+
+	for _, tt := range []struct {
+		in, want string
+	}{
+		{`<img src="/uploads/a.png" alt="a">`, `<img src="/mdp/uploads/a.png" alt="a">`},
+		{`<a href="/docs/b.pdf">b</a>`, `<a href="/mdp/docs/b.pdf">b</a>`},
+		{`<video controls src="/uploads/c.mp4"></video>`, `<video controls src="/mdp/uploads/c.mp4"></video>`},
+		{`<img src="/mdp/uploads/a.png">`, `<img src="/mdp/uploads/a.png">`},
+		{`<img src="images/a.png">`, `<img src="images/a.png">`},
+		{`<img src="//cdn.example/a.png">`, `<img src="//cdn.example/a.png">`},
+		{`<a href="https://example.com/">x</a>`, `<a href="https://example.com/">x</a>`},
+		{`<code>&lt;img src=&quot;/uploads/a.png&quot;&gt;</code>`, `<code>&lt;img src=&quot;/uploads/a.png&quot;&gt;</code>`},
+	} {
+		if got := withBasePathLinks(tt.in); got != tt.want {
+			t.Errorf("withBasePathLinks(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestUploadURLLeavesOutBasePath(t *testing.T) {
+	old := basePath
+	basePath = "/mdp"
+	t.Cleanup(func() { basePath = old })
+	setFlag(t, uploadDir, t.TempDir())
+
+	u, _, err := storeUpload(bytes.NewReader([]byte("data")), "image/png", ".png", "a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(u, "/uploads/") {
+		t.Errorf("upload URL = %q, want it under /uploads/", u)
+	}
+	if got := renderBlock(sourceBlock{Text: "![a](" + u + ")\n"}, ""); !strings.Contains(got, `src="/mdp`+u+`"`) {
+		t.Errorf("rendered %q, want the link below the base path", got)
+	}
+}
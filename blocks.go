@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/gomarkdown/markdown"
+	"github.com/yourusername/markdown-preview/wsproto"
+)
+
+var listItemPattern = regexp.MustCompile(`^ {0,3}([-*+]|\d{1,9}[.)])([ \t]|$)`)
+
+var htmlBlockPattern = regexp.MustCompile(`^<([a-zA-Z0-9]+)`)
+
+// htmlBlockTags are the tags gomarkdown starts an HTML block with. Such a
+// block runs, blank lines included, to the first line ending in its
+// closing tag.
+var htmlBlockTags = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true,
+	"canvas": true, "dd": true, "del": true, "details": true, "dialog": true,
+	"div": true, "dl": true, "dt": true, "fieldset": true, "figcaption": true,
+	"figure": true, "footer": true, "form": true, "h1": true, "h2": true,
+	"h3": true, "h4": true, "h5": true, "h6": true, "header": true,
+	"hgroup": true, "iframe": true, "ins": true, "li": true, "main": true,
+	"math": true, "nav": true, "noscript": true, "ol": true, "output": true,
+	"p": true, "pre": true, "progress": true, "script": true, "section": true,
+	"style": true, "table": true, "ul": true, "video": true,
+}
+
+// sourceBlock is a top-level Markdown block and the zero-based line it
+// starts on.
+type sourceBlock struct {
+	Line int
+	Text string
+}
+
+// splitBlocks cuts a document into top-level blocks at blank lines. Fenced
+// code, indented continuations and loose lists stay in one block so each
+// piece renders the same as it would inside the whole document.
+func splitBlocks(src []byte) []sourceBlock {
+	lines := splitSourceLines(src)
+	var blocks []sourceBlock
+	var cur []string
+	start := 0
+	inList := false
+	flush := func() {
+		if len(cur) > 0 {
+			blocks = append(blocks, sourceBlock{Line: start, Text: strings.Join(cur, "\n") + "\n"})
+		}
+		cur = nil
+	}
+
+	htmlEnd := -1
+	for i, l := range lines {
+		blank := strings.TrimSpace(l.Text) == ""
+		if blank && !l.InFence && i > htmlEnd {
+			if len(cur) > 0 && !continuesBlock(lines, i, inList) {
+				flush()
+			} else if len(cur) > 0 {
+				cur = append(cur, l.Text)
+			}
+			continue
+		}
+		if len(cur) == 0 {
+			start = i
+			inList = listItemPattern.MatchString(l.Text)
+			htmlEnd = htmlBlockEnd(lines, i)
+		}
+		cur = append(cur, l.Text)
+	}
+	flush()
+
+	// Trailing blank lines kept for a continuation that never came are
+	// dropped so that block text is stable while typing.
+	for i := range blocks {
+		blocks[i].Text = strings.TrimRight(blocks[i].Text, "\n") + "\n"
+	}
+	return blocks
+}
+
+// htmlBlockEnd returns the line that closes an HTML block or comment
+// opening at line i, or -1 if none opens there or it is never closed, in
+// which case gomarkdown does not treat it as HTML either. Like gomarkdown,
+// a comment ends at its first "-->" and a tag at the first line ending in
+// its closing tag that is followed by a blank line.
+func htmlBlockEnd(lines []sourceLine, i int) int {
+	if strings.HasPrefix(lines[i].Text, "<!--") {
+		for j := i; j < len(lines); j++ {
+			if end := strings.Index(lines[j].Text, "-->"); end >= 0 {
+				if strings.TrimSpace(lines[j].Text[end+3:]) != "" {
+					return -1
+				}
+				return j
+			}
+		}
+		return -1
+	}
+	m := htmlBlockPattern.FindStringSubmatch(lines[i].Text)
+	if m == nil || !htmlBlockTags[m[1]] {
+		return -1
+	}
+	closing := "</" + m[1] + ">"
+	for j := i; j < len(lines); j++ {
+		if strings.HasSuffix(strings.TrimRight(lines[j].Text, " \t"), closing) &&
+			(j+1 == len(lines) || strings.TrimSpace(lines[j+1].Text) == "") {
+			return j
+		}
+	}
+	return -1
+}
+
+// continuesBlock reports whether the block interrupted by the blank line
+// at index i carries on after it.
+func continuesBlock(lines []sourceLine, i int, inList bool) bool {
+	for j := i + 1; j < len(lines); j++ {
+		next := lines[j].Text
+		if strings.TrimSpace(next) == "" {
+			continue
+		}
+		if strings.HasPrefix(next, "    ") || strings.HasPrefix(next, "\t") {
+			return true
+		}
+		return inList && listItemPattern.MatchString(next)
+	}
+	return false
+}
+
+// renderPreviewHTML renders a document for the preview pane.
+func renderPreviewHTML(ctx context.Context, src []byte) (string, error) {
+	return renders.render(renderKey("preview", src), func() (string, error) {
+		body, err := renderBlocksHTML(ctx, src)
+		if err != nil {
+			return "", err
+		}
+		return `<div class="markdown-body">` + body + `</div>`, nil
+	})
+}
+
+// renderBlocksHTML renders each top-level block separately and wraps it in
+// an element carrying its source line, which lets the preview scroll to a
+// given editor line. Reference definitions are shared with every block so
+// that reference-style links still resolve. Rendering stops between blocks
+// once ctx is done.
+func renderBlocksHTML(ctx context.Context, src []byte) (string, error) {
+	blocks := splitBlocks(src)
+	refs := referenceDefinitions(blocks)
+	var b strings.Builder
+	for _, block := range blocks {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		b.WriteString(renderBlock(block, refs))
+	}
+	return b.String(), nil
+}
+
+func renderBlock(block sourceBlock, refs string) string {
+	src := []byte(block.Text + refs)
+	body, _ := renders.render(renderKey("block", src), func() (string, error) {
+		return withBasePathLinks(string(markdown.ToHTML(src, nil, nil))), nil
+	})
+	return fmt.Sprintf(`<div class="md-block" data-line="%d">`, block.Line+1) + body + "</div>\n"
+}
+
+// blockRenderer remembers the blocks last sent to one preview so that the
+// next render only has to send the blocks that changed.
+type blockRenderer struct {
+	mu     sync.Mutex
+	blocks []sourceBlock
+	refs   string
+	valid  bool
+}
+
+// update renders src as a patch against the previous render. Blocks are
+// matched by text from both ends of the document; everything in between is
+// re-rendered. A change to the reference definitions, which every block
+// shares, or reset forces a full render. If ctx ends first the next update
+// starts over with a full render.
+func (r *blockRenderer) update(ctx context.Context, src []byte, reset bool) (wsproto.Patch, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	blocks := splitBlocks(src)
+	refs := referenceDefinitions(blocks)
+	old := r.blocks
+	if reset || !r.valid || refs != r.refs {
+		old = nil
+	}
+
+	prefix := 0
+	for prefix < len(old) && prefix < len(blocks) && old[prefix] == blocks[prefix] {
+		prefix++
+	}
+	suffix, shift := 0, 0
+	if prefix < len(old) && prefix < len(blocks) {
+		shift = blocks[len(blocks)-1].Line - old[len(old)-1].Line
+	}
+	for suffix < len(old)-prefix && suffix < len(blocks)-prefix {
+		o, n := old[len(old)-1-suffix], blocks[len(blocks)-1-suffix]
+		if o.Text != n.Text || n.Line-o.Line != shift {
+			break
+		}
+		suffix++
+	}
+	if suffix == 0 {
+		shift = 0
+	}
+
+	patch := wsproto.Patch{
+		Reset:  old == nil,
+		Start:  prefix,
+		Delete: len(old) - prefix - suffix,
+		Insert: []string{},
+		Shift:  shift,
+	}
+	r.valid = false
+	for _, block := range blocks[prefix : len(blocks)-suffix] {
+		if err := ctx.Err(); err != nil {
+			return wsproto.Patch{}, err
+		}
+		patch.Insert = append(patch.Insert, renderBlock(block, refs))
+	}
+	r.blocks, r.refs, r.valid = blocks, refs, true
+	return patch, nil
+}
+
+func referenceDefinitions(blocks []sourceBlock) string {
+	var defs []string
+	for _, block := range blocks {
+		for _, line := range strings.Split(block.Text, "\n") {
+			if refDefPattern.MatchString(line) {
+				defs = append(defs, line)
+			}
+		}
+	}
+	if len(defs) == 0 {
+		return ""
+	}
+	return "\n" + strings.Join(defs, "\n") + "\n"
+}
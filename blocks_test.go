@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/gomarkdown/markdown"
+)
+
+// normalizeHTML drops the differences in whitespace between blocks that
+// rendering them one at a time brings.
+func normalizeHTML(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// TestBlocksMatchWholeDocument renders documents block by block, the way
+// renderBlock does, and compares that with rendering them whole.
+func TestBlocksMatchWholeDocument(t *testing.T) {
+	docs := map[string]string{
+		"paragraphs":       "# Title\n\nOne\ntwo\n\nThree\n",
+		"details":          "<details>\n<summary>More</summary>\n\nhidden **body**\n\n</details>\n\nAfter\n",
+		"nested html text": "<div>\n\n*a*\n\n</div>\n<p>not closed here\n\nText\n",
+		"unclosed html":    "<div>\n\nopen\n\nText\n",
+		"comment":          "<!-- a\n\nb -->\n\nText\n",
+		"fenced code":      "```\na\n\nb\n```\n\nText\n",
+		"loose list":       "- a\n\n- b\n\n  more b\n\nText\n",
+		"indented code":    "Para\n\n    code\n\n    more code\n\nText\n",
+		"reference links":  "See [x][1].\n\nAnd [x][1] again.\n\n[1]: https://example.com\n",
+		"table":            "| a | b |\n|---|---|\n| 1 | 2 |\n\nText\n",
+	}
+	for name, doc := range docs {
+		blocks := splitBlocks([]byte(doc))
+		refs := referenceDefinitions(blocks)
+		var chunked string
+		for _, b := range blocks {
+			chunked += string(markdown.ToHTML([]byte(b.Text+refs), nil, nil))
+		}
+		whole := string(markdown.ToHTML([]byte(doc), nil, nil))
+		if normalizeHTML(chunked) != normalizeHTML(whole) {
+			t.Errorf("%s:\nblocks: %q\nwhole:  %q", name, chunked, whole)
+		}
+	}
+}
+
+func TestSplitBlocksKeepsHTMLBlocks(t *testing.T) {
+	doc := "Intro\n\n<details>\n<summary>More</summary>\n\nhidden **body**\n\n</details>\n\nAfter\n"
+	var got []int
+	for _, b := range splitBlocks([]byte(doc)) {
+		got = append(got, b.Line)
+	}
+	if want := []int{0, 2, 9}; len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Errorf("blocks start on lines %v, want %v", got, want)
+	}
+}
+
+// TestBlockRendererPatches applies each patch to a copy of the preview's
+// blocks, the way the browser does, and checks the result against a full
+// render of the new text.
+func TestBlockRendererPatches(t *testing.T) {
+	edits := []string{
+		"# Title\n\nOne\n\nTwo\n",
+		"# Title\n\nOne, edited\n\nTwo\n",
+		"# Title\n\nNew\n\nOne, edited\n\nTwo\n",
+		"# Title\n\nTwo\n",
+		"# Title\n\n<details>\n\nhidden\n\n</details>\n\nTwo\n",
+		"# Title\n\nSee [x][1].\n\nTwo\n\n[1]: https://example.com\n",
+		"",
+		"Fresh start\n",
+	}
+	var r blockRenderer
+	var preview []string
+	for i, text := range edits {
+		patch, err := r.update(context.Background(), []byte(text), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if patch.Reset {
+			preview = nil
+		}
+		tail := append([]string{}, preview[patch.Start+patch.Delete:]...)
+		preview = append(append(preview[:patch.Start], patch.Insert...), tail...)
+		if patch.Shift != 0 {
+			for j := patch.Start + len(patch.Insert); j < len(preview); j++ {
+				preview[j] = shiftBlockLine(t, preview[j], patch.Shift)
+			}
+		}
+
+		want, err := renderBlocksHTML(context.Background(), []byte(text))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(preview, ""); got != want {
+			t.Errorf("edit %d:\npatched: %q\nfull:    %q", i, got, want)
+		}
+	}
+}
+
+// shiftBlockLine moves a rendered block's data-line by shift.
+func shiftBlockLine(t *testing.T, block string, shift int) string {
+	var line int
+	if _, err := fmt.Sscanf(block, `<div class="md-block" data-line="%d">`, &line); err != nil {
+		t.Fatalf("block without a line: %q", block)
+	}
+	return strings.Replace(block, fmt.Sprintf(`data-line="%d"`, line), fmt.Sprintf(`data-line="%d"`, line+shift), 1)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/yourusername/markdown-preview/wsproto"
+)
+
+// bufferStore holds the latest unsaved buffer pushed by an external editor.
+type bufferStore struct {
+	mu   sync.Mutex
+	path string
+	text string
+	line int
+	set  bool
+}
+
+var buffers = &bufferStore{}
+
+// apply records u and returns the event to broadcast, or an empty type if
+// u carried nothing new.
+func (b *bufferStore) apply(u wsproto.PushBuffer) (string, interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if u.Text == nil {
+		if !b.set || u.Line == 0 || u.Line == b.line {
+			return "", nil
+		}
+		b.line = u.Line
+		return wsproto.TypeCursor, wsproto.Cursor{Path: b.path, Line: b.line}
+	}
+	if u.Line > 0 {
+		b.line = u.Line
+	}
+	b.path, b.text, b.set = u.Path, *u.Text, true
+	return wsproto.TypeContentChanged, b.contentLocked()
+}
+
+// current returns the pushed buffer, if any, as a content-changed event.
+func (b *bufferStore) current() (wsproto.ContentChanged, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.contentLocked(), b.set
+}
+
+func (b *bufferStore) contentLocked() wsproto.ContentChanged {
+	return wsproto.ContentChanged{Source: "buffer", Path: b.path, Text: b.text, Line: b.line}
+}
+
+// pushBuffer applies an editor update and tells every client about it,
+// following new text with fresh diagnostics.
+func pushBuffer(u wsproto.PushBuffer) {
+	typ, payload := buffers.apply(u)
+	if typ == "" {
+		return
+	}
+	content, ok := payload.(wsproto.ContentChanged)
+	if ok {
+		// Browsers take the new text from the shared document, so merge
+		// it there before announcing it.
+		collab.replace(content.Text)
+	}
+	hub.broadcastEvent(typ, payload)
+	if ok {
+		hub.broadcastEvent(wsproto.TypeDiagnostics, documentDiagnostics(content.Path, []byte(content.Text)))
+	}
+}
+
+// documentDiagnostics runs the linter and link checker for protocol clients.
+func documentDiagnostics(path string, src []byte) wsproto.Diagnostics {
+	diags := lintMarkdown(src)
+	if path != "" {
+		diags = append(diags, checkLinks(path, src)...)
+	}
+	out := wsproto.Diagnostics{Path: path, Diagnostics: []wsproto.Diagnostic{}}
+	for _, d := range diags {
+		severity := "info"
+		switch d.Severity {
+		case severityError:
+			severity = "error"
+		case severityWarning:
+			severity = "warning"
+		}
+		out.Diagnostics = append(out.Diagnostics, wsproto.Diagnostic{
+			Line:     d.Line + 1,
+			Col:      d.Col + 1,
+			Severity: severity,
+			Source:   d.Source,
+			Message:  d.Message,
+		})
+	}
+	return out
+}
+
+// handleBufferPush accepts {"path": ..., "text": ..., "line": ...} from
+// an editor integration such as the lsp subcommand and forwards it to
+// every browser. Omitting text moves the cursor only.
+func handleBufferPush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limitBody(w, r)
+	var u wsproto.PushBuffer
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Invalid buffer payload", http.StatusBadRequest)
+		return
+	}
+
+	pushBuffer(u)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleEditorSocket is the streaming variant of /buffer for editor
+// plugins that push on every keystroke or cursor move. Each text frame is
+// a bare JSON buffer update; clients that want replies and events should
+// speak the full protocol on /ws instead.
+func handleEditorSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer conn.Close()
+	if !hub.addEditor(conn) {
+		conn.WriteControl(websocket.CloseMessage, goingAway, time.Now().Add(time.Second))
+		return
+	}
+	defer hub.removeEditor(conn)
+	conn.SetReadLimit(int64(*maxBodyMB) << 20)
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var u wsproto.PushBuffer
+		if err := json.Unmarshal(data, &u); err != nil {
+			// Malformed JSON and wrong field types alike are answered
+			// without dropping the editor.
+			log.Printf("Invalid editor update: %v", err)
+			if msg, err := wsproto.Encode(wsproto.TypeError, "", wsproto.ErrorPayload{Code: wsproto.ErrBadMessage, Message: err.Error()}); err == nil {
+				conn.WriteMessage(websocket.TextMessage, msg)
+			}
+			continue
+		}
+		pushBuffer(u)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/yourusername/markdown-preview/wsproto"
+)
+
+func TestEditorSocketKeepsConnectionOnBadUpdate(t *testing.T) {
+	srv := newTestServer(t)
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws/editor"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": {srv.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, update := range []string{`{"path":1}`, `{"text":`, `{"line":"three"}`} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(update)); err != nil {
+			t.Fatalf("%s: %v", update, err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var msg wsproto.Message
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("%s: connection dropped: %v", update, err)
+		}
+		var e wsproto.ErrorPayload
+		if msg.Type != wsproto.TypeError || msg.Decode(&e) != nil || e.Code != wsproto.ErrBadMessage {
+			t.Errorf("%s: got %s %s, want a %s error", update, msg.Type, msg.Payload, wsproto.ErrBadMessage)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gomarkdown/markdown/html"
+	"github.com/gomarkdown/markdown/parser"
+)
+
+// renderOptions identifies everything besides the source that affects
+// rendered HTML. It is part of every cache key, so changing how documents
+// are parsed or rendered never serves stale output. The only other input
+// is -base-path, which renderKey adds: the output is not sanitized, and
+// the theme is only CSS.
+var renderOptions = fmt.Sprintf("ext=%d,html=%d", parser.CommonExtensions, html.CommonFlags)
+
+// renderCache is an LRU cache of rendered HTML bounded by the total size of
+// the cached output. Keys are content hashes of everything a render reads,
+// so an entry never goes stale.
+type renderCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	bytes    int64
+	lru      *list.List // front is most recently used
+	items    map[string]*list.Element
+
+	hits, misses, evictions atomic.Int64
+}
+
+type cacheEntry struct {
+	key  string
+	html string
+}
+
+var renders = newRenderCache(32 << 20)
+
+func newRenderCache(maxBytes int64) *renderCache {
+	c := &renderCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		items:    make(map[string]*list.Element),
+	}
+	return c
+}
+
+// renderKey derives the cache key for rendering src as the given kind of
+// output.
+func renderKey(kind string, src []byte) string {
+	sum := sha256.Sum256(src)
+	return kind + "|" + renderOptions + "|" + basePath + "|" + hex.EncodeToString(sum[:])
+}
+
+// setLimit changes the memory limit, evicting entries if needed. Zero
+// disables caching.
+func (c *renderCache) setLimit(maxBytes int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxBytes = maxBytes
+	c.evictLocked()
+}
+
+// render returns the cached output for key, calling build on a miss.
+// Failed builds are not cached.
+func (c *renderCache) render(key string, build func() (string, error)) (string, error) {
+	c.mu.Lock()
+	if el, ok := c.items[key]; ok {
+		c.lru.MoveToFront(el)
+		c.mu.Unlock()
+		c.hits.Add(1)
+		return el.Value.(*cacheEntry).html, nil
+	}
+	c.mu.Unlock()
+	c.misses.Add(1)
+
+	out, err := build()
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.items[key]; ok || entrySize(key, out) > c.maxBytes {
+		return out, nil
+	}
+	c.items[key] = c.lru.PushFront(&cacheEntry{key: key, html: out})
+	c.bytes += entrySize(key, out)
+	c.evictLocked()
+	return out, nil
+}
+
+func (c *renderCache) evictLocked() {
+	for c.bytes > c.maxBytes && c.lru.Len() > 0 {
+		c.removeLocked(c.lru.Back())
+		c.evictions.Add(1)
+	}
+}
+
+func (c *renderCache) removeLocked(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	delete(c.items, e.key)
+	c.bytes -= entrySize(e.key, e.html)
+}
+
+func entrySize(key, html string) int64 {
+	return int64(len(key) + len(html))
+}
+
+// cacheStats is what /debug/vars reports about a render cache.
+type cacheStats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	Entries   int   `json:"entries"`
+	Bytes     int64 `json:"bytes"`
+}
+
+func (c *renderCache) stats() cacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return cacheStats{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+		Entries:   c.lru.Len(),
+		Bytes:     c.bytes,
+	}
+}
+
+// handleCacheStats serves the render cache counters in the expvar JSON
+// format. The expvar package itself is not used: its registry also
+// publishes the command line and memory statistics.
+func handleCacheStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]cacheStats{"render_cache": renders.stats()})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRenderCache(t *testing.T) {
+	key := func(s string) string { return renderKey("block", []byte(s)) }
+	builds := 0
+	build := func(out string) func() (string, error) {
+		return func() (string, error) {
+			builds++
+			return out, nil
+		}
+	}
+	size := entrySize(key("a"), "AAAA")
+	c := newRenderCache(2 * size)
+
+	tests := []struct {
+		name       string
+		key        string
+		build      func() (string, error)
+		want       string
+		wantBuilds int
+	}{
+		{"miss", key("a"), build("AAAA"), "AAAA", 1},
+		{"hit", key("a"), build("stale"), "AAAA", 1},
+		{"second entry", key("b"), build("BBBB"), "BBBB", 2},
+		{"touch a", key("a"), build("stale"), "AAAA", 2},
+		{"evicts b, the least recently used", key("c"), build("CCCC"), "CCCC", 3},
+		{"a survived", key("a"), build("stale"), "AAAA", 3},
+		{"b was evicted", key("b"), build("BBBB"), "BBBB", 4},
+		{"other kind", renderKey("preview", []byte("a")), build("PPPP"), "PPPP", 5},
+	}
+	for _, tt := range tests {
+		got, err := c.render(tt.key, tt.build)
+		if err != nil || got != tt.want || builds != tt.wantBuilds {
+			t.Errorf("%s: got %q, %v after %d builds, want %q after %d", tt.name, got, err, builds, tt.want, tt.wantBuilds)
+		}
+	}
+	if c.bytes > c.maxBytes {
+		t.Errorf("cache holds %d bytes, limit %d", c.bytes, c.maxBytes)
+	}
+}
+
+func TestRenderCacheSkipsFailures(t *testing.T) {
+	c := newRenderCache(1 << 20)
+	fail := errors.New("render failed")
+	if _, err := c.render("k", func() (string, error) { return "", fail }); err != fail {
+		t.Fatalf("err = %v, want %v", err, fail)
+	}
+	if got, _ := c.render("k", func() (string, error) { return "ok", nil }); got != "ok" {
+		t.Errorf("failed build was cached: got %q", got)
+	}
+
+	c.setLimit(0)
+	if c.lru.Len() != 0 || c.bytes != 0 {
+		t.Errorf("limit 0 left %d entries, %d bytes", c.lru.Len(), c.bytes)
+	}
+}
+
+func TestCacheStatsOnly(t *testing.T) {
+	renders.render(renderKey("block", []byte("stats")), func() (string, error) { return "x", nil })
+	rec := httptest.NewRecorder()
+	handleCacheStats(rec, httptest.NewRequest(http.MethodGet, "/debug/vars", nil))
+	var vars map[string]map[string]int64
+	if err := json.NewDecoder(rec.Body).Decode(&vars); err != nil {
+		t.Fatal(err)
+	}
+	if len(vars) != 1 || vars["render_cache"] == nil {
+		var names []string
+		for name := range vars {
+			names = append(names, name)
+		}
+		t.Fatalf("/debug/vars publishes %s, want only render_cache", strings.Join(names, ", "))
+	}
+	for _, name := range []string{"hits", "misses", "evictions", "entries", "bytes"} {
+		if _, ok := vars["render_cache"][name]; !ok {
+			t.Errorf("render_cache has no %s", name)
+		}
+	}
+	if vars["render_cache"]["misses"] == 0 {
+		t.Errorf("render_cache = %v, want the miss counted", vars["render_cache"])
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/yourusername/markdown-preview/wsproto"
+)
+
+// serverSite is the CRDT site of edits the server makes itself, when the
+// watched file is written or an editor plugin pushes a buffer.
+const serverSite = "server"
+
+// collabSession is the document the browser tabs edit together. The mutex
+// orders edits: each is applied and relayed before the next, so every
+// client sees them in the same order as the server, and a client joining
+// gets a snapshot with no edit missing or repeated after it.
+type collabSession struct {
+	mu  sync.Mutex
+	doc *rga
+}
+
+var collab = &collabSession{doc: newRGA()}
+
+// join sends c the document and everybody's selection, and relays edits
+// to it from then on.
+func (s *collabSession) join(c *wsClient, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hub.joinCollab(c, id, s.doc.snapshot())
+}
+
+// edit applies an edit from c and relays it to the other clients.
+func (s *collabSession) edit(c *wsClient, e wsproto.Edit) error {
+	if err := validateEdit(c.session, e); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.doc.known(e) {
+		return errors.New("edit refers to characters the server does not have")
+	}
+	if err := s.doc.checkIDs(e); err != nil {
+		return err
+	}
+	s.doc.apply(e)
+	e.Session = c.session
+	s.relay(c, e)
+	return nil
+}
+
+// replace makes text the shared document, as an edit by the server.
+func (s *collabSession) replace(text string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.doc.text() == text {
+		return
+	}
+	e := s.doc.replace(serverSite, text)
+	e.Session = serverSite
+	s.relay(nil, e)
+}
+
+// text returns the shared document.
+func (s *collabSession) text() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.doc.text()
+}
+
+func (s *collabSession) relay(from *wsClient, e wsproto.Edit) {
+	msg, err := wsproto.Encode(wsproto.TypeEdit, "", e)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	hub.broadcastCollab(from, msg)
+}
+
+// joinCollab answers a join with the document and the other editors'
+// selections, and marks c as editing the shared document.
+func (h *wsHub) joinCollab(c *wsClient, id string, runs []wsproto.Run) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	snapshot := wsproto.Snapshot{Runs: runs, Selections: []wsproto.Selection{}}
+	for other := range h.clients {
+		if other != c && other.selection != nil {
+			snapshot.Selections = append(snapshot.Selections, *other.selection)
+		}
+	}
+	msg, err := wsproto.Encode(wsproto.TypeSnapshot, id, snapshot)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if h.clients[c] {
+		c.collab = true
+		h.sendLocked(c, msg)
+	}
+}
+
+// broadcastCollab queues msg for every client editing the shared document
+// except from.
+func (h *wsHub) broadcastCollab(from *wsClient, msg []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		if c.collab && c != from {
+			h.sendLocked(c, msg)
+		}
+	}
+}
+
+// setSelection records c's selection and relays it to the other editors.
+func (h *wsHub) setSelection(c *wsClient, sel wsproto.Selection) {
+	sel.Session, sel.Name = c.session, c.name
+	msg, err := wsproto.Encode(wsproto.TypeSelection, "", sel)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c.selection = &sel
+	for other := range h.clients {
+		if other.collab && other != c {
+			h.sendLocked(other, msg)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/yourusername/markdown-preview/wsproto"
+)
+
+// rga is a replicated growable array, the sequence CRDT behind
+// collaborative editing. Every character ever inserted keeps its place,
+// deleted ones as tombstones, so edits that name them still apply. Inserts
+// at the same place are ordered by ID, highest Lamport clock first, which
+// every replica works out the same way whatever order the edits arrive in.
+// The browser keeps the same structure in JavaScript.
+type rga struct {
+	chars []*rgaChar
+	byID  map[wsproto.CharID]*rgaChar
+	clock uint64
+
+	// Edits naming characters that have not arrived yet wait here.
+	pendingInserts []wsproto.Insert
+	pendingDeletes map[wsproto.CharID]bool
+}
+
+type rgaChar struct {
+	id      wsproto.CharID
+	r       rune
+	deleted bool
+	at      int // index in chars
+}
+
+func newRGA() *rga {
+	return &rga{
+		byID:           make(map[wsproto.CharID]*rgaChar),
+		pendingDeletes: make(map[wsproto.CharID]bool),
+	}
+}
+
+// idAfter reports whether a sorts after b among inserts at the same place.
+func idAfter(a, b wsproto.CharID) bool {
+	return a.Clock > b.Clock || (a.Clock == b.Clock && a.Site > b.Site)
+}
+
+// validateEdit checks an edit a client sends: it may only insert
+// characters of its own site, with clocks above the character they follow.
+func validateEdit(site string, e wsproto.Edit) error {
+	for _, ins := range e.Insert {
+		if ins.ID.Site != site {
+			return errors.New("inserted characters must carry the sender's session as site")
+		}
+		if ins.ID.Clock <= ins.After.Clock {
+			return errors.New("an insert's clock must be higher than the character it follows")
+		}
+		if ins.Text == "" {
+			return errors.New("empty insert")
+		}
+	}
+	for _, span := range e.Delete {
+		if span.Site == "" || span.Clock == 0 || span.Len <= 0 {
+			return errors.New("invalid delete span")
+		}
+	}
+	return nil
+}
+
+// maxClockSkew is how far past the replica's clock a client may start an
+// insert. A client picks the clock after the highest it has seen, and the
+// server has seen everything the client has, so honest clients never need
+// it; it only keeps a client from pushing the clock towards overflow.
+const maxClockSkew = 1024
+
+// checkIDs rejects an edit from a client whose inserts reuse IDs the
+// replica or the edit already has, or run clocks far past the replica's.
+func (d *rga) checkIDs(e wsproto.Edit) error {
+	top := d.clock
+	seen := map[wsproto.CharID]bool{}
+	for _, ins := range e.Insert {
+		if ins.ID.Clock > top+1+maxClockSkew {
+			return errors.New("an insert's clock runs too far ahead of the document")
+		}
+		n := uint64(utf8.RuneCountInString(ins.Text))
+		if last := ins.ID.Clock + n - 1; last > top {
+			top = last
+		}
+		id := ins.ID
+		for i := uint64(0); i < n; i++ {
+			if d.byID[id] != nil || seen[id] {
+				return errors.New("inserted characters reuse IDs already in the document")
+			}
+			seen[id] = true
+			id.Clock++
+		}
+	}
+	return nil
+}
+
+// known reports whether every character e names is in the replica or
+// inserted by e itself. Clients only name characters they have seen, and
+// the server has always seen them first, so the server rejects edits that
+// fail this instead of holding them back.
+func (d *rga) known(e wsproto.Edit) bool {
+	added := map[wsproto.CharID]bool{}
+	for _, ins := range e.Insert {
+		if ins.After != (wsproto.CharID{}) && d.byID[ins.After] == nil && !added[ins.After] {
+			return false
+		}
+		id := ins.ID
+		for range ins.Text {
+			added[id] = true
+			id.Clock++
+		}
+	}
+	for _, span := range e.Delete {
+		if span.Len > len(d.chars) {
+			return false
+		}
+		for i := 0; i < span.Len; i++ {
+			id := wsproto.CharID{Site: span.Site, Clock: span.Clock + uint64(i)}
+			if d.byID[id] == nil && !added[id] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// apply merges an edit from any replica. Applying the same edit twice, or
+// edits in a different order, gives the same result.
+func (d *rga) apply(e wsproto.Edit) {
+	for _, span := range e.Delete {
+		for i := 0; i < span.Len; i++ {
+			id := wsproto.CharID{Site: span.Site, Clock: span.Clock + uint64(i)}
+			if c := d.byID[id]; c != nil {
+				c.deleted = true
+			} else {
+				d.pendingDeletes[id] = true
+			}
+		}
+		d.observe(span.Clock + uint64(span.Len) - 1)
+	}
+
+	d.pendingInserts = append(d.pendingInserts, e.Insert...)
+	for progress := true; progress; {
+		progress = false
+		waiting := d.pendingInserts[:0]
+		for _, ins := range d.pendingInserts {
+			if d.integrate(ins) {
+				progress = true
+			} else {
+				waiting = append(waiting, ins)
+			}
+		}
+		d.pendingInserts = waiting
+	}
+}
+
+// integrate places the characters of ins, or reports false if the
+// character it follows is not known yet.
+func (d *rga) integrate(ins wsproto.Insert) bool {
+	after := -1
+	if ins.After != (wsproto.CharID{}) {
+		c := d.byID[ins.After]
+		if c == nil {
+			return false
+		}
+		after = c.at
+	}
+	if d.byID[ins.ID] != nil {
+		// Already applied.
+		return true
+	}
+
+	// Skip the inserts at the same place that sort first, along with
+	// everything typed after them, which has even higher clocks. The rest
+	// of the run sorts after whatever follows the first character, since
+	// its clocks are higher still, so the whole run goes in here.
+	i := after + 1
+	for i < len(d.chars) && idAfter(d.chars[i].id, ins.ID) {
+		i++
+	}
+	var run []*rgaChar
+	id := ins.ID
+	for _, r := range ins.Text {
+		c := &rgaChar{id: id, r: r, deleted: d.pendingDeletes[id]}
+		delete(d.pendingDeletes, id)
+		d.byID[id] = c
+		run = append(run, c)
+		id.Clock++
+	}
+	d.chars = append(d.chars[:i], append(run, d.chars[i:]...)...)
+	for j := i; j < len(d.chars); j++ {
+		d.chars[j].at = j
+	}
+	d.observe(id.Clock - 1)
+	return true
+}
+
+func (d *rga) observe(clock uint64) {
+	if clock > d.clock {
+		d.clock = clock
+	}
+}
+
+// text returns the visible document.
+func (d *rga) text() string {
+	var b strings.Builder
+	for _, c := range d.chars {
+		if !c.deleted {
+			b.WriteRune(c.r)
+		}
+	}
+	return b.String()
+}
+
+// snapshot lists the document, tombstones included, as runs a new replica
+// can load.
+func (d *rga) snapshot() []wsproto.Run {
+	runs := []wsproto.Run{}
+	var last *wsproto.Run
+	var next wsproto.CharID
+	for _, c := range d.chars {
+		if last != nil && c.id == next && c.deleted == last.Deleted {
+			last.Text += string(c.r)
+		} else {
+			runs = append(runs, wsproto.Run{ID: c.id, Text: string(c.r), Deleted: c.deleted})
+			last = &runs[len(runs)-1]
+		}
+		next = wsproto.CharID{Site: c.id.Site, Clock: c.id.Clock + 1}
+	}
+	return runs
+}
+
+// load replaces the replica with a snapshot.
+func (d *rga) load(runs []wsproto.Run) {
+	*d = *newRGA()
+	for _, run := range runs {
+		id := run.ID
+		for _, r := range run.Text {
+			c := &rgaChar{id: id, r: r, deleted: run.Deleted, at: len(d.chars)}
+			d.chars = append(d.chars, c)
+			d.byID[id] = c
+			id.Clock++
+		}
+		d.observe(id.Clock - 1)
+	}
+}
+
+// replace turns the visible text into text as a local change by site. It
+// deletes what changed between the common prefix and suffix, inserts the
+// new middle, and returns the edit to send to the other replicas.
+func (d *rga) replace(site, text string) wsproto.Edit {
+	var visible []*rgaChar
+	for _, c := range d.chars {
+		if !c.deleted {
+			visible = append(visible, c)
+		}
+	}
+	runes := []rune(text)
+	start := 0
+	for start < len(visible) && start < len(runes) && visible[start].r == runes[start] {
+		start++
+	}
+	end := 0
+	for end < len(visible)-start && end < len(runes)-start && visible[len(visible)-1-end].r == runes[len(runes)-1-end] {
+		end++
+	}
+
+	var e wsproto.Edit
+	for _, c := range visible[start : len(visible)-end] {
+		c.deleted = true
+		if n := len(e.Delete); n > 0 && e.Delete[n-1].Site == c.id.Site && e.Delete[n-1].Clock+uint64(e.Delete[n-1].Len) == c.id.Clock {
+			e.Delete[n-1].Len++
+		} else {
+			e.Delete = append(e.Delete, wsproto.Span{Site: c.id.Site, Clock: c.id.Clock, Len: 1})
+		}
+	}
+	if middle := runes[start : len(runes)-end]; len(middle) > 0 {
+		ins := wsproto.Insert{ID: wsproto.CharID{Site: site, Clock: d.clock + 1}, Text: string(middle)}
+		if start > 0 {
+			ins.After = visible[start-1].id
+		}
+		d.integrate(ins)
+		e.Insert = append(e.Insert, ins)
+	}
+	return e
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yourusername/markdown-preview/wsproto"
+)
+
+// randomChange rewrites a random stretch of text, the way typing, pasting
+// and deleting a selection do.
+func randomChange(rng *rand.Rand, text string) string {
+	runes := []rune(text)
+	start := rng.Intn(len(runes) + 1)
+	end := start + rng.Intn(min(4, len(runes)-start)+1)
+	words := []string{"a", "b", "ab", "\n", "# ", "héllo", "🙂", " "}
+	insert := ""
+	for n := rng.Intn(3); n > 0; n-- {
+		insert += words[rng.Intn(len(words))]
+	}
+	return string(runes[:start]) + insert + string(runes[end:])
+}
+
+// TestRGAConvergesOutOfOrder lets replicas edit concurrently and delivers
+// every edit to every other replica late, shuffled and sometimes twice.
+func TestRGAConvergesOutOfOrder(t *testing.T) {
+	for seed := int64(1); seed <= 50; seed++ {
+		rng := rand.New(rand.NewSource(seed))
+		sites := []string{"a", "b", "c", "d"}
+		replicas := make([]*rga, len(sites))
+		inbox := make([][]wsproto.Edit, len(sites))
+		for i := range replicas {
+			replicas[i] = newRGA()
+		}
+
+		for round := 0; round < 40; round++ {
+			i := rng.Intn(len(replicas))
+			edit := replicas[i].replace(sites[i], randomChange(rng, replicas[i].text()))
+			for j := range replicas {
+				if j != i {
+					inbox[j] = append(inbox[j], edit)
+				}
+			}
+			// Deliver some of the waiting edits in a random order.
+			j := rng.Intn(len(replicas))
+			rng.Shuffle(len(inbox[j]), func(a, b int) { inbox[j][a], inbox[j][b] = inbox[j][b], inbox[j][a] })
+			n := rng.Intn(len(inbox[j]) + 1)
+			for _, e := range inbox[j][:n] {
+				replicas[j].apply(e)
+				if rng.Intn(5) == 0 {
+					replicas[j].apply(e)
+				}
+			}
+			inbox[j] = inbox[j][n:]
+		}
+
+		for j := range replicas {
+			rng.Shuffle(len(inbox[j]), func(a, b int) { inbox[j][a], inbox[j][b] = inbox[j][b], inbox[j][a] })
+			for _, e := range inbox[j] {
+				replicas[j].apply(e)
+			}
+		}
+		want := replicas[0].text()
+		for j, r := range replicas {
+			if got := r.text(); got != want {
+				t.Fatalf("seed %d: replica %s has %q, replica a has %q", seed, sites[j], got, want)
+			}
+			if len(r.pendingInserts) > 0 || len(r.pendingDeletes) > 0 {
+				t.Fatalf("seed %d: replica %s still has pending edits", seed, sites[j])
+			}
+		}
+	}
+}
+
+func TestRGASnapshot(t *testing.T) {
+	a := newRGA()
+	a.replace("a", "hello world")
+	a.replace("a", "hello, brave world")
+	a.replace("a", "hello, world 🙂")
+
+	b := newRGA()
+	b.load(a.snapshot())
+	if b.text() != a.text() {
+		t.Fatalf("loaded %q, want %q", b.text(), a.text())
+	}
+	// Both sides keep editing from the snapshot.
+	ea := a.replace("a", "hello, world 🙂!")
+	eb := b.replace("b", "Hello, world 🙂")
+	a.apply(eb)
+	b.apply(ea)
+	if a.text() != "Hello, world 🙂!" || b.text() != a.text() {
+		t.Fatalf("replicas diverged: %q and %q", a.text(), b.text())
+	}
+}
+
+// collabTestClient is a browser stand-in: a replica of the shared document
+// kept in step with the server over /ws.
+type collabTestClient struct {
+	conn *wsproto.Client
+	site string
+
+	mu  sync.Mutex
+	doc *rga
+
+	pongs chan struct{}
+	done  chan error
+}
+
+func dialCollab(t *testing.T, url string) *collabTestClient {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := wsproto.Dial(ctx, url, nil, wsproto.Hello{Client: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := conn.Request(ctx, wsproto.TypeJoin, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snapshot wsproto.Snapshot
+	if err := reply.Decode(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	c := &collabTestClient{
+		conn:  conn,
+		site:  conn.Welcome().Session,
+		doc:   newRGA(),
+		pongs: make(chan struct{}, 1),
+		done:  make(chan error, 1),
+	}
+	c.doc.load(snapshot.Runs)
+	go c.read()
+	return c
+}
+
+func (c *collabTestClient) read() {
+	for {
+		msg, err := c.conn.Next()
+		if err != nil {
+			c.done <- err
+			return
+		}
+		switch msg.Type {
+		case wsproto.TypeEdit:
+			var e wsproto.Edit
+			if err := msg.Decode(&e); err != nil {
+				c.done <- err
+				return
+			}
+			c.mu.Lock()
+			c.doc.apply(e)
+			c.mu.Unlock()
+		case wsproto.TypePong:
+			c.pongs <- struct{}{}
+		case wsproto.TypeError:
+			c.done <- fmt.Errorf("server error: %s", msg.Payload)
+			return
+		}
+	}
+}
+
+func (c *collabTestClient) edit(rng *rand.Rand) error {
+	c.mu.Lock()
+	e := c.doc.replace(c.site, randomChange(rng, c.doc.text()))
+	c.mu.Unlock()
+	return c.conn.Send(wsproto.TypeEdit, "", e)
+}
+
+// sync waits until the server has handled everything sent so far and the
+// client has everything relayed to it before that.
+func (c *collabTestClient) sync(t *testing.T) {
+	t.Helper()
+	if err := c.conn.Send(wsproto.TypePing, "sync", nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-c.pongs:
+	case err := <-c.done:
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no pong")
+	}
+}
+
+func (c *collabTestClient) text() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.doc.text()
+}
+
+func resetCollab() {
+	collab.mu.Lock()
+	collab.doc = newRGA()
+	collab.mu.Unlock()
+}
+
+// TestCollabConcurrentClients has several clients type into the shared
+// document at once while the watched file changes underneath them.
+func TestCollabConcurrentClients(t *testing.T) {
+	resetCollab()
+	srv := newTestServer(t)
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+
+	clients := make([]*collabTestClient, 4)
+	for i := range clients {
+		clients[i] = dialCollab(t, url)
+		defer clients[i].conn.Close()
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(clients))
+	for i, c := range clients {
+		wg.Add(1)
+		go func(c *collabTestClient, seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+			for n := 0; n < 100; n++ {
+				if err := c.edit(rng); err != nil {
+					errs <- err
+					return
+				}
+				// Type quickly, but not faster than a client's send
+				// queue drains.
+				time.Sleep(time.Duration(rng.Intn(2000)) * time.Microsecond)
+			}
+		}(c, int64(i+1))
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for n := 0; n < 10; n++ {
+			collab.replace(fmt.Sprintf("# Saved %d\n\nfrom the file\n", n))
+			time.Sleep(2 * time.Millisecond)
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	// Once every client's own edits have reached the server, a second
+	// round trip also flushes everything relayed to it.
+	for _, c := range clients {
+		c.sync(t)
+	}
+	for _, c := range clients {
+		c.sync(t)
+	}
+
+	collab.mu.Lock()
+	want := collab.doc.text()
+	collab.mu.Unlock()
+	for i, c := range clients {
+		if got := c.text(); got != want {
+			t.Errorf("client %d has %q, server has %q", i, got, want)
+		}
+	}
+}
+
+func TestCollabRejectsForeignSite(t *testing.T) {
+	resetCollab()
+	srv := newTestServer(t)
+	c := dialCollab(t, "ws"+strings.TrimPrefix(srv.URL, "http")+"/ws")
+	defer c.conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// A second connection sends the forged edit, since c's reader owns Next.
+	conn, err := wsproto.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil, wsproto.Hello{Client: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Request(ctx, wsproto.TypeJoin, nil); err != nil {
+		t.Fatal(err)
+	}
+	forged := wsproto.Edit{Insert: []wsproto.Insert{{ID: wsproto.CharID{Site: c.site, Clock: 1}, Text: "x"}}}
+	if _, err := conn.Request(ctx, wsproto.TypeEdit, forged); err == nil {
+		t.Fatal("edit with another session's site was accepted")
+	}
+}
+
+func TestCollabRejectsReusedAndRunawayIDs(t *testing.T) {
+	resetCollab()
+	srv := newTestServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := wsproto.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil, wsproto.Hello{Client: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Request(ctx, wsproto.TypeJoin, nil); err != nil {
+		t.Fatal(err)
+	}
+	site := conn.Welcome().Session
+	id := func(clock uint64) wsproto.CharID { return wsproto.CharID{Site: site, Clock: clock} }
+
+	first := wsproto.Edit{Insert: []wsproto.Insert{{ID: id(1), Text: "abc"}}}
+	if _, err := conn.Request(ctx, wsproto.TypeEdit, first); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		edit wsproto.Edit
+	}{
+		{"same ID", wsproto.Edit{Insert: []wsproto.Insert{{ID: id(1), Text: "x"}}}},
+		{"run into known IDs", wsproto.Edit{Insert: []wsproto.Insert{{ID: id(3), After: id(2), Text: "xy"}}}},
+		{"overlap within the edit", wsproto.Edit{Insert: []wsproto.Insert{
+			{ID: id(4), After: id(3), Text: "xy"},
+			{ID: id(5), After: id(4), Text: "z"},
+		}}},
+		{"clock far ahead", wsproto.Edit{Insert: []wsproto.Insert{{ID: id(4 + maxClockSkew + 1), After: id(3), Text: "x"}}}},
+		{"clock near overflow", wsproto.Edit{Insert: []wsproto.Insert{{ID: id(^uint64(0) - 1), After: id(3), Text: "x"}}}},
+	}
+	for _, tt := range tests {
+		if _, err := conn.Request(ctx, wsproto.TypeEdit, tt.edit); err == nil {
+			t.Errorf("%s: edit was accepted", tt.name)
+		}
+	}
+
+	collab.mu.Lock()
+	text, clock := collab.doc.text(), collab.doc.clock
+	collab.mu.Unlock()
+	if text != "abc" || clock != 3 {
+		t.Errorf("document is %q at clock %d, want %q at clock 3", text, clock, "abc")
+	}
+
+	// A clock up to the skew ahead is still taken.
+	ok := wsproto.Edit{Insert: []wsproto.Insert{{ID: id(4 + maxClockSkew), After: id(3), Text: "d"}}}
+	if _, err := conn.Request(ctx, wsproto.TypeEdit, ok); err != nil {
+		t.Errorf("edit within the skew: %v", err)
+	}
+}
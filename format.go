@@ -0,0 +1,832 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gomarkdown/markdown/ast"
+	"github.com/gomarkdown/markdown/parser"
+)
+
+// formatOptions controls the layout produced by formatMarkdown.
+type formatOptions struct {
+	ListMarker  byte // bullet for unordered lists: '-', '*' or '+'
+	Emphasis    byte // delimiter for emphasis and strong: '*' or '_'
+	AlignTables bool // pad table cells so that columns line up
+	WrapWidth   int  // wrap paragraphs at this column; 0 keeps source line breaks
+}
+
+func defaultFormatOptions() formatOptions {
+	return formatOptions{
+		ListMarker:  '-',
+		Emphasis:    '*',
+		AlignTables: true,
+	}
+}
+
+// parseFormatOptions validates user supplied formatter settings, coming
+// either from the fmt subcommand or from the /format form fields.
+func parseFormatOptions(listMarker, emphasis string, alignTables bool, wrap int) (formatOptions, error) {
+	opts := formatOptions{AlignTables: alignTables, WrapWidth: wrap}
+	switch listMarker {
+	case "-", "*", "+":
+		opts.ListMarker = listMarker[0]
+	default:
+		return opts, fmt.Errorf("invalid list marker %q (want -, * or +)", listMarker)
+	}
+	switch emphasis {
+	case "*", "_":
+		opts.Emphasis = emphasis[0]
+	default:
+		return opts, fmt.Errorf("invalid emphasis style %q (want * or _)", emphasis)
+	}
+	if wrap < 0 {
+		return opts, fmt.Errorf("invalid wrap width %d", wrap)
+	}
+	return opts, nil
+}
+
+// Placeholders used while laying out paragraphs. Spaces inside code spans
+// and link titles must never become wrap points, and hard breaks have to
+// survive re-wrapping.
+const (
+	fmtNoBreakSpace = "\x00"
+	fmtHardBreak    = "\x01"
+)
+
+// formatMarkdown parses src with the same extensions used for previewing and
+// prints it back as canonical Markdown. Text the parser ignores, like table
+// cells beyond the header's column count, would be lost by reprinting, so
+// such documents are returned unchanged.
+func formatMarkdown(src []byte, opts formatOptions) []byte {
+	doc := parser.NewWithExtensions(parser.CommonExtensions).Parse(src)
+	f := &mdFormatter{opts: opts, seenRefs: map[string]bool{}}
+	lines := f.blocks(doc.GetChildren(), opts.WrapWidth, false)
+	if len(f.refs) > 0 {
+		lines = append(lines, "")
+		lines = append(lines, f.refs...)
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	out := []byte(strings.Join(lines, "\n") + "\n")
+	if !keepsWords(src, out) {
+		return src
+	}
+	return out
+}
+
+// keepsWords reports whether every word of src still occurs in out at least
+// as often. Formatting only rewrites markup, so a missing word means some
+// text was dropped.
+func keepsWords(src, out []byte) bool {
+	isSep := func(r rune) bool { return !unicode.IsLetter(r) }
+	have := map[string]int{}
+	for _, w := range bytes.FieldsFunc(out, isSep) {
+		have[string(w)]++
+	}
+	for _, w := range bytes.FieldsFunc(src, isSep) {
+		if have[string(w)] == 0 {
+			return false
+		}
+		have[string(w)]--
+	}
+	return true
+}
+
+type mdFormatter struct {
+	opts     formatOptions
+	refs     []string // reference definitions for links written as [text][id]
+	seenRefs map[string]bool
+}
+
+// blocks lays out sibling block nodes, separating them with a blank line
+// unless they belong to a tight list item.
+func (f *mdFormatter) blocks(nodes []ast.Node, width int, tight bool) []string {
+	var lines []string
+	var prev ast.Node
+	for _, node := range nodes {
+		block := f.block(node, width)
+		if block == nil {
+			continue
+		}
+		if prev != nil {
+			if !tight {
+				lines = append(lines, "")
+			}
+			// Two lists of the same kind in a row would be merged into
+			// one when re-parsed, so keep them apart with an empty comment.
+			if sameListKind(prev, node) {
+				lines = append(lines, "<!-- -->", "")
+			}
+		}
+		lines = append(lines, block...)
+		prev = node
+	}
+	return lines
+}
+
+func sameListKind(a, b ast.Node) bool {
+	la, ok := a.(*ast.List)
+	if !ok {
+		return false
+	}
+	lb, ok := b.(*ast.List)
+	if !ok {
+		return false
+	}
+	return la.ListFlags&ast.ListTypeOrdered == lb.ListFlags&ast.ListTypeOrdered
+}
+
+func (f *mdFormatter) block(node ast.Node, width int) []string {
+	switch n := node.(type) {
+	case *ast.Paragraph:
+		return f.paragraph(n, width)
+	case *ast.Heading:
+		return []string{f.heading(n)}
+	case *ast.HorizontalRule:
+		return []string{"---"}
+	case *ast.CodeBlock:
+		return codeFence(n)
+	case *ast.HTMLBlock:
+		return strings.Split(strings.TrimRight(string(n.Literal), "\n"), "\n")
+	case *ast.MathBlock:
+		lines := []string{"$$"}
+		if math := strings.Trim(string(n.Literal), "\n"); math != "" {
+			lines = append(lines, strings.Split(math, "\n")...)
+		}
+		return append(lines, "$$")
+	case *ast.BlockQuote:
+		inner := f.blocks(n.Children, width-2, false)
+		for i, line := range inner {
+			if line == "" {
+				inner[i] = ">"
+			} else {
+				inner[i] = "> " + line
+			}
+		}
+		return inner
+	case *ast.List:
+		return f.list(n, width)
+	case *ast.Table:
+		return f.table(n)
+	}
+	if c := node.AsContainer(); c != nil {
+		return f.blocks(c.Children, width, false)
+	}
+	if l := node.AsLeaf(); l != nil && len(l.Literal) > 0 {
+		return strings.Split(strings.TrimRight(string(l.Literal), "\n"), "\n")
+	}
+	return nil
+}
+
+func (f *mdFormatter) heading(n *ast.Heading) string {
+	text := strings.TrimSpace(strings.ReplaceAll(f.inlineText(n.Children), "\n", " "))
+	// A trailing run of '#' would be taken as a closing sequence.
+	if strings.HasSuffix(text, "#") {
+		text = text[:len(text)-1] + `\#`
+	}
+	line := strings.Repeat("#", n.Level) + " " + text
+	if n.HeadingID != "" {
+		line += " {#" + n.HeadingID + "}"
+	}
+	return line
+}
+
+func (f *mdFormatter) paragraph(n *ast.Paragraph, width int) []string {
+	var lines []string
+	segments := strings.Split(f.inlines(n.Children, false), fmtHardBreak)
+	for i, segment := range segments {
+		var segLines []string
+		if width > 0 {
+			segLines = wrapWords(strings.Fields(segment), width)
+		} else {
+			for _, line := range strings.Split(segment, "\n") {
+				if line = strings.TrimSpace(line); line != "" {
+					segLines = append(segLines, line)
+				}
+			}
+		}
+		for j, line := range segLines {
+			segLines[j] = strings.ReplaceAll(escapeLineStart(line), fmtNoBreakSpace, " ")
+		}
+		if i < len(segments)-1 && len(segLines) > 0 {
+			segLines[len(segLines)-1] += `\`
+		}
+		lines = append(lines, segLines...)
+	}
+	return lines
+}
+
+// wrapWords greedily fills lines up to width. A word that would be
+// misread as block syntax at the start of a line stays on the previous one.
+func wrapWords(words []string, width int) []string {
+	var lines []string
+	var cur strings.Builder
+	curLen := 0
+	for _, word := range words {
+		wordLen := utf8.RuneCountInString(word)
+		if curLen > 0 && curLen+1+wordLen > width && escapeLineStart(word) == word {
+			lines = append(lines, cur.String())
+			cur.Reset()
+			curLen = 0
+		}
+		if curLen > 0 {
+			cur.WriteByte(' ')
+			curLen++
+		}
+		cur.WriteString(word)
+		curLen += wordLen
+	}
+	if curLen > 0 {
+		lines = append(lines, cur.String())
+	}
+	return lines
+}
+
+// escapeLineStart backslash-escapes text at the start of a paragraph line
+// that would otherwise be parsed as a heading, quote, list item, setext
+// underline or definition.
+func escapeLineStart(line string) string {
+	if line == "" {
+		return line
+	}
+	switch line[0] {
+	case '#', '>':
+		return `\` + line
+	case '-', '+', '*', ':':
+		if len(line) == 1 || line[1] == ' ' || strings.Trim(line, string(line[0])) == "" {
+			return `\` + line
+		}
+	case '=':
+		if strings.Trim(line, "=") == "" {
+			return `\` + line
+		}
+	}
+	digits := 0
+	for digits < len(line) && digits < 9 && line[digits] >= '0' && line[digits] <= '9' {
+		digits++
+	}
+	if digits > 0 && digits < len(line) && (line[digits] == '.' || line[digits] == ')') &&
+		(digits+1 == len(line) || line[digits+1] == ' ') {
+		return line[:digits] + `\` + line[digits:]
+	}
+	return line
+}
+
+// inlineText renders inline nodes and restores protected spaces; used where
+// the result is never wrapped.
+func (f *mdFormatter) inlineText(nodes []ast.Node) string {
+	return strings.ReplaceAll(f.inlines(nodes, false), fmtNoBreakSpace, " ")
+}
+
+func (f *mdFormatter) inlines(nodes []ast.Node, raw bool) string {
+	var b strings.Builder
+	for i, node := range nodes {
+		switch n := node.(type) {
+		case *ast.Text:
+			if raw {
+				b.Write(n.Literal)
+			} else {
+				b.WriteString(escapeText(string(n.Literal), followingText(nodes[i+1:])))
+			}
+		case *ast.Emph, *ast.Strong:
+			delim := f.emphasisDelim(b.String(), nodes[i+1:])
+			if _, ok := n.(*ast.Strong); ok {
+				delim += delim
+			}
+			b.WriteString(delim + f.inlines(n.GetChildren(), raw) + delim)
+		case *ast.Del:
+			b.WriteString("~~" + f.inlines(n.Children, raw) + "~~")
+		case *ast.Code:
+			b.WriteString(codeSpan(string(n.Literal)))
+		case *ast.Math:
+			b.WriteString("$" + string(n.Literal) + "$")
+		case *ast.Link:
+			b.WriteString(f.link(n))
+		case *ast.Image:
+			b.WriteString("![" + f.inlines(n.Children, true) + "]" + linkTarget(n.Destination, n.Title))
+		case *ast.HTMLSpan:
+			b.Write(n.Literal)
+		case *ast.Hardbreak:
+			b.WriteString(fmtHardBreak)
+		case *ast.Softbreak:
+			b.WriteString("\n")
+		default:
+			if c := node.AsContainer(); c != nil {
+				b.WriteString(f.inlines(c.Children, raw))
+			} else if l := node.AsLeaf(); l != nil {
+				b.Write(l.Literal)
+			}
+		}
+	}
+	return b.String()
+}
+
+// emphasisDelim returns the configured emphasis character, falling back to
+// '*' inside words where '_' would not be recognised.
+func (f *mdFormatter) emphasisDelim(before string, after []ast.Node) string {
+	if f.opts.Emphasis != '_' {
+		return string(f.opts.Emphasis)
+	}
+	if r, _ := utf8.DecodeLastRuneInString(before); isWordRune(r) {
+		return "*"
+	}
+	if len(after) > 0 {
+		if t, ok := after[0].(*ast.Text); ok {
+			if r, _ := utf8.DecodeRune(t.Literal); isWordRune(r) {
+				return "*"
+			}
+		}
+	}
+	return "_"
+}
+
+func (f *mdFormatter) link(n *ast.Link) string {
+	text := f.inlines(n.Children, false)
+	plain := string(plainText(n))
+	dest := string(n.Destination)
+	if len(n.Title) == 0 && !strings.ContainsAny(dest, " <>") {
+		if plain == dest && strings.Contains(dest, ":") {
+			return "<" + dest + ">"
+		}
+		if "mailto:"+plain == dest {
+			return "<" + plain + ">"
+		}
+	}
+	if len(n.DeferredID) > 0 {
+		id := string(n.DeferredID)
+		if key := strings.ToLower(id); !f.seenRefs[key] {
+			f.seenRefs[key] = true
+			f.refs = append(f.refs, strings.ReplaceAll("["+id+"]: "+strings.TrimSuffix(strings.TrimPrefix(linkTarget(n.Destination, n.Title), "("), ")"), fmtNoBreakSpace, " "))
+		}
+		return "[" + text + "][" + id + "]"
+	}
+	return "[" + text + "]" + linkTarget(n.Destination, n.Title)
+}
+
+// linkTarget renders the parenthesised destination and optional title of
+// a link or image.
+func linkTarget(dest, title []byte) string {
+	d := string(dest)
+	if d == "" || strings.ContainsAny(d, " <>()") {
+		d = "<" + strings.NewReplacer("<", `\<`, ">", `\>`).Replace(d) + ">"
+	}
+	if len(title) > 0 {
+		t := strings.ReplaceAll(string(title), `"`, `\"`)
+		d += fmtNoBreakSpace + `"` + strings.ReplaceAll(t, " ", fmtNoBreakSpace) + `"`
+	}
+	return "(" + d + ")"
+}
+
+func plainText(node ast.Node) []byte {
+	var buf bytes.Buffer
+	ast.WalkFunc(node, func(n ast.Node, entering bool) ast.WalkStatus {
+		if t, ok := n.(*ast.Text); ok && entering {
+			buf.Write(t.Literal)
+		}
+		return ast.GoToNext
+	})
+	return buf.Bytes()
+}
+
+func codeSpan(code string) string {
+	longest, run := 0, 0
+	for _, r := range code {
+		if r == '`' {
+			run++
+			if run > longest {
+				longest = run
+			}
+		} else {
+			run = 0
+		}
+	}
+	fence := strings.Repeat("`", longest+1)
+	if strings.HasPrefix(code, "`") || strings.HasSuffix(code, "`") ||
+		(strings.HasPrefix(code, " ") && strings.HasSuffix(code, " ") && strings.TrimSpace(code) != "") {
+		code = " " + code + " "
+	}
+	code = strings.NewReplacer(" ", fmtNoBreakSpace, "\n", fmtNoBreakSpace).Replace(code)
+	return fence + code + fence
+}
+
+func codeFence(n *ast.CodeBlock) []string {
+	code := strings.TrimSuffix(string(n.Literal), "\n")
+	longest := 0
+	for _, line := range strings.Split(code, "\n") {
+		trimmed := strings.TrimLeft(line, " ")
+		if run := len(trimmed) - len(strings.TrimLeft(trimmed, "`")); run > longest {
+			longest = run
+		}
+	}
+	fence := strings.Repeat("`", max(3, longest+1))
+	lines := []string{fence + strings.TrimSpace(string(n.Info))}
+	if code != "" {
+		lines = append(lines, strings.Split(code, "\n")...)
+	}
+	return append(lines, fence)
+}
+
+func isWordRune(r rune) bool {
+	return r != utf8.RuneError && (unicode.IsLetter(r) || unicode.IsDigit(r))
+}
+
+// escapeText escapes characters in a text node that would otherwise start
+// inline markup. Underscores inside words are left alone since they cannot
+// open emphasis; after is the text that follows, for spotting references
+// split across nodes.
+func escapeText(s, after string) string {
+	var b strings.Builder
+	runes := []rune(s)
+	for i, r := range runes {
+		var prev, next rune
+		if i > 0 {
+			prev = runes[i-1]
+		}
+		if i+1 < len(runes) {
+			next = runes[i+1]
+		}
+		switch r {
+		case '\\', '`', '*', '[', ']':
+			b.WriteByte('\\')
+		case '_':
+			if !isWordRune(prev) || !isWordRune(next) {
+				b.WriteByte('\\')
+			}
+		case '~':
+			if prev == 0 || next == 0 || prev == '~' || next == '~' {
+				b.WriteByte('\\')
+			}
+		case '<':
+			if next == 0 || next == '/' || next == '!' || next == '?' || unicode.IsLetter(next) {
+				b.WriteByte('\\')
+			}
+		case '&':
+			if entityPattern.MatchString(string(runes[i:]) + after) {
+				b.WriteByte('\\')
+			}
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// followingText returns the literal text of the Text nodes at the start of
+// nodes. The parser splits text at a backslash escape, so an & may end one
+// node and its reference continue in the next.
+func followingText(nodes []ast.Node) string {
+	var b strings.Builder
+	for _, node := range nodes {
+		n, ok := node.(*ast.Text)
+		if !ok {
+			break
+		}
+		b.Write(n.Literal)
+	}
+	return b.String()
+}
+
+// entityPattern matches a named or numeric character reference, which a
+// literal & in text must not turn into.
+var entityPattern = regexp.MustCompile(`^&(?:[A-Za-z][A-Za-z0-9]*|#[0-9]+|#[xX][0-9A-Fa-f]+);`)
+
+func (f *mdFormatter) list(n *ast.List, width int) []string {
+	var lines []string
+	num := n.Start
+	if num == 0 {
+		num = 1
+	}
+	delim := n.Delimiter
+	if delim == 0 {
+		delim = '.'
+	}
+	for i, child := range n.Children {
+		item, ok := child.(*ast.ListItem)
+		if !ok {
+			continue
+		}
+		var marker string
+		switch {
+		case item.ListFlags&ast.ListTypeTerm != 0:
+			marker = ""
+		case n.ListFlags&ast.ListTypeDefinition != 0:
+			marker = ": "
+		case n.ListFlags&ast.ListTypeOrdered != 0:
+			marker = strconv.Itoa(num) + string(delim) + " "
+			num++
+		default:
+			marker = string(f.opts.ListMarker) + " "
+		}
+		if i > 0 && !n.Tight {
+			lines = append(lines, "")
+		}
+		inner := f.blocks(item.Children, width-max(4, len(marker)), n.Tight && item.ListFlags&ast.ListItemContainsBlock == 0)
+		if len(inner) == 0 {
+			// The space stays: gomarkdown reads a bare "-" as text.
+			lines = append(lines, marker)
+			continue
+		}
+		// gomarkdown only keeps blocks after a blank line inside the item
+		// when they are indented by at least four columns.
+		indent := strings.Repeat(" ", max(4, len(marker)))
+		for j, line := range inner {
+			switch {
+			case j == 0:
+				lines = append(lines, marker+line)
+			case line == "":
+				lines = append(lines, "")
+			default:
+				lines = append(lines, indent+line)
+			}
+		}
+	}
+	return lines
+}
+
+func (f *mdFormatter) table(n *ast.Table) []string {
+	var rows [][]string
+	var aligns []ast.CellAlignFlags
+	for _, section := range n.Children {
+		for _, row := range section.GetChildren() {
+			var cells []string
+			for _, c := range row.GetChildren() {
+				cell, ok := c.(*ast.TableCell)
+				if !ok {
+					continue
+				}
+				if len(rows) == 0 {
+					aligns = append(aligns, cell.Align)
+				}
+				cells = append(cells, f.tableCell(cell))
+			}
+			rows = append(rows, cells)
+		}
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	cols := 0
+	for _, row := range rows {
+		cols = max(cols, len(row))
+	}
+	for len(aligns) < cols {
+		aligns = append(aligns, 0)
+	}
+	widths := make([]int, cols)
+	for col := range widths {
+		widths[col] = 3
+		if f.opts.AlignTables {
+			for _, row := range rows {
+				if col < len(row) {
+					widths[col] = max(widths[col], utf8.RuneCountInString(row[col]))
+				}
+			}
+		}
+	}
+
+	var lines []string
+	for i, row := range rows {
+		var b strings.Builder
+		b.WriteString("|")
+		for col := 0; col < cols; col++ {
+			cell := ""
+			if col < len(row) {
+				cell = row[col]
+			}
+			b.WriteString(" " + padCell(cell, widths[col], aligns[col], f.opts.AlignTables) + " |")
+		}
+		lines = append(lines, b.String())
+		if i == 0 {
+			lines = append(lines, tableDelimiterRow(aligns, widths, f.opts.AlignTables))
+		}
+	}
+	return lines
+}
+
+// tableCell renders a cell on one line. Pipes that would end the cell are
+// escaped, except inside a leading code span, which the table parser skips
+// over as a whole.
+func (f *mdFormatter) tableCell(cell *ast.TableCell) string {
+	children := cell.Children
+	for len(children) > 0 && isEmptyText(children[0]) {
+		children = children[1:]
+	}
+	lead := ""
+	if len(children) > 0 {
+		if code, ok := children[0].(*ast.Code); ok {
+			lead = codeSpan(string(code.Literal))
+			children = children[1:]
+		}
+	}
+	text := strings.TrimRight(strings.ReplaceAll(f.inlineText(children), "\n", " "), " ")
+	if lead == "" {
+		text = strings.TrimLeft(text, " ")
+	}
+	return lead + escapePipes(text)
+}
+
+func isEmptyText(n ast.Node) bool {
+	t, ok := n.(*ast.Text)
+	return ok && len(t.Literal) == 0
+}
+
+// escapePipes backslash-escapes every | not already preceded by an odd
+// number of backslashes.
+func escapePipes(s string) string {
+	var b strings.Builder
+	backslashes := 0
+	for _, r := range s {
+		if r == '|' && backslashes%2 == 0 {
+			b.WriteByte('\\')
+		}
+		if r == '\\' {
+			backslashes++
+		} else {
+			backslashes = 0
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func padCell(cell string, width int, align ast.CellAlignFlags, pad bool) string {
+	gap := width - utf8.RuneCountInString(cell)
+	if !pad || gap <= 0 {
+		return cell
+	}
+	switch align {
+	case ast.TableAlignmentRight:
+		return strings.Repeat(" ", gap) + cell
+	case ast.TableAlignmentCenter:
+		return strings.Repeat(" ", gap/2) + cell + strings.Repeat(" ", gap-gap/2)
+	}
+	return cell + strings.Repeat(" ", gap)
+}
+
+func tableDelimiterRow(aligns []ast.CellAlignFlags, widths []int, pad bool) string {
+	var b strings.Builder
+	b.WriteString("|")
+	for col, align := range aligns {
+		dashes := 3
+		if pad {
+			dashes = widths[col]
+		}
+		var cell string
+		switch align {
+		case ast.TableAlignmentLeft:
+			cell = ":" + strings.Repeat("-", dashes-1)
+		case ast.TableAlignmentRight:
+			cell = strings.Repeat("-", dashes-1) + ":"
+		case ast.TableAlignmentCenter:
+			cell = ":" + strings.Repeat("-", max(1, dashes-2)) + ":"
+		default:
+			cell = strings.Repeat("-", dashes)
+		}
+		b.WriteString(" " + cell + " |")
+	}
+	return b.String()
+}
+
+// handleMarkdownFormat returns the canonical form of the posted Markdown.
+// Formatter settings may be overridden with the list_marker, emphasis,
+// align_tables and wrap form fields.
+func handleMarkdownFormat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !parseLimitedForm(w, r) {
+		return
+	}
+
+	opts := defaultFormatOptions()
+	listMarker := string(opts.ListMarker)
+	if v := r.FormValue("list_marker"); v != "" {
+		listMarker = v
+	}
+	emphasis := string(opts.Emphasis)
+	if v := r.FormValue("emphasis"); v != "" {
+		emphasis = v
+	}
+	alignTables := opts.AlignTables
+	if v := r.FormValue("align_tables"); v != "" {
+		alignTables = v == "true" || v == "1"
+	}
+	wrap := opts.WrapWidth
+	if v := r.FormValue("wrap"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Invalid wrap width", http.StatusBadRequest)
+			return
+		}
+		wrap = n
+	}
+	opts, err := parseFormatOptions(listMarker, emphasis, alignTables, wrap)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	content := []byte(r.FormValue("markdown"))
+	formatted := formatMarkdown(content, opts)
+	log.Printf("Formatted markdown content (length: %d -> %d)", len(content), len(formatted))
+
+	w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+	w.Write(formatted)
+}
+
+// runFmt implements the fmt subcommand. Like gofmt it prints to stdout
+// by default, rewrites files in place with -w and lists unformatted files
+// with -check, exiting with status 1 if there are any.
+func runFmt(args []string) int {
+	fs := flag.NewFlagSet("fmt", flag.ContinueOnError)
+	write := fs.Bool("w", false, "Write result to the source file instead of stdout")
+	check := fs.Bool("check", false, "List files whose formatting differs and exit with status 1")
+	listMarker := fs.String("list-marker", "-", "Bullet for unordered lists: -, * or +")
+	emphasis := fs.String("emphasis", "*", "Emphasis delimiter: * or _")
+	alignTables := fs.Bool("align-tables", true, "Pad table cells so columns line up")
+	wrap := fs.Int("wrap", 0, "Wrap paragraphs at this width (0 keeps line breaks)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s fmt [flags] [file ...]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	opts, err := parseFormatOptions(*listMarker, *emphasis, *alignTables, *wrap)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if fs.NArg() == 0 {
+		if *write {
+			fmt.Fprintln(os.Stderr, "cannot use -w with standard input")
+			return 2
+		}
+		src, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		formatted := formatMarkdown(src, opts)
+		if *check {
+			if !bytes.Equal(src, formatted) {
+				fmt.Println("<standard input>")
+				return 1
+			}
+			return 0
+		}
+		os.Stdout.Write(formatted)
+		return 0
+	}
+
+	status := 0
+	for _, path := range fs.Args() {
+		src, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 2
+			continue
+		}
+		formatted := formatMarkdown(src, opts)
+		switch {
+		case *check:
+			if !bytes.Equal(src, formatted) {
+				fmt.Println(path)
+				if status == 0 {
+					status = 1
+				}
+			}
+		case *write:
+			if bytes.Equal(src, formatted) {
+				continue
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				status = 2
+				continue
+			}
+			if err := os.WriteFile(path, formatted, info.Mode().Perm()); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				status = 2
+			}
+		default:
+			os.Stdout.Write(formatted)
+		}
+	}
+	return status
+}
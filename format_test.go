@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gomarkdown/markdown"
+)
+
+func TestFormatMarkdown(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"list markers", "* one\n+ two\n", "- one\n- two\n"},
+		{"emphasis", "_a_ and __b__\n", "*a* and **b**\n"},
+		{"setext heading", "Title\n=====\n", "# Title\n"},
+		{"empty list item", "- a\n- \n- b\n", "- a\n- \n- b\n"},
+		{"empty ordered item", "1. \n2. x\n", "1. \n2. x\n"},
+		{"escaped marker", "\\- not a list\n", "\\- not a list\n"},
+		{"fenced code", "~~~go\nx := 1\n~~~\n", "```go\nx := 1\n```\n"},
+		{"table", "a|b\n-|-\n1|22\n", "| a   | b   |\n| --- | --- |\n| 1   | 22  |\n"},
+		{"escaped entity", "\\&copy; \\&#169; & x\n", "\\&copy; \\&#169; & x\n"},
+		{"display math", "$$\nx^2\n$$\n", "$$\nx^2\n$$\n"},
+		{"escaped pipe in code", "a|b\n-|-\nx `\\|`|y\n", "| a      | b   |\n| ------ | --- |\n| x `\\|` | y   |\n"},
+		{"surplus cell", "| a | b |\n|---|---|\n| x `|` | yyyy |\n", "| a | b |\n|---|---|\n| x `|` | yyyy |\n"},
+	}
+	for _, tt := range tests {
+		if got := string(formatMarkdown([]byte(tt.in), defaultFormatOptions())); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestFormatIdempotent checks that formatting formatted Markdown changes
+// nothing, so fmt -check passes right after fmt -w.
+func TestFormatIdempotent(t *testing.T) {
+	inputs := []string{
+		"- \n",
+		"- a\n- \n- b\n",
+		"1. \n2. x\n",
+		"* one\n\n  two\n* three\n",
+		"> quote\n> - item\n",
+		"# Title #\n\nSome *text* with `code` and [a link](http://x.test \"t\").\n",
+		"Term\n: Definition\n",
+		"a_b_c and 2 * 3 * 4\n",
+		"<details>\n<summary>More</summary>\n\nbody\n\n</details>\n",
+		"| a | b |\n|:--|--:|\n| 1 | 2 |\n",
+		"line one  \nline two\n",
+		"```\ncode ``` inside\n```\n",
+		"\\&amp; and \\&#x41;\n",
+		"$$\na\nb\n$$\n",
+		"| a | b |\n|---|---|\n| `a|b` | \\| |\n",
+	}
+	opts := defaultFormatOptions()
+	wrapped := opts
+	wrapped.WrapWidth = 20
+	for _, o := range []formatOptions{opts, wrapped} {
+		for _, in := range inputs {
+			once := formatMarkdown([]byte(in), o)
+			twice := formatMarkdown(once, o)
+			if string(once) != string(twice) {
+				t.Errorf("%q (wrap %d): first pass %q, second pass %q", in, o.WrapWidth, once, twice)
+			}
+		}
+	}
+}
+
+// TestFormatPreservesRendering checks that formatting never changes the
+// rendered HTML of a document.
+func TestFormatPreservesRendering(t *testing.T) {
+	inputs := []string{
+		"\\&copy; and &copy; and \\&#169; and \\&#xA9; &amp; a & b\n",
+		"$$\nx^2\n$$\n",
+		"$$\na = b\nc = d\n$$\n",
+		"| a | b | c |\n|---|---|---|\n| x `|` | yyyy | z |\n",
+		"| a | b |\n|---|---|\n| x `\\|` | yyyy |\n",
+		"| a | b |\n|---|---|\n| `a|b` rest | \\| and \\\\ |\n",
+		"Some *text* with `code`, <b>html</b> and \\<notatag>.\n",
+		"- one\n- two\n\n  more\n",
+		"> quote with \\*stars\\* and \\_under\\_\n",
+	}
+	opts := defaultFormatOptions()
+	for _, in := range inputs {
+		out := formatMarkdown([]byte(in), opts)
+		want := string(markdown.ToHTML([]byte(in), nil, nil))
+		if got := string(markdown.ToHTML(out, nil, nil)); got != want {
+			t.Errorf("%q formatted to %q:\nrenders %q\nwant    %q", in, out, got, want)
+		}
+	}
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/gorilla/websocket"
+	"github.com/yourusername/markdown-preview/wsproto"
+)
+
+// handshakeTimeout bounds how long a new connection may take to say hello.
+const handshakeTimeout = 10 * time.Second
+
+// wsClient is a connected protocol client. Writes go through send so that
+// a single goroutine owns the connection's writer.
+type wsClient struct {
+	conn    *websocket.Conn
+	send    chan []byte
+	session string
+	kind    string
+	name    string
+
+	// share is the link a read-only viewer joined through, or nil.
+	share  *shareLink
+	addr   string
+	joined time.Time
+
+	// collab is set once the client joined the shared document; selection
+	// is its last caret or selected range there. Both are guarded by the
+	// hub's mutex.
+	collab    bool
+	selection *wsproto.Selection
+
+	// preview is only touched by the connection's read loop.
+	preview blockRenderer
+}
+
+// wsHub tracks connected clients and fans messages out to all of them.
+// It also keeps the bare /ws/editor connections so that shutdown can say
+// goodbye to every socket.
+type wsHub struct {
+	mu      sync.Mutex
+	clients map[*wsClient]bool
+	editors map[*websocket.Conn]bool
+	closing bool
+	conns   sync.WaitGroup
+
+	// presenter is the client driving everyone's preview, or nil, and
+	// presentation where it last was.
+	presenter    *wsClient
+	presentation wsproto.Presentation
+}
+
+var hub = &wsHub{
+	clients: make(map[*wsClient]bool),
+	editors: make(map[*websocket.Conn]bool),
+}
+
+// register adds c to the hub. It returns false once the server is shutting
+// down.
+func (h *wsHub) register(c *wsClient) bool {
+	h.mu.Lock()
+	if h.closing {
+		h.mu.Unlock()
+		return false
+	}
+	h.clients[c] = true
+	h.conns.Add(1)
+	// A client joining during a presentation starts following it.
+	if h.presenter != nil {
+		h.sendPresentationLocked(c)
+	}
+	h.mu.Unlock()
+	h.broadcastEvent(wsproto.TypePresence, h.presence())
+	return true
+}
+
+func (h *wsHub) unregister(c *wsClient) {
+	h.mu.Lock()
+	if h.clients[c] {
+		delete(h.clients, c)
+		close(c.send)
+	}
+	if h.presenter == c {
+		h.stopPresentingLocked()
+	}
+	h.mu.Unlock()
+	h.broadcastEvent(wsproto.TypePresence, h.presence())
+	h.conns.Done()
+}
+
+// addEditor tracks a /ws/editor connection. It returns false once the
+// server is shutting down.
+func (h *wsHub) addEditor(conn *websocket.Conn) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closing {
+		return false
+	}
+	h.editors[conn] = true
+	h.conns.Add(1)
+	return true
+}
+
+func (h *wsHub) removeEditor(conn *websocket.Conn) {
+	h.mu.Lock()
+	delete(h.editors, conn)
+	h.mu.Unlock()
+	h.conns.Done()
+}
+
+// focusBrowser asks one connected browser tab to come to the front. It
+// reports false if no browser is connected.
+func (h *wsHub) focusBrowser(path string) bool {
+	msg, err := wsproto.Encode(wsproto.TypeFocus, "", wsproto.Focus{Path: path})
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		if c.kind == "browser" {
+			h.sendLocked(c, msg)
+			return true
+		}
+	}
+	return false
+}
+
+// isClosing reports whether shutdown has started.
+func (h *wsHub) isClosing() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.closing
+}
+
+// shutdown sends a going-away close frame to every connection, after any
+// messages already queued for it, and waits for the connections to finish.
+// Whatever is still open when ctx ends is closed outright.
+func (h *wsHub) shutdown(ctx context.Context) {
+	h.mu.Lock()
+	h.closing = true
+	var conns []*websocket.Conn
+	for c := range h.clients {
+		conns = append(conns, c.conn)
+		delete(h.clients, c)
+		close(c.send)
+	}
+	for conn := range h.editors {
+		conns = append(conns, conn)
+		conn.WriteControl(websocket.CloseMessage, goingAway, time.Now().Add(time.Second))
+	}
+	h.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		h.conns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Printf("Closing %d WebSocket connection(s) that did not finish in time", len(conns))
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+}
+
+// presence lists connected clients in a stable order.
+func (h *wsHub) presence() wsproto.Presence {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	p := wsproto.Presence{Participants: []wsproto.Participant{}}
+	for c := range h.clients {
+		p.Participants = append(p.Participants, wsproto.Participant{Session: c.session, Client: c.kind, Name: c.name})
+	}
+	sort.Slice(p.Participants, func(i, j int) bool {
+		return p.Participants[i].Session < p.Participants[j].Session
+	})
+	return p
+}
+
+// broadcast queues msg for every client. Clients that are too slow to keep
+// up are dropped rather than blocking everybody else.
+func (h *wsHub) broadcast(msg []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		h.sendLocked(c, msg)
+	}
+}
+
+func (h *wsHub) broadcastEvent(typ string, payload interface{}) {
+	msg, err := wsproto.Encode(typ, "", payload)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	h.broadcast(msg)
+}
+
+// sendTo queues a message for one client if it is still connected.
+func (h *wsHub) sendTo(c *wsClient, typ, id string, payload interface{}) {
+	msg, err := wsproto.Encode(typ, id, payload)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.clients[c] {
+		h.sendLocked(c, msg)
+	}
+}
+
+func (h *wsHub) sendLocked(c *wsClient, msg []byte) {
+	select {
+	case c.send <- msg:
+	default:
+		delete(h.clients, c)
+		close(c.send)
+	}
+}
+
+// goingAway is the close frame sent to clients when the server stops.
+var goingAway = websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+
+func (c *wsClient) writePump() {
+	for msg := range c.send {
+		if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+			log.Println(err)
+			c.conn.Close()
+			return
+		}
+	}
+	if hub.isClosing() {
+		c.conn.WriteControl(websocket.CloseMessage, goingAway, time.Now().Add(time.Second))
+		// Leave the connection open for the client's close reply; the
+		// read loop closes it when that arrives.
+		return
+	}
+	c.conn.Close()
+}
+
+func newSessionID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// rejectHandshake writes an error message followed by a close frame.
+func rejectHandshake(conn *websocket.Conn, code, message string) {
+	if msg, err := wsproto.Encode(wsproto.TypeError, "", wsproto.ErrorPayload{Code: code, Message: message}); err == nil {
+		conn.WriteMessage(websocket.TextMessage, msg)
+	}
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseProtocolError, code),
+		time.Now().Add(time.Second))
+}
+
+func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	serveProtocol(w, r, nil)
+}
+
+// serveProtocol runs one protocol connection. Clients joining through a
+// share link are read-only viewers: they start from the current document
+// and may not push buffers.
+func serveProtocol(w http.ResponseWriter, r *http.Request, share *shareLink) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(int64(*maxBodyMB) << 20)
+
+	// The first frame must be a hello offering a version we speak.
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	var first wsproto.Message
+	if err := conn.ReadJSON(&first); err != nil {
+		rejectHandshake(conn, wsproto.ErrHandshakeRequired, "first message must be hello")
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	var hello wsproto.Hello
+	if first.Type != wsproto.TypeHello || first.Decode(&hello) != nil {
+		rejectHandshake(conn, wsproto.ErrHandshakeRequired, "first message must be hello")
+		return
+	}
+	supported := false
+	for _, v := range hello.Versions {
+		if v == wsproto.Version {
+			supported = true
+		}
+	}
+	if !supported {
+		rejectHandshake(conn, wsproto.ErrUnsupportedVersion, "this server speaks protocol version 1")
+		return
+	}
+
+	client := &wsClient{
+		conn:    conn,
+		send:    make(chan []byte, 64),
+		session: newSessionID(),
+		kind:    hello.Client,
+		name:    hello.Name,
+		share:   share,
+		addr:    r.RemoteAddr,
+		joined:  time.Now(),
+	}
+	if share != nil {
+		client.kind = "viewer"
+	}
+	welcome, err := wsproto.Encode(wsproto.TypeWelcome, first.ID, wsproto.Welcome{
+		Version: wsproto.Version,
+		Session: client.session,
+		Server:  "markdown-preview",
+	})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	client.send <- welcome
+	// A tab that connects after an editor pushed its buffer starts from it.
+	// A viewer has no text of its own, so it also gets the file.
+	content, ok := buffers.current()
+	if share != nil {
+		content, ok = currentDocument()
+	}
+	if ok {
+		if msg, err := wsproto.Encode(wsproto.TypeContentChanged, "", content); err == nil {
+			client.send <- msg
+		}
+	}
+	if !hub.register(client) {
+		conn.WriteControl(websocket.CloseMessage, goingAway, time.Now().Add(time.Second))
+		return
+	}
+	defer hub.unregister(client)
+	go client.writePump()
+	if share != nil {
+		if shares.lookup(share.token) == nil {
+			// Revoked during the handshake.
+			return
+		}
+		log.Printf("Viewer %s joined through share link %q from %s", client.session, share.Label, client.addr)
+		defer log.Printf("Viewer %s left", client.session)
+	}
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err == websocket.ErrReadLimit {
+			// The connection has already sent a "message too big" close frame.
+			hub.sendTo(client, wsproto.TypeError, "", wsproto.ErrorPayload{Code: wsproto.ErrTooLarge, Message: "message exceeds the size limit"})
+			return
+		}
+		if err != nil {
+			return
+		}
+		var msg wsproto.Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			hub.sendTo(client, wsproto.TypeError, "", wsproto.ErrorPayload{Code: wsproto.ErrBadMessage, Message: err.Error()})
+			continue
+		}
+		handleCommand(client, &msg)
+	}
+}
+
+// handleCommand answers one client command. Replies echo the command id.
+func handleCommand(c *wsClient, msg *wsproto.Message) {
+	fail := func(code, message string) {
+		hub.sendTo(c, wsproto.TypeError, msg.ID, wsproto.ErrorPayload{Code: code, Message: message})
+	}
+
+	// Viewers joined through a share link may only ping and render; what
+	// they render is always the shared document.
+	if c.share != nil {
+		switch msg.Type {
+		case wsproto.TypePing, wsproto.TypeRender, wsproto.TypeUpdate:
+		default:
+			fail(wsproto.ErrForbidden, "viewers joined through a share link are read-only")
+			return
+		}
+	}
+
+	switch msg.Type {
+	case wsproto.TypePing:
+		hub.sendTo(c, wsproto.TypePong, msg.ID, nil)
+	case wsproto.TypeRender:
+		var req wsproto.Render
+		if err := msg.Decode(&req); err != nil {
+			fail(wsproto.ErrBadMessage, err.Error())
+			return
+		}
+		if c.share != nil {
+			req.Markdown = string(sharedDocument())
+		}
+		var out wsproto.Rendered
+		err := renderPool.do(context.Background(), func(ctx context.Context) (err error) {
+			out.HTML, err = renderPreviewHTML(ctx, []byte(req.Markdown))
+			return err
+		})
+		if err != nil {
+			fail(renderErrorCode(err), err.Error())
+			return
+		}
+		hub.sendTo(c, wsproto.TypeRendered, msg.ID, out)
+	case wsproto.TypeUpdate:
+		var req wsproto.Update
+		if err := msg.Decode(&req); err != nil {
+			fail(wsproto.ErrBadMessage, err.Error())
+			return
+		}
+		if c.share != nil {
+			req.Markdown = string(sharedDocument())
+		}
+		var patch wsproto.Patch
+		err := renderPool.do(context.Background(), func(ctx context.Context) (err error) {
+			patch, err = c.preview.update(ctx, []byte(req.Markdown), req.Reset)
+			return err
+		})
+		if err != nil {
+			fail(renderErrorCode(err), err.Error())
+			return
+		}
+		hub.sendTo(c, wsproto.TypePatch, msg.ID, patch)
+	case wsproto.TypeLint:
+		var req wsproto.Lint
+		if err := msg.Decode(&req); err != nil {
+			fail(wsproto.ErrBadMessage, err.Error())
+			return
+		}
+		hub.sendTo(c, wsproto.TypeDiagnostics, msg.ID, documentDiagnostics(req.Path, []byte(req.Markdown)))
+	case wsproto.TypePushBuffer:
+		var req wsproto.PushBuffer
+		if err := msg.Decode(&req); err != nil {
+			fail(wsproto.ErrBadMessage, err.Error())
+			return
+		}
+		pushBuffer(req)
+		if msg.ID != "" {
+			hub.sendTo(c, wsproto.TypeAck, msg.ID, nil)
+		}
+	case wsproto.TypeJoin:
+		collab.join(c, msg.ID)
+	case wsproto.TypeEdit:
+		var req wsproto.Edit
+		if err := msg.Decode(&req); err != nil {
+			fail(wsproto.ErrBadMessage, err.Error())
+			return
+		}
+		if !c.collab {
+			fail(wsproto.ErrBadMessage, "join the document before editing it")
+			return
+		}
+		if err := collab.edit(c, req); err != nil {
+			fail(wsproto.ErrBadMessage, err.Error())
+			return
+		}
+		if msg.ID != "" {
+			hub.sendTo(c, wsproto.TypeAck, msg.ID, nil)
+		}
+	case wsproto.TypeSelection:
+		var req wsproto.Selection
+		if err := msg.Decode(&req); err != nil {
+			fail(wsproto.ErrBadMessage, err.Error())
+			return
+		}
+		hub.setSelection(c, req)
+	case wsproto.TypePresent:
+		var req wsproto.Presentation
+		if err := msg.Decode(&req); err != nil {
+			fail(wsproto.ErrBadMessage, err.Error())
+			return
+		}
+		hub.present(c, req)
+		if msg.ID != "" {
+			hub.sendTo(c, wsproto.TypeAck, msg.ID, nil)
+		}
+	default:
+		fail(wsproto.ErrUnknownCommand, "unknown command "+msg.Type)
+	}
+}
+
+// renderErrorCode maps a renderLimiter error to a protocol error code.
+func renderErrorCode(err error) string {
+	switch {
+	case errors.Is(err, errRenderBusy):
+		return wsproto.ErrOverloaded
+	case errors.Is(err, context.DeadlineExceeded):
+		return wsproto.ErrTimeout
+	}
+	return wsproto.ErrInternal
+}
+
+// watchMarkdownFile sends the previewed file's new contents to every
+// client whenever it is written, until ctx is done.
+func watchMarkdownFile(ctx context.Context, path string) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer watcher.Close()
+
+	if err := watcher.Add(path); err != nil {
+		log.Println(err)
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&fsnotify.Write == fsnotify.Write {
+				data, err := os.ReadFile(path)
+				if err != nil {
+					log.Println(err)
+					continue
+				}
+				collab.replace(string(data))
+				hub.broadcastEvent(wsproto.TypeContentChanged, wsproto.ContentChanged{Source: "file", Path: path, Text: string(data)})
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Println("error:", err)
+		}
+	}
+}
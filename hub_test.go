@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/yourusername/markdown-preview/wsproto"
+)
+
+func TestShutdownSaysGoingAway(t *testing.T) {
+	old := hub
+	hub = &wsHub{clients: make(map[*wsClient]bool), editors: make(map[*websocket.Conn]bool)}
+	t.Cleanup(func() { hub = old })
+	srv := newTestServer(t)
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, err := wsproto.Dial(ctx, wsURL+"/ws", nil, wsproto.Hello{Client: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	editor, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws/editor", http.Header{"Origin": {srv.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer editor.Close()
+	// The editor is tracked once a round trip has gone through.
+	editor.WriteMessage(websocket.TextMessage, []byte("{"))
+	editor.ReadMessage()
+
+	done := make(chan struct{})
+	go func() {
+		hub.shutdown(ctx)
+		close(done)
+	}()
+
+	for {
+		if _, err = client.Next(); err != nil {
+			break
+		}
+	}
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("client: got %v, want a going-away close", err)
+	}
+	editor.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := editor.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("editor: got %v, want a going-away close", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not return after both connections closed")
+	}
+	if ctx.Err() != nil {
+		t.Error("shutdown waited for its deadline")
+	}
+
+	// Connections opened afterwards are turned away.
+	late, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws/editor", http.Header{"Origin": {srv.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer late.Close()
+	late.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := late.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("late editor: got %v, want a going-away close", err)
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// thumbsDir is the hidden folder, beside each asset, holding its
+// thumbnails. Hidden folders are left out of asset listings.
+const thumbsDir = ".thumbs"
+
+// maxImagePixels is the largest image that is decoded, about 50
+// megapixels or 200 MB once expanded to RGBA. A small file can declare
+// far larger dimensions than it holds.
+const maxImagePixels = 50_000_000
+
+// errImageTooLarge reports an image over maxImagePixels.
+var errImageTooLarge = errors.New("image has too many pixels")
+
+// thumbnailSizes holds the parsed -thumbnails flag.
+var thumbnailSizes []int
+
+// decodeConfig reads an image's dimensions and rejects it with
+// errImageTooLarge before anything allocates its pixels.
+func decodeConfig(data []byte) (image.Config, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return cfg, err
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > maxImagePixels {
+		return cfg, errImageTooLarge
+	}
+	return cfg, nil
+}
+
+// processImage prepares an uploaded image for storage. For a PNG or JPEG
+// it applies the EXIF orientation, downscales it to fit -image-max-size
+// and re-encodes it when either changed anything, and otherwise strips
+// metadata without touching the pixels. WebP files have their EXIF and
+// XMP chunks removed; GIFs are returned as is.
+func processImage(data []byte, contentType string) ([]byte, error) {
+	if contentType == "image/webp" {
+		return stripWebPMetadata(data)
+	}
+	if contentType != "image/png" && contentType != "image/jpeg" {
+		return data, nil
+	}
+	cfg, err := decodeConfig(data)
+	if err != nil {
+		return nil, err
+	}
+	orientation := 1
+	if contentType == "image/jpeg" {
+		orientation = jpegOrientation(data)
+	}
+	limit := *imageMaxSize
+	if orientation == 1 && (limit <= 0 || (cfg.Width <= limit && cfg.Height <= limit)) {
+		if contentType == "image/jpeg" {
+			return stripJPEGMetadata(data)
+		}
+		return stripPNGMetadata(data)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	rgba := orient(toRGBA(img), orientation)
+	if b := rgba.Bounds(); limit > 0 && (b.Dx() > limit || b.Dy() > limit) {
+		w, h := fitWithin(b.Dx(), b.Dy(), limit, limit)
+		rgba = downscale(rgba, w, h)
+	}
+	return encodeImage(rgba, contentType)
+}
+
+func encodeImage(img image.Image, contentType string) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	if contentType == "image/jpeg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: *jpegQuality})
+	} else {
+		err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&buf, img)
+	}
+	return buf.Bytes(), err
+}
+
+// parseThumbnailSizes reads the -thumbnails list of sizes.
+func parseThumbnailSizes(list string) ([]int, error) {
+	var sizes []int
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		n, err := strconv.Atoi(field)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid thumbnail size %q", field)
+		}
+		sizes = append(sizes, n)
+	}
+	sort.Ints(sizes)
+	return sizes, nil
+}
+
+// writeThumbnails stores a copy of the image at path scaled to fit each
+// size in sizes that is smaller than the image, as
+// .thumbs/<name>-<size><ext>, and returns their paths.
+func writeThumbnails(path string, data []byte, contentType string, sizes []int) ([]string, error) {
+	if len(sizes) == 0 || (contentType != "image/png" && contentType != "image/jpeg") {
+		return nil, nil
+	}
+	if _, err := decodeConfig(data); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	src := toRGBA(img)
+	dir := filepath.Join(filepath.Dir(path), thumbsDir)
+	ext := filepath.Ext(path)
+	stem := strings.TrimSuffix(filepath.Base(path), ext)
+
+	var written []string
+	for _, size := range sizes {
+		b := src.Bounds()
+		if b.Dx() <= size && b.Dy() <= size {
+			continue
+		}
+		w, h := fitWithin(b.Dx(), b.Dy(), size, size)
+		out, err := encodeImage(downscale(src, w, h), contentType)
+		if err != nil {
+			return written, err
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return written, err
+		}
+		thumb := filepath.Join(dir, fmt.Sprintf("%s-%d%s", stem, size, ext))
+		if err := os.WriteFile(thumb, out, 0644); err != nil {
+			return written, err
+		}
+		written = append(written, thumb)
+	}
+	return written, nil
+}
+
+// thumbnailsOf returns the thumbnails stored for the asset at path,
+// smallest first.
+func thumbnailsOf(path string) []string {
+	dir := filepath.Join(filepath.Dir(path), thumbsDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	ext := filepath.Ext(path)
+	stem := strings.TrimSuffix(filepath.Base(path), ext)
+	type thumb struct {
+		path string
+		size int
+	}
+	var thumbs []thumb
+	for _, e := range entries {
+		middle, ok := strings.CutPrefix(e.Name(), stem+"-")
+		if !ok {
+			continue
+		}
+		middle, ok = strings.CutSuffix(middle, ext)
+		if n, err := strconv.Atoi(middle); ok && err == nil {
+			thumbs = append(thumbs, thumb{filepath.Join(dir, e.Name()), n})
+		}
+	}
+	sort.Slice(thumbs, func(i, j int) bool { return thumbs[i].size < thumbs[j].size })
+	paths := make([]string, len(thumbs))
+	for i, t := range thumbs {
+		paths[i] = t.path
+	}
+	return paths
+}
+
+// fitWithin scales w×h down to fit inside maxW×maxH, keeping the aspect
+// ratio and never returning a zero side.
+func fitWithin(w, h, maxW, maxH int) (int, int) {
+	if w <= maxW && h <= maxH {
+		return w, h
+	}
+	if w*maxH > h*maxW {
+		return maxW, max(1, h*maxW/w)
+	}
+	return max(1, w*maxH/h), maxH
+}
+
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Bounds().Min == (image.Point{}) {
+		return rgba
+	}
+	b := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, b.Min, draw.Src)
+	return rgba
+}
+
+// downscale resizes src to w×h by averaging the source pixels that each
+// destination pixel covers (a box filter), which avoids the aliasing of
+// nearest-neighbour sampling when shrinking photos and screenshots.
+func downscale(src *image.RGBA, w, h int) *image.RGBA {
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := y*sh/h, max((y+1)*sh/h, y*sh/h+1)
+		for x := 0; x < w; x++ {
+			x0, x1 := x*sw/w, max((x+1)*sw/w, x*sw/w+1)
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride+x0*4 : sy*src.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					r += uint64(row[i])
+					g += uint64(row[i+1])
+					b += uint64(row[i+2])
+					a += uint64(row[i+3])
+					n++
+				}
+			}
+			i := y*dst.Stride + x*4
+			dst.Pix[i] = uint8(r / n)
+			dst.Pix[i+1] = uint8(g / n)
+			dst.Pix[i+2] = uint8(b / n)
+			dst.Pix[i+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// orient applies an EXIF orientation (1-8) so the pixels are stored
+// upright once the tag is gone.
+func orient(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	dw, dh := sw, sh
+	if orientation >= 5 {
+		dw, dh = sh, sw
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < sh; y++ {
+		for x := 0; x < sw; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored
+				dx, dy = sw-1-x, y
+			case 3: // rotated 180°
+				dx, dy = sw-1-x, sh-1-y
+			case 4: // mirrored vertically
+				dx, dy = x, sh-1-y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // rotated 90° clockwise
+				dx, dy = sh-1-y, x
+			case 7: // transversed
+				dx, dy = sh-1-y, sw-1-x
+			case 8: // rotated 90° counter-clockwise
+				dx, dy = y, sw-1-x
+			}
+			copy(dst.Pix[dy*dst.Stride+dx*4:dy*dst.Stride+dx*4+4], src.Pix[y*src.Stride+x*4:y*src.Stride+x*4+4])
+		}
+	}
+	return dst
+}
+
+// jpegSegments calls fn for each marker segment before the image data
+// with the marker byte and the whole segment, and returns the offset of
+// the start-of-scan marker.
+func jpegSegments(data []byte, fn func(marker byte, segment []byte)) (int, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 0, fmt.Errorf("not a JPEG file")
+	}
+	i := 2
+	for i+4 <= len(data) {
+		if data[i] != 0xFF {
+			return 0, fmt.Errorf("corrupt JPEG marker at offset %d", i)
+		}
+		marker := data[i+1]
+		if marker == 0xFF { // fill byte
+			i++
+			continue
+		}
+		if marker == 0xDA {
+			return i, nil
+		}
+		n := int(binary.BigEndian.Uint16(data[i+2:]))
+		if n < 2 || i+2+n > len(data) {
+			return 0, fmt.Errorf("corrupt JPEG segment at offset %d", i)
+		}
+		fn(marker, data[i:i+2+n])
+		i += 2 + n
+	}
+	return 0, fmt.Errorf("JPEG has no image data")
+}
+
+// stripJPEGMetadata drops EXIF and XMP (APP1), IPTC (APP13) and comment
+// segments. JFIF, ICC profile and Adobe segments are kept because they
+// affect how colours are decoded.
+func stripJPEGMetadata(data []byte) ([]byte, error) {
+	out := []byte{0xFF, 0xD8}
+	sos, err := jpegSegments(data, func(marker byte, segment []byte) {
+		if marker == 0xE1 || marker == 0xED || marker == 0xFE {
+			return
+		}
+		out = append(out, segment...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(out, data[sos:]...), nil
+}
+
+// jpegOrientation returns the EXIF orientation tag, or 1 if there is none.
+func jpegOrientation(data []byte) int {
+	orientation := 1
+	jpegSegments(data, func(marker byte, segment []byte) {
+		exif, ok := bytes.CutPrefix(segment[4:], []byte("Exif\x00\x00"))
+		if marker != 0xE1 || !ok || len(exif) < 8 {
+			return
+		}
+		var order binary.ByteOrder
+		switch string(exif[:2]) {
+		case "II":
+			order = binary.LittleEndian
+		case "MM":
+			order = binary.BigEndian
+		default:
+			return
+		}
+		ifd := int(order.Uint32(exif[4:]))
+		if ifd+2 > len(exif) {
+			return
+		}
+		count := int(order.Uint16(exif[ifd:]))
+		for e := 0; e < count; e++ {
+			entry := ifd + 2 + e*12
+			if entry+12 > len(exif) {
+				return
+			}
+			if order.Uint16(exif[entry:]) == 0x0112 {
+				orientation = int(order.Uint16(exif[entry+8:]))
+				return
+			}
+		}
+	})
+	return orientation
+}
+
+// pngMetadataChunks are dropped by stripPNGMetadata: EXIF, text and the
+// last-modified time.
+var pngMetadataChunks = map[string]bool{"eXIf": true, "tEXt": true, "zTXt": true, "iTXt": true, "tIME": true}
+
+func stripPNGMetadata(data []byte) ([]byte, error) {
+	const signature = "\x89PNG\r\n\x1a\n"
+	if !bytes.HasPrefix(data, []byte(signature)) {
+		return nil, fmt.Errorf("not a PNG file")
+	}
+	out := []byte(signature)
+	for i := len(signature); i < len(data); {
+		if i+12 > len(data) {
+			return nil, fmt.Errorf("corrupt PNG chunk at offset %d", i)
+		}
+		n := int(binary.BigEndian.Uint32(data[i:]))
+		end := i + 12 + n
+		if n < 0 || end > len(data) {
+			return nil, fmt.Errorf("corrupt PNG chunk at offset %d", i)
+		}
+		if !pngMetadataChunks[string(data[i+4:i+8])] {
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+	return out, nil
+}
+
+// stripWebPMetadata drops the EXIF and XMP chunks of a WebP file and
+// clears their flags in the VP8X header. The image data is untouched.
+func stripWebPMetadata(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, fmt.Errorf("not a WebP file")
+	}
+	out := append([]byte(nil), data[:12]...)
+	for i := 12; i < len(data); {
+		if i+8 > len(data) {
+			return nil, fmt.Errorf("corrupt WebP chunk at offset %d", i)
+		}
+		n := int(binary.LittleEndian.Uint32(data[i+4:]))
+		end := i + 8 + n
+		if n < 0 || end > len(data) {
+			return nil, fmt.Errorf("corrupt WebP chunk at offset %d", i)
+		}
+		if n%2 == 1 && end < len(data) { // chunks are padded to an even size
+			end++
+		}
+		switch string(data[i : i+4]) {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			start := len(out)
+			out = append(out, data[i:end]...)
+			if n > 0 {
+				out[start+8] &^= 0x08 | 0x04 // EXIF and XMP present
+			}
+		default:
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// pngChunk frames data as a PNG chunk.
+func pngChunk(typ string, data []byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	b = append(b, typ...)
+	b = append(b, data...)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b[4:]))
+}
+
+// testPNG encodes a w×h image and inserts extra chunks after IHDR.
+func testPNG(t *testing.T, w, h int, extra ...[]byte) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	img.Set(0, 0, color.RGBA{255, 0, 0, 255})
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	const ihdrEnd = 8 + 12 + 13
+	out := append([]byte(nil), data[:ihdrEnd]...)
+	for _, c := range extra {
+		out = append(out, c...)
+	}
+	return append(out, data[ihdrEnd:]...)
+}
+
+// hugePNG declares dimensions far over maxImagePixels in a few bytes.
+func hugePNG() []byte {
+	ihdr := binary.BigEndian.AppendUint32(nil, 100000)
+	ihdr = binary.BigEndian.AppendUint32(ihdr, 100000)
+	ihdr = append(ihdr, 8, 6, 0, 0, 0)
+	out := append([]byte("\x89PNG\r\n\x1a\n"), pngChunk("IHDR", ihdr)...)
+	out = append(out, pngChunk("IDAT", []byte{0x78, 0x9c})...)
+	return append(out, pngChunk("IEND", nil)...)
+}
+
+// webpChunk frames data as a RIFF chunk, padded to an even size.
+func webpChunk(fourcc string, data []byte) []byte {
+	b := append([]byte(fourcc), binary.LittleEndian.AppendUint32(nil, uint32(len(data)))...)
+	b = append(b, data...)
+	if len(data)%2 == 1 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func testWebP(chunks ...[]byte) []byte {
+	var body []byte
+	for _, c := range chunks {
+		body = append(body, c...)
+	}
+	out := append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(4+len(body)))...)
+	return append(append(out, "WEBP"...), body...)
+}
+
+func TestProcessImage(t *testing.T) {
+	text := pngChunk("tEXt", []byte("Author\x00someone"))
+	vp8x := func(flags byte) []byte { return webpChunk("VP8X", []byte{flags, 0, 0, 0, 0, 0, 0, 0, 0, 0}) }
+	vp8l := webpChunk("VP8L", []byte{0x2f, 0, 0, 0, 0})
+	for _, tt := range []struct {
+		name        string
+		data        []byte
+		contentType string
+		want        []byte // nil when an error is expected
+		tooLarge    bool
+	}{
+		{"png text stripped", testPNG(t, 4, 4, text), "image/png", testPNG(t, 4, 4), false},
+		{"png unchanged", testPNG(t, 4, 4), "image/png", testPNG(t, 4, 4), false},
+		{"png too many pixels", hugePNG(), "image/png", nil, true},
+		{"corrupt png", []byte("\x89PNG\r\n\x1a\nbroken"), "image/png", nil, false},
+		{"corrupt jpeg", []byte("\xff\xd8\xff\xe0junk"), "image/jpeg", nil, false},
+		{
+			"webp exif and xmp stripped",
+			testWebP(vp8x(0x08|0x04|0x10), webpChunk("EXIF", []byte("Exif\x00\x00MM")), vp8l, webpChunk("XMP ", []byte("<x/>"))),
+			"image/webp",
+			testWebP(vp8x(0x10), vp8l),
+			false,
+		},
+		{"webp unchanged", testWebP(vp8l), "image/webp", testWebP(vp8l), false},
+		{"corrupt webp", append(testWebP(vp8l), "EXIF\xff\xff"...), "image/webp", nil, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := processImage(tt.data, tt.contentType)
+			if tt.want == nil {
+				if err == nil {
+					t.Fatal("processImage succeeded, want an error")
+				}
+				if tooLarge := err == errImageTooLarge; tooLarge != tt.tooLarge {
+					t.Errorf("err = %v, too large = %v, want %v", err, tooLarge, tt.tooLarge)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("processImage =\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteThumbnailsTooLarge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "huge.png")
+	if _, err := writeThumbnails(path, hugePNG(), "image/png", []int{64}); err != errImageTooLarge {
+		t.Errorf("writeThumbnails err = %v, want errImageTooLarge", err)
+	}
+}
+
+func TestUploadRejectsUnprocessableImages(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"too many pixels", hugePNG(), http.StatusRequestEntityTooLarge},
+		{"corrupt jpeg with exif", []byte("\xff\xd8\xff\xe1\x00\x10Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08\xff"), http.StatusBadRequest},
+		{"valid", testPNG(t, 4, 4), http.StatusOK},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, uploadDir, t.TempDir())
+			var body bytes.Buffer
+			mw := multipart.NewWriter(&body)
+			fw, err := mw.CreateFormFile("image", "photo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			fw.Write(tt.data)
+			mw.Close()
+			req := httptest.NewRequest(http.MethodPost, "/upload", &body)
+			req.Header.Set("Content-Type", mw.FormDataContentType())
+			rec := httptest.NewRecorder()
+			handleImageUpload(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			entries, err := os.ReadDir(*uploadDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored := len(entries) > 0; stored != (tt.want == http.StatusOK) {
+				t.Errorf("stored %d file(s) for status %d", len(entries), rec.Code)
+			}
+		})
+	}
+}
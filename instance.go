@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yourusername/markdown-preview/wsproto"
+)
+
+// instanceInfo is the control file a server leaves in the runtime
+// directory so that later invocations for the same document directory
+// hand their file to it instead of starting another server.
+type instanceInfo struct {
+	PID        int    `json:"pid"`
+	URL        string `json:"url"`
+	BasePath   string `json:"basePath,omitempty"`
+	CertSHA256 string `json:"certSha256,omitempty"` // pinned when serving HTTPS
+	Root       string `json:"root"`
+	Token      string `json:"token"`
+}
+
+// openRequest is the body of POST /api/open.
+type openRequest struct {
+	File string `json:"file"`
+	Open bool   `json:"open"` // open a browser tab if none is connected
+}
+
+// instance describes this server once it has claimed its control file.
+var instance struct {
+	ctx   context.Context
+	url   string
+	token string
+
+	mu      sync.Mutex
+	watched map[string]bool
+}
+
+// runtimeDir is where control files live: $XDG_RUNTIME_DIR when set, or a
+// per-user directory under the system temp directory.
+func runtimeDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "markdown-preview")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("markdown-preview-%d", os.Getuid()))
+}
+
+// instancePath returns the control file for a document directory. Servers
+// are shared per directory so that relative links and asset folders keep
+// resolving against the directory they were written for.
+func instancePath() (string, string, error) {
+	root, err := filepath.Abs(documentRoot())
+	if err != nil {
+		return "", "", err
+	}
+	sum := sha256.Sum256([]byte(root))
+	return filepath.Join(runtimeDir(), hex.EncodeToString(sum[:8])+".json"), root, nil
+}
+
+// readInstance returns the control file left by a server for the
+// document directory. The server may have died without removing it.
+func readInstance() (instanceInfo, error) {
+	var info instanceInfo
+	path, _, err := instancePath()
+	if err != nil {
+		return info, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return info, err
+	}
+	err = json.Unmarshal(data, &info)
+	return info, err
+}
+
+// liveInstance reports whether a server for the document directory is
+// running and answering requests.
+func liveInstance() (instanceInfo, bool) {
+	info, err := readInstance()
+	if err != nil {
+		return info, false
+	}
+	client, base := httpClientFor(info.URL, info.CertSHA256, 2*time.Second)
+	resp, err := client.Get(base + info.BasePath + "/")
+	if err != nil {
+		return info, false
+	}
+	resp.Body.Close()
+	return info, true
+}
+
+// openInRunningServer asks a server already previewing the document
+// directory to open file. It returns the URL of that server's page, or
+// false if there is no live server to hand over to.
+func openInRunningServer(file string, openTab bool) (string, bool) {
+	info, err := readInstance()
+	if err != nil {
+		return "", false
+	}
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return "", false
+	}
+	body, _ := json.Marshal(openRequest{File: abs, Open: openTab})
+	client, base := httpClientFor(info.URL, info.CertSHA256, 2*time.Second)
+	req, err := http.NewRequest(http.MethodPost, base+info.BasePath+"/api/open", bytes.NewReader(body))
+	if err != nil {
+		return "", false
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Instance-Token", info.Token)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		// Most likely the server died without removing its control file.
+		return "", false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		log.Printf("Running server at %s refused to open %s: %s", info.URL, file, resp.Status)
+		return "", false
+	}
+	if strings.HasPrefix(info.URL, "http") && info.BasePath != "" {
+		return info.URL + info.BasePath + "/", true
+	}
+	return info.URL, true
+}
+
+// claimInstance writes the control file for this server and returns a
+// function that removes it again, unless another server has taken it over
+// in the meantime.
+func claimInstance(ctx context.Context, url, fingerprint string) func() {
+	instance.ctx = ctx
+	instance.url = url
+	instance.token = newSessionID() + newSessionID()
+
+	path, root, err := instancePath()
+	if err != nil {
+		log.Printf("Single-instance mode disabled: %v", err)
+		return func() {}
+	}
+	data, err := json.Marshal(instanceInfo{PID: os.Getpid(), URL: url, BasePath: basePath, CertSHA256: fingerprint, Root: root, Token: instance.token})
+	if err != nil {
+		log.Printf("Single-instance mode disabled: %v", err)
+		return func() {}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		log.Printf("Single-instance mode disabled: %v", err)
+		return func() {}
+	}
+	tmp := path + fmt.Sprintf(".%d", os.Getpid())
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		log.Printf("Single-instance mode disabled: %v", err)
+		return func() {}
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		log.Printf("Single-instance mode disabled: %v", err)
+		return func() {}
+	}
+
+	return func() {
+		current, err := os.ReadFile(path)
+		if err == nil && bytes.Equal(current, data) {
+			os.Remove(path)
+		}
+	}
+}
+
+// handleOpen lets a later invocation for the same directory hand its file
+// to this server. The file is shown in the connected tabs and watched
+// from then on; one tab is brought to the front, or a new one opened.
+func handleOpen(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token := r.Header.Get("X-Instance-Token")
+	if instance.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(instance.token)) != 1 {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	limitBody(w, r)
+	var req openRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid open request", http.StatusBadRequest)
+		return
+	}
+	root, err := filepath.Abs(documentRoot())
+	if err != nil {
+		http.Error(w, "Failed to resolve document root", http.StatusInternalServerError)
+		return
+	}
+	rel, err := filepath.Rel(root, req.File)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || !isMarkdownPath(req.File) {
+		http.Error(w, "File is not a Markdown file in this server's directory", http.StatusBadRequest)
+		return
+	}
+	if err := openDocument(req.File); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	log.Printf("Opened %s for another invocation", req.File)
+
+	if !hub.focusBrowser(req.File) && req.Open && strings.HasPrefix(instance.url, "http") {
+		go func() {
+			if err := openBrowser(withTokenURL(pageURL(instance.url))); err != nil {
+				log.Printf("Failed to open browser: %v", err)
+			}
+		}()
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// openDocument shows path in every tab, as if an editor had pushed it, and
+// watches it for changes.
+func openDocument(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	text := string(data)
+	pushBuffer(wsproto.PushBuffer{Path: path, Text: &text})
+
+	watchedFile, _ := filepath.Abs(*markdownFile)
+	instance.mu.Lock()
+	defer instance.mu.Unlock()
+	if instance.watched == nil {
+		instance.watched = make(map[string]bool)
+	}
+	if path != watchedFile && !instance.watched[path] {
+		instance.watched[path] = true
+		go watchMarkdownFile(instance.ctx, path)
+	}
+	return nil
+}
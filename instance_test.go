@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setupInstance makes this process the server for a temporary document
+// directory with a known instance token.
+func setupInstance(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	setFlag(t, markdownFile, filepath.Join(root, "index.md"))
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	for _, name := range []string{"index.md", "other.md", "notes.txt"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte("# "+name+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	oldCtx, oldToken := instance.ctx, instance.token
+	instance.ctx, instance.token = ctx, "secret-token"
+	oldBuffers := buffers
+	buffers = &bufferStore{}
+	t.Cleanup(func() {
+		cancel()
+		instance.ctx, instance.token = oldCtx, oldToken
+		buffers = oldBuffers
+		resetCollab()
+	})
+	return root
+}
+
+func TestHandleOpen(t *testing.T) {
+	root := setupInstance(t)
+	outside := filepath.Join(t.TempDir(), "elsewhere.md")
+	os.WriteFile(outside, []byte("# Elsewhere\n"), 0644)
+
+	for _, tt := range []struct {
+		name  string
+		token string
+		file  string
+		want  int
+	}{
+		{"no token", "", filepath.Join(root, "other.md"), http.StatusForbidden},
+		{"wrong token", "guess", filepath.Join(root, "other.md"), http.StatusForbidden},
+		{"outside the root", "secret-token", outside, http.StatusBadRequest},
+		{"escaping the root", "secret-token", filepath.Join(root, "..", filepath.Base(filepath.Dir(outside)), "elsewhere.md"), http.StatusBadRequest},
+		{"not markdown", "secret-token", filepath.Join(root, "notes.txt"), http.StatusBadRequest},
+		{"missing", "secret-token", filepath.Join(root, "gone.md"), http.StatusNotFound},
+		{"markdown in the root", "secret-token", filepath.Join(root, "other.md"), http.StatusNoContent},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := json.Marshal(openRequest{File: tt.file})
+			req := httptest.NewRequest(http.MethodPost, "/api/open", strings.NewReader(string(body)))
+			if tt.token != "" {
+				req.Header.Set("X-Instance-Token", tt.token)
+			}
+			rec := httptest.NewRecorder()
+			handleOpen(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+	if content, ok := buffers.current(); !ok || content.Path != filepath.Join(root, "other.md") {
+		t.Errorf("current buffer = %+v, want other.md", content)
+	}
+}
+
+func TestOpenInRunningServer(t *testing.T) {
+	root := setupInstance(t)
+	path, abs, err := instancePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(filepath.Dir(path), 0700)
+	writeInfo := func(url, token string) {
+		data, _ := json.Marshal(instanceInfo{URL: url, Root: abs, Token: token})
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file := filepath.Join(root, "other.md")
+
+	if _, ok := openInRunningServer(file, false); ok {
+		t.Error("handed over without a control file")
+	}
+
+	// A control file left by a server that is gone falls through to
+	// starting a new one.
+	stale := httptest.NewServer(http.NotFoundHandler())
+	stale.Close()
+	writeInfo(stale.URL, "secret-token")
+	if _, ok := openInRunningServer(file, false); ok {
+		t.Error("handed over to a dead server")
+	}
+
+	srv := newTestServer(t)
+	writeInfo(srv.URL, "wrong-token")
+	if _, ok := openInRunningServer(file, false); ok {
+		t.Error("handed over with a token the server refuses")
+	}
+	writeInfo(srv.URL, "secret-token")
+	if url, ok := openInRunningServer(file, false); !ok || url != srv.URL {
+		t.Errorf("live server: got %q, %v, want %s", url, ok, srv.URL)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+var errRenderBusy = errors.New("all render workers are busy")
+
+// renderLimiter bounds how many renders run at once and how long a caller
+// waits for one. The Markdown parser cannot be interrupted, so a render
+// that overruns its deadline keeps its worker slot until the current
+// block finishes; the caller gets its error straight away.
+type renderLimiter struct {
+	slots   chan struct{}
+	timeout time.Duration
+}
+
+var renderPool = newRenderLimiter(4, 5*time.Second)
+
+func newRenderLimiter(workers int, timeout time.Duration) *renderLimiter {
+	return &renderLimiter{slots: make(chan struct{}, max(workers, 1)), timeout: timeout}
+}
+
+// do runs fn on a worker slot under the render deadline. It returns
+// errRenderBusy if no slot frees up before the deadline and
+// context.DeadlineExceeded if fn itself takes too long. Results should be
+// passed out through variables the caller reads only when do returns nil.
+func (l *renderLimiter) do(ctx context.Context, fn func(context.Context) error) error {
+	if l.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.timeout)
+		defer cancel()
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return errRenderBusy
+		}
+		return ctx.Err()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		defer func() { <-l.slots }()
+		done <- fn(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// renderStatus maps a renderLimiter error to an HTTP status.
+func renderStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, errRenderBusy):
+		return http.StatusServiceUnavailable, "Server busy, try again"
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusServiceUnavailable, "Render timed out"
+	}
+	return http.StatusInternalServerError, "Render failed"
+}
+
+// limitBody caps the request body at the configured size.
+func limitBody(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, int64(*maxBodyMB)<<20)
+}
+
+// parseLimitedForm parses a form body under the size cap, answering 413 or
+// 400 itself and returning false if the request cannot be used.
+func parseLimitedForm(w http.ResponseWriter, r *http.Request) bool {
+	limitBody(w, r)
+	// ParseMultipartForm hides ParseForm errors for non-multipart bodies,
+	// so parse URL-encoded forms first.
+	err := r.ParseForm()
+	if err == nil {
+		err = r.ParseMultipartForm(1 << 20)
+	}
+	if err == nil || errors.Is(err, http.ErrNotMultipart) {
+		return true
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return false
+	}
+	log.Printf("Invalid form: %v", err)
+	http.Error(w, "Invalid form data", http.StatusBadRequest)
+	return false
+}
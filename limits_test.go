@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderLimiter(t *testing.T) {
+	l := newRenderLimiter(1, 50*time.Millisecond)
+
+	// A render that ignores its deadline still returns to the caller on time.
+	release := make(chan struct{})
+	defer close(release)
+	start := time.Now()
+	err := l.do(context.Background(), func(context.Context) error {
+		<-release
+		return nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("slow render: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("slow render returned after %v", elapsed)
+	}
+
+	// It keeps its slot, so the next caller finds the pool busy.
+	err = l.do(context.Background(), func(context.Context) error { return nil })
+	if !errors.Is(err, errRenderBusy) {
+		t.Errorf("full pool: got %v, want %v", err, errRenderBusy)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.do(ctx, func(context.Context) error { return nil }); !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled caller: got %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestConvertBusyRetryAfter(t *testing.T) {
+	srv := newTestServer(t)
+	renderPool = newRenderLimiter(1, 20*time.Millisecond)
+	renderPool.slots <- struct{}{}
+	defer func() { <-renderPool.slots }()
+
+	resp := postForm(t, srv, "/convert", nil)
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("status %d, want 503", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After = %q, want 1", got)
+	}
+}
+
+func TestLimitBody(t *testing.T) {
+	srv := newTestServer(t)
+	old := *maxBodyMB
+	t.Cleanup(func() { *maxBodyMB = old })
+	*maxBodyMB = 1
+
+	for _, tt := range []struct {
+		size int
+		want int
+	}{
+		{1 << 10, http.StatusOK},
+		{2 << 20, http.StatusRequestEntityTooLarge},
+	} {
+		body := "markdown=" + strings.Repeat("a", tt.size)
+		resp, err := http.Post(srv.URL+"/convert", "application/x-www-form-urlencoded", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%d byte body: status %d, want %d", tt.size, resp.StatusCode, tt.want)
+		}
+	}
+}
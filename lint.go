@@ -0,0 +1,344 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Diagnostic severities, numbered as in the Language Server Protocol.
+const (
+	severityError   = 1
+	severityWarning = 2
+	severityInfo    = 3
+)
+
+// diagnostic is a problem found by the linter or the link checker. Lines
+// are zero-based; columns are byte offsets into the line.
+type diagnostic struct {
+	Line     int
+	Col      int
+	EndCol   int
+	Severity int
+	Source   string
+	Message  string
+}
+
+// sourceLine is one line of a Markdown document, with code fences and
+// inline code spans masked out so rules do not fire inside code.
+type sourceLine struct {
+	Text    string // original text
+	Masked  string // text with code spans replaced by spaces
+	InFence bool   // inside (or delimiting) a fenced code block
+}
+
+var fencePattern = regexp.MustCompile("^ {0,3}(`{3,}|~{3,})")
+
+func splitSourceLines(src []byte) []sourceLine {
+	text := strings.ReplaceAll(string(src), "\r\n", "\n")
+	var lines []sourceLine
+	fence := ""
+	for _, line := range strings.Split(text, "\n") {
+		l := sourceLine{Text: line, Masked: line}
+		if m := fencePattern.FindStringSubmatch(line); m != nil {
+			switch {
+			case fence == "":
+				fence = m[1]
+				l.InFence = true
+			case m[1][0] == fence[0] && len(m[1]) >= len(fence):
+				fence = ""
+				l.InFence = true
+			}
+		} else if fence != "" {
+			l.InFence = true
+		}
+		if !l.InFence {
+			l.Masked = maskCodeSpans(line)
+		}
+		lines = append(lines, l)
+	}
+	return lines
+}
+
+func maskCodeSpans(line string) string {
+	b := []byte(line)
+	for i := 0; i < len(b); {
+		if b[i] != '`' {
+			i++
+			continue
+		}
+		run := 1
+		for i+run < len(b) && b[i+run] == '`' {
+			run++
+		}
+		closing := strings.Index(line[i+run:], strings.Repeat("`", run))
+		if closing < 0 {
+			i += run
+			continue
+		}
+		end := i + run + closing + run
+		for j := i; j < end; j++ {
+			b[j] = ' '
+		}
+		i = end
+	}
+	return string(b)
+}
+
+// outlineHeading is an ATX or setext heading with its GitHub style anchor.
+type outlineHeading struct {
+	Level int
+	Text  string
+	Line  int
+	Slug  string
+}
+
+var atxHeadingPattern = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+
+func headingOutline(lines []sourceLine) []outlineHeading {
+	var headings []outlineHeading
+	slugs := map[string]int{}
+	add := func(level int, text string, line int) {
+		slug := headingSlug(text)
+		if n := slugs[slug]; n > 0 {
+			slugs[slug] = n + 1
+			slug = fmt.Sprintf("%s-%d", slug, n)
+		} else {
+			slugs[slug] = 1
+		}
+		headings = append(headings, outlineHeading{Level: level, Text: text, Line: line, Slug: slug})
+	}
+	for i, l := range lines {
+		if l.InFence {
+			continue
+		}
+		if m := atxHeadingPattern.FindStringSubmatch(l.Text); m != nil {
+			add(len(m[1]), strings.TrimSpace(m[2]), i)
+			continue
+		}
+		if i > 0 && !lines[i-1].InFence && strings.TrimSpace(lines[i-1].Text) != "" {
+			underline := strings.TrimSpace(l.Text)
+			prev := strings.TrimSpace(lines[i-1].Text)
+			if prev[0] == '#' || prev[0] == '-' || prev[0] == '>' {
+				continue
+			}
+			if underline != "" && strings.Trim(underline, "=") == "" {
+				add(1, prev, i-1)
+			} else if len(underline) >= 2 && strings.Trim(underline, "-") == "" {
+				add(2, prev, i-1)
+			}
+		}
+	}
+	return headings
+}
+
+// headingSlug derives the anchor GitHub generates for a heading.
+func headingSlug(text string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_':
+			b.WriteRune(r)
+		case r == ' ':
+			b.WriteByte('-')
+		}
+	}
+	return b.String()
+}
+
+// markdownLink is an inline link, image or reference definition, located
+// by the span of its destination.
+type markdownLink struct {
+	Line       int
+	Start      int // byte offset of the destination
+	End        int
+	MatchStart int // byte offsets of the whole link
+	MatchEnd   int
+	Dest       string
+	Text       string
+	IsImage    bool
+}
+
+var (
+	inlineLinkPattern = regexp.MustCompile(`(!?)\[((?:[^\[\]]|\[[^\]]*\])*)\]\(\s*<?([^)\s>]*)>?(?:\s+"[^"]*")?\s*\)`)
+	refDefPattern     = regexp.MustCompile(`^ {0,3}\[[^\]]+\]:\s*<?([^\s>]+)>?`)
+)
+
+func findLinks(lines []sourceLine) []markdownLink {
+	var links []markdownLink
+	for i, l := range lines {
+		if l.InFence {
+			continue
+		}
+		if m := refDefPattern.FindStringSubmatchIndex(l.Masked); m != nil {
+			links = append(links, markdownLink{
+				Line: i, Start: m[2], End: m[3], MatchStart: m[0], MatchEnd: m[1],
+				Dest: l.Masked[m[2]:m[3]],
+			})
+			continue
+		}
+		for _, m := range inlineLinkPattern.FindAllStringSubmatchIndex(l.Masked, -1) {
+			links = append(links, markdownLink{
+				Line:       i,
+				Start:      m[6],
+				End:        m[7],
+				MatchStart: m[0],
+				MatchEnd:   m[1],
+				Dest:       l.Masked[m[6]:m[7]],
+				Text:       l.Masked[m[4]:m[5]],
+				IsImage:    m[3] > m[2],
+			})
+		}
+	}
+	return links
+}
+
+// splitLinkDest separates a relative destination into its file path and
+// fragment. External URLs report ok == false.
+func splitLinkDest(dest string) (path, fragment string, ok bool) {
+	if dest == "" {
+		return "", "", false
+	}
+	if u, err := url.Parse(dest); err != nil || u.Scheme != "" || u.Host != "" || strings.HasPrefix(dest, "/") {
+		return "", "", false
+	}
+	path, fragment, _ = strings.Cut(dest, "#")
+	if unescaped, err := url.PathUnescape(path); err == nil {
+		path = unescaped
+	}
+	return path, fragment, true
+}
+
+// lintMarkdown applies the style rules to a document.
+func lintMarkdown(src []byte) []diagnostic {
+	lines := splitSourceLines(src)
+	var diags []diagnostic
+	report := func(line, col, endCol, severity int, format string, args ...interface{}) {
+		diags = append(diags, diagnostic{
+			Line: line, Col: col, EndCol: endCol, Severity: severity,
+			Source: "lint", Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	openFence := -1
+	for i, l := range lines {
+		if m := fencePattern.FindStringIndex(l.Text); m != nil && l.InFence {
+			if openFence < 0 {
+				openFence = i
+			} else {
+				openFence = -1
+			}
+		}
+		if l.InFence {
+			continue
+		}
+		trimmed := strings.TrimRight(l.Text, " \t")
+		if trailing := len(l.Text) - len(trimmed); trailing > 0 && l.Text[len(trimmed):] != "  " {
+			report(i, len(trimmed), len(l.Text), severityInfo, "Trailing whitespace")
+		}
+	}
+	if openFence >= 0 {
+		report(openFence, 0, len(lines[openFence].Text), severityError, "Code fence is never closed")
+	}
+
+	headings := headingOutline(lines)
+	seen := map[string]int{}
+	h1 := -1
+	for i, h := range headings {
+		end := len(lines[h.Line].Text)
+		if i > 0 && h.Level > headings[i-1].Level+1 {
+			report(h.Line, 0, end, severityWarning, "Heading level jumps from H%d to H%d", headings[i-1].Level, h.Level)
+		}
+		if h.Text == "" {
+			report(h.Line, 0, end, severityWarning, "Empty heading")
+		}
+		if prev, ok := seen[strings.ToLower(h.Text)]; ok {
+			report(h.Line, 0, end, severityInfo, "Duplicate heading (first used on line %d)", prev+1)
+		} else {
+			seen[strings.ToLower(h.Text)] = h.Line
+		}
+		if h.Level == 1 {
+			if h1 >= 0 {
+				report(h.Line, 0, end, severityWarning, "Multiple top-level headings (first on line %d)", h1+1)
+			} else {
+				h1 = h.Line
+			}
+		}
+	}
+
+	for _, link := range findLinks(lines) {
+		if link.Dest == "" {
+			report(link.Line, link.Start, link.End, severityWarning, "Link has no destination")
+		}
+		if link.IsImage && strings.TrimSpace(link.Text) == "" {
+			report(link.Line, link.Start, link.End, severityInfo, "Image has no alt text")
+		}
+	}
+	return diags
+}
+
+// checkLinks verifies that relative links in the document at path point
+// to existing files and that their fragments match a heading.
+func checkLinks(path string, src []byte) []diagnostic {
+	lines := splitSourceLines(src)
+	var diags []diagnostic
+	anchors := map[string]map[string]bool{"": slugSet(headingOutline(lines))}
+	dir := filepath.Dir(path)
+
+	for _, link := range findLinks(lines) {
+		target, fragment, ok := splitLinkDest(link.Dest)
+		if !ok {
+			continue
+		}
+		report := func(format string, args ...interface{}) {
+			diags = append(diags, diagnostic{
+				Line: link.Line, Col: link.Start, EndCol: link.End, Severity: severityWarning,
+				Source: "links", Message: fmt.Sprintf(format, args...),
+			})
+		}
+		key := ""
+		if target != "" {
+			full := filepath.Join(dir, filepath.FromSlash(target))
+			info, err := os.Stat(full)
+			if err != nil {
+				report("Linked file %s does not exist", target)
+				continue
+			}
+			if fragment == "" || info.IsDir() || !isMarkdownPath(full) {
+				continue
+			}
+			key = full
+			if _, ok := anchors[key]; !ok {
+				data, err := os.ReadFile(full)
+				if err != nil {
+					continue
+				}
+				anchors[key] = slugSet(headingOutline(splitSourceLines(data)))
+			}
+		}
+		if fragment != "" && !anchors[key][strings.ToLower(fragment)] {
+			report("No heading matches anchor #%s", fragment)
+		}
+	}
+	return diags
+}
+
+func slugSet(headings []outlineHeading) map[string]bool {
+	set := make(map[string]bool, len(headings))
+	for _, h := range headings {
+		set[h.Slug] = true
+	}
+	return set
+}
+
+func isMarkdownPath(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".md", ".markdown", ".mdown", ".mkd":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listenFDsStart is the first file descriptor systemd passes to a
+// socket-activated service.
+const listenFDsStart = 3
+
+// openListeners returns the listeners to serve on and the URL the server
+// is reached at. Sockets passed in by systemd take precedence, then
+// -unix-socket, then the first free TCP port from -port. With a TLS
+// configuration every listener serves HTTPS.
+func openListeners(cfg *tls.Config) ([]net.Listener, string) {
+	listeners, url := openPlainListeners()
+	if cfg == nil {
+		return listeners, url
+	}
+	for i, l := range listeners {
+		listeners[i] = tls.NewListener(l, cfg)
+	}
+	if rest, ok := strings.CutPrefix(url, "http://"); ok {
+		url = "https://" + rest
+	}
+	return listeners, url
+}
+
+func openPlainListeners() ([]net.Listener, string) {
+	inherited, err := systemdListeners()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(inherited) > 0 {
+		log.Printf("Serving on %d socket(s) passed in by systemd", len(inherited))
+		return inherited, listenerURL(inherited[0])
+	}
+
+	if *unixSocket != "" {
+		mode, err := strconv.ParseUint(*unixSocketMode, 8, 32)
+		if err != nil {
+			log.Fatalf("-unix-socket-mode must be an octal mode such as 0660, got %q", *unixSocketMode)
+		}
+		path, err := filepath.Abs(*unixSocket)
+		if err != nil {
+			log.Fatal(err)
+		}
+		l, err := listenUnix(path, os.FileMode(mode))
+		if err != nil {
+			log.Fatal(err)
+		}
+		return []net.Listener{l}, listenerURL(l)
+	}
+
+	l, url := findAvailablePort(*port, *host)
+	return []net.Listener{l}, url
+}
+
+// systemdListeners returns the sockets inherited through the systemd
+// LISTEN_FDS protocol, or none if the process was not socket-activated.
+func systemdListeners() ([]net.Listener, error) {
+	n, names := systemdListenFDs()
+	var listeners []net.Listener
+	for i := 0; i < n; i++ {
+		f := os.NewFile(uintptr(listenFDsStart+i), names[i])
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inherited socket %s: %v", names[i], err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// systemdListenFDs reads how many sockets systemd passed to this process
+// and their names, "LISTEN_FD_<fd>" where LISTEN_FDNAMES gives none. The
+// variables are cleared so that child processes don't pick them up.
+func systemdListenFDs() (int, []string) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return 0, nil
+	}
+	given := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	names := make([]string, n)
+	for i := range names {
+		names[i] = fmt.Sprintf("LISTEN_FD_%d", listenFDsStart+i)
+		if i < len(given) && given[i] != "" {
+			names[i] = given[i]
+		}
+	}
+	return n, names
+}
+
+// listenUnix listens on a Unix domain socket at path with the given
+// permissions. A socket file left behind by a server that is no longer
+// running is replaced; one that still accepts connections is an error.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("another server is already listening on %s", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// listenerURL describes where l can be reached. Unix sockets have no URL a
+// browser can open, so they are given as "unix:" followed by the path.
+func listenerURL(l net.Listener) string {
+	if addr, ok := l.Addr().(*net.UnixAddr); ok {
+		return "unix:" + addr.Name
+	}
+	host, _, err := net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		return "http://" + l.Addr().String()
+	}
+	return serverURL(host, l.Addr())
+}
+
+// httpClientFor returns a client and base URL for talking to the server at
+// url, which may be a "unix:" socket address. A non-empty fingerprint pins
+// the server's TLS certificate.
+func httpClientFor(url, fingerprint string, timeout time.Duration) (*http.Client, string) {
+	transport := &http.Transport{}
+	if fingerprint != "" {
+		transport.TLSClientConfig = pinnedTLSConfig(fingerprint)
+	}
+	if path, ok := strings.CutPrefix(url, "unix:"); ok {
+		var dialer net.Dialer
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", path)
+		}
+		url = "http://unix"
+		if fingerprint != "" {
+			url = "https://unix"
+		}
+	}
+	return &http.Client{Timeout: timeout, Transport: transport}, url
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestFindAvailablePort(t *testing.T) {
+	// Port 0 takes whatever the kernel hands out.
+	l, url := findAvailablePort("0", "127.0.0.1")
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+	if port == 0 || url != "http://127.0.0.1:"+strconv.Itoa(port) {
+		t.Errorf("port 0: listening on %v, url %q", l.Addr(), url)
+	}
+
+	// A taken port is skipped, and the listener is handed back open so
+	// nothing can take the port in between.
+	old := *maxPort
+	*maxPort = port + 20
+	t.Cleanup(func() { *maxPort = old })
+	next, url := findAvailablePort(":"+strconv.Itoa(port), "127.0.0.1")
+	defer next.Close()
+	got := next.Addr().(*net.TCPAddr).Port
+	if got <= port || got > *maxPort || url != "http://127.0.0.1:"+strconv.Itoa(got) {
+		t.Errorf("port %d taken: listening on %v, url %q", port, next.Addr(), url)
+	}
+
+	// Wildcard binds are opened in the browser through localhost.
+	wild, url := findAvailablePort("0", "")
+	defer wild.Close()
+	if want := "http://localhost:" + strconv.Itoa(wild.Addr().(*net.TCPAddr).Port); url != want {
+		t.Errorf("wildcard: url %q, want %q", url, want)
+	}
+}
+
+func TestFindAvailablePortIPv6(t *testing.T) {
+	probe, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 loopback unavailable:", err)
+	}
+	probe.Close()
+
+	l, url := findAvailablePort("0", "::1")
+	defer l.Close()
+	addr := l.Addr().(*net.TCPAddr)
+	if !addr.IP.Equal(net.IPv6loopback) || url != "http://[::1]:"+strconv.Itoa(addr.Port) {
+		t.Errorf("listening on %v, url %q", addr, url)
+	}
+}
+
+func TestSystemdListenFDs(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	for _, tt := range []struct {
+		name            string
+		pid, fds, names string
+		want            []string
+	}{
+		{"not activated", "", "", "", nil},
+		{"other process", "1", "2", "", nil},
+		{"bad count", pid, "two", "", nil},
+		{"zero sockets", pid, "0", "", nil},
+		{"unnamed", pid, "2", "", []string{"LISTEN_FD_3", "LISTEN_FD_4"}},
+		{"named", pid, "2", "http:", []string{"http", "LISTEN_FD_4"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("LISTEN_PID", tt.pid)
+			t.Setenv("LISTEN_FDS", tt.fds)
+			t.Setenv("LISTEN_FDNAMES", tt.names)
+			n, names := systemdListenFDs()
+			if n != len(tt.want) || !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("got %d %q, want %q", n, names, tt.want)
+			}
+			if tt.want != nil && os.Getenv("LISTEN_FDS") != "" {
+				t.Error("LISTEN_FDS left set for child processes")
+			}
+		})
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	dir := t.TempDir()
+
+	// A socket left behind by a server that died is replaced.
+	path := filepath.Join(dir, "stale.sock")
+	old, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skip("Unix sockets unavailable:", err)
+	}
+	old.(*net.UnixListener).SetUnlinkOnClose(false)
+	old.Close()
+	l, err := listenUnix(path, 0600)
+	if err != nil {
+		t.Fatalf("stale socket: %v", err)
+	}
+	defer l.Close()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("mode = %v, want 0600", info.Mode().Perm())
+	}
+	if got := listenerURL(l); got != "unix:"+path {
+		t.Errorf("listenerURL = %q", got)
+	}
+
+	// One that still accepts connections belongs to a running server.
+	if l2, err := listenUnix(path, 0600); err == nil {
+		l2.Close()
+		t.Error("took over a live socket")
+	}
+
+	// Anything else at the path is left alone.
+	file := filepath.Join(dir, "notes.txt")
+	os.WriteFile(file, []byte("keep"), 0644)
+	if l3, err := listenUnix(file, 0600); err == nil {
+		l3.Close()
+		t.Error("replaced a regular file")
+	}
+	if data, _ := os.ReadFile(file); string(data) != "keep" {
+		t.Error("regular file was changed")
+	}
+}
@@ -0,0 +1,640 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// LSP constants used by this server.
+const (
+	lspTextDocumentSyncFull = 1
+	lspSymbolKindString     = 15
+	lspCompletionKindFile   = 17
+	lspCompletionKindFolder = 19
+	lspCompletionKindRef    = 18
+	lspErrMethodNotFound    = -32601
+	lspErrInvalidParams     = -32602
+)
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+// valid reports whether p can index into a document; lines and characters
+// are zero-based and never negative.
+func (p lspPosition) valid() bool {
+	return p.Line >= 0 && p.Character >= 0
+}
+
+var errInvalidPosition = &lspError{Code: lspErrInvalidParams, Message: "negative line or character"}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+type lspDocumentSymbol struct {
+	Name           string              `json:"name"`
+	Kind           int                 `json:"kind"`
+	Range          lspRange            `json:"range"`
+	SelectionRange lspRange            `json:"selectionRange"`
+	Children       []lspDocumentSymbol `json:"children,omitempty"`
+}
+
+type lspTextEdit struct {
+	Range   lspRange `json:"range"`
+	NewText string   `json:"newText"`
+}
+
+type lspCompletionItem struct {
+	Label    string      `json:"label"`
+	Kind     int         `json:"kind"`
+	Detail   string      `json:"detail,omitempty"`
+	TextEdit lspTextEdit `json:"textEdit"`
+}
+
+type lspTextDocumentPosition struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Position lspPosition `json:"position"`
+}
+
+type lspIncoming struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type lspError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// lspServer speaks the Language Server Protocol over a pair of streams.
+// Requests are handled one at a time on the reading goroutine, so the
+// document map needs no locking.
+type lspServer struct {
+	in       *bufio.Reader
+	out      io.Writer
+	docs     map[string]string // URI to current buffer contents
+	active   string            // URI mirrored to the preview server
+	cursor   int               // one-based cursor line in the active document
+	preview  string            // base URL of a running preview server
+	token    string            // access token for the preview server, if any
+	pushes   chan bufferPush
+	shutdown bool
+}
+
+// bufferPush is the payload accepted by the preview server's /buffer route.
+type bufferPush struct {
+	Path string `json:"path"`
+	Text string `json:"text"`
+	Line int    `json:"line,omitempty"`
+}
+
+// runLSP implements the lsp subcommand.
+func runLSP(args []string) int {
+	fs := flag.NewFlagSet("lsp", flag.ContinueOnError)
+	preview := fs.String("preview", "", "URL of a running preview server to keep in sync with the active buffer, including ?token= if it needs one")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s lsp [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	// stdout carries the protocol, so keep diagnostics on stderr.
+	log.SetOutput(os.Stderr)
+	s := &lspServer{
+		in:     bufio.NewReader(os.Stdin),
+		out:    os.Stdout,
+		docs:   make(map[string]string),
+		pushes: make(chan bufferPush, 1),
+	}
+	s.setPreview(*preview)
+	go s.pushLoop()
+	return s.serve()
+}
+
+func (s *lspServer) serve() int {
+	for {
+		msg, err := s.read()
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("lsp: %v", err)
+			}
+			return 1
+		}
+		if msg.Method == "exit" {
+			if s.shutdown {
+				return 0
+			}
+			return 1
+		}
+		result, rpcErr := s.handle(msg)
+		if len(msg.ID) > 0 {
+			s.respond(msg.ID, result, rpcErr)
+		} else if rpcErr != nil {
+			log.Printf("lsp: %s: %s", msg.Method, rpcErr.Message)
+		}
+	}
+}
+
+func (s *lspServer) read() (*lspIncoming, error) {
+	headers, err := textproto.NewReader(s.in).ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.Atoi(headers.Get("Content-Length"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid Content-Length: %v", err)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(s.in, body); err != nil {
+		return nil, err
+	}
+	var msg lspIncoming
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+func (s *lspServer) write(v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("lsp: %v", err)
+		return
+	}
+	fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n", len(body))
+	s.out.Write(body)
+}
+
+func (s *lspServer) respond(id json.RawMessage, result interface{}, rpcErr *lspError) {
+	msg := map[string]interface{}{"jsonrpc": "2.0", "id": id}
+	if rpcErr != nil {
+		msg["error"] = rpcErr
+	} else {
+		msg["result"] = result
+	}
+	s.write(msg)
+}
+
+func (s *lspServer) notify(method string, params interface{}) {
+	s.write(map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params})
+}
+
+func (s *lspServer) handle(msg *lspIncoming) (interface{}, *lspError) {
+	switch msg.Method {
+	case "initialize":
+		var params struct {
+			InitializationOptions struct {
+				PreviewURL string `json:"previewUrl"`
+			} `json:"initializationOptions"`
+		}
+		if len(msg.Params) > 0 {
+			if err := json.Unmarshal(msg.Params, &params); err != nil {
+				return nil, &lspError{Code: lspErrInvalidParams, Message: err.Error()}
+			}
+		}
+		if u := params.InitializationOptions.PreviewURL; u != "" {
+			s.setPreview(u)
+		}
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync":       lspTextDocumentSyncFull,
+				"documentSymbolProvider": true,
+				"definitionProvider":     true,
+				"completionProvider": map[string]interface{}{
+					"triggerCharacters": []string{"(", "/", "#"},
+				},
+			},
+			"serverInfo": map[string]string{"name": "markdown-preview"},
+		}, nil
+	case "initialized", "$/cancelRequest", "$/setTrace", "textDocument/didSave":
+		return nil, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+	case "textDocument/didOpen":
+		var params struct {
+			TextDocument struct {
+				URI  string `json:"uri"`
+				Text string `json:"text"`
+			} `json:"textDocument"`
+		}
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, &lspError{Code: lspErrInvalidParams, Message: err.Error()}
+		}
+		s.docs[params.TextDocument.URI] = params.TextDocument.Text
+		s.active, s.cursor = params.TextDocument.URI, 0
+		s.changed(params.TextDocument.URI)
+		return nil, nil
+	case "textDocument/didChange":
+		var params struct {
+			TextDocument struct {
+				URI string `json:"uri"`
+			} `json:"textDocument"`
+			ContentChanges []struct {
+				Text string `json:"text"`
+			} `json:"contentChanges"`
+		}
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, &lspError{Code: lspErrInvalidParams, Message: err.Error()}
+		}
+		if n := len(params.ContentChanges); n > 0 {
+			// Full sync: the last change holds the whole document.
+			s.docs[params.TextDocument.URI] = params.ContentChanges[n-1].Text
+			s.changed(params.TextDocument.URI)
+		}
+		return nil, nil
+	case "textDocument/didClose":
+		var params lspTextDocumentPosition
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, &lspError{Code: lspErrInvalidParams, Message: err.Error()}
+		}
+		delete(s.docs, params.TextDocument.URI)
+		s.notify("textDocument/publishDiagnostics", map[string]interface{}{
+			"uri":         params.TextDocument.URI,
+			"diagnostics": []lspDiagnostic{},
+		})
+		return nil, nil
+	case "markdownPreview/sync":
+		// Sent by editor plugins when the user switches buffers or moves
+		// the cursor, so the preview follows whatever is in front.
+		var params struct {
+			TextDocument struct {
+				URI string `json:"uri"`
+			} `json:"textDocument"`
+			Position *lspPosition `json:"position"`
+		}
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, &lspError{Code: lspErrInvalidParams, Message: err.Error()}
+		}
+		if params.Position != nil && !params.Position.valid() {
+			return nil, errInvalidPosition
+		}
+		if _, ok := s.docs[params.TextDocument.URI]; ok {
+			if params.TextDocument.URI != s.active {
+				s.cursor = 0
+			}
+			s.active = params.TextDocument.URI
+			if params.Position != nil {
+				s.cursor = params.Position.Line + 1
+			}
+			s.syncPreview()
+		}
+		return nil, nil
+	case "textDocument/documentSymbol":
+		var params lspTextDocumentPosition
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, &lspError{Code: lspErrInvalidParams, Message: err.Error()}
+		}
+		return s.documentSymbols(params.TextDocument.URI), nil
+	case "textDocument/definition":
+		var params lspTextDocumentPosition
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, &lspError{Code: lspErrInvalidParams, Message: err.Error()}
+		}
+		if !params.Position.valid() {
+			return nil, errInvalidPosition
+		}
+		return s.definition(params.TextDocument.URI, params.Position), nil
+	case "textDocument/completion":
+		var params lspTextDocumentPosition
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, &lspError{Code: lspErrInvalidParams, Message: err.Error()}
+		}
+		if !params.Position.valid() {
+			return nil, errInvalidPosition
+		}
+		return s.completion(params.TextDocument.URI, params.Position), nil
+	}
+	if len(msg.ID) == 0 {
+		// Unknown notifications are ignored, as the protocol requires.
+		return nil, nil
+	}
+	return nil, &lspError{Code: lspErrMethodNotFound, Message: "method not found: " + msg.Method}
+}
+
+// changed republishes diagnostics and mirrors the active buffer.
+func (s *lspServer) changed(uri string) {
+	text := s.docs[uri]
+	path := uriToPath(uri)
+	lines := splitSourceLines([]byte(text))
+
+	diags := []lspDiagnostic{}
+	for _, d := range append(lintMarkdown([]byte(text)), checkLinks(path, []byte(text))...) {
+		line := ""
+		if d.Line < len(lines) {
+			line = lines[d.Line].Text
+		}
+		diags = append(diags, lspDiagnostic{
+			Range: lspRange{
+				Start: lspPosition{Line: d.Line, Character: utf16Column(line, d.Col)},
+				End:   lspPosition{Line: d.Line, Character: utf16Column(line, d.EndCol)},
+			},
+			Severity: d.Severity,
+			Source:   "markdown-preview/" + d.Source,
+			Message:  d.Message,
+		})
+	}
+	s.notify("textDocument/publishDiagnostics", map[string]interface{}{"uri": uri, "diagnostics": diags})
+
+	if uri == s.active {
+		s.syncPreview()
+	}
+}
+
+// syncPreview queues the active buffer for the preview server, replacing
+// any push that has not been sent yet.
+func (s *lspServer) syncPreview() {
+	if s.preview == "" || s.active == "" {
+		return
+	}
+	push := bufferPush{Path: uriToPath(s.active), Text: s.docs[s.active], Line: s.cursor}
+	select {
+	case <-s.pushes:
+	default:
+	}
+	s.pushes <- push
+}
+
+// setPreview sets the preview server URL. A token in its query string, as
+// in the URL the server prints at startup, is sent as a Bearer token.
+func (s *lspServer) setPreview(raw string) {
+	s.preview, s.token = raw, ""
+	if u, err := url.Parse(raw); err == nil {
+		s.token = u.Query().Get("token")
+		u.RawQuery, u.Fragment = "", ""
+		s.preview = u.String()
+	}
+	s.preview = strings.TrimRight(s.preview, "/")
+}
+
+func (s *lspServer) pushLoop() {
+	client := &http.Client{Timeout: 5 * time.Second}
+	failing := false
+	for push := range s.pushes {
+		body, err := json.Marshal(push)
+		if err != nil {
+			continue
+		}
+		req, err := http.NewRequest(http.MethodPost, s.preview+"/buffer", bytes.NewReader(body))
+		if err != nil {
+			continue
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if s.token != "" {
+			req.Header.Set("Authorization", "Bearer "+s.token)
+		}
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				err = fmt.Errorf("preview server returned %s", resp.Status)
+			}
+		}
+		// Only log transitions so a stopped preview server doesn't flood the editor's log.
+		if err != nil && !failing {
+			log.Printf("lsp: failed to sync preview: %v", err)
+		}
+		failing = err != nil
+	}
+}
+
+func (s *lspServer) documentSymbols(uri string) []lspDocumentSymbol {
+	lines := splitSourceLines([]byte(s.docs[uri]))
+	headings := headingOutline(lines)
+
+	var build func(i, level int) ([]lspDocumentSymbol, int)
+	build = func(i, level int) ([]lspDocumentSymbol, int) {
+		symbols := []lspDocumentSymbol{}
+		for i < len(headings) && headings[i].Level > level {
+			h := headings[i]
+			sym := lspDocumentSymbol{
+				Name:           h.Text,
+				Kind:           lspSymbolKindString,
+				SelectionRange: lineRange(h.Line, lines[h.Line].Text),
+			}
+			if sym.Name == "" {
+				sym.Name = strings.Repeat("#", h.Level)
+			}
+			sym.Children, i = build(i+1, h.Level)
+			// A section runs until the next heading at the same or a higher level.
+			last := len(lines) - 1
+			if i < len(headings) {
+				last = headings[i].Line - 1
+			}
+			sym.Range = lspRange{
+				Start: lspPosition{Line: h.Line},
+				End:   lspPosition{Line: last, Character: utf16Column(lines[last].Text, len(lines[last].Text))},
+			}
+			symbols = append(symbols, sym)
+		}
+		return symbols, i
+	}
+	symbols, _ := build(0, 0)
+	return symbols
+}
+
+func (s *lspServer) definition(uri string, pos lspPosition) interface{} {
+	lines := splitSourceLines([]byte(s.docs[uri]))
+	if pos.Line >= len(lines) {
+		return nil
+	}
+	col := byteColumn(lines[pos.Line].Text, pos.Character)
+	for _, link := range findLinks(lines) {
+		if link.Line != pos.Line || col < link.MatchStart || col > link.MatchEnd {
+			continue
+		}
+		target, fragment, ok := splitLinkDest(link.Dest)
+		if !ok {
+			return nil
+		}
+		targetURI, targetLines := uri, lines
+		if target != "" {
+			path := filepath.Join(filepath.Dir(uriToPath(uri)), filepath.FromSlash(target))
+			if info, err := os.Stat(path); err != nil || info.IsDir() {
+				return nil
+			}
+			targetURI = pathToURI(path)
+			targetLines = s.linesFor(targetURI)
+		}
+		loc := lspLocation{URI: targetURI}
+		if fragment != "" {
+			for _, h := range headingOutline(targetLines) {
+				if h.Slug == strings.ToLower(fragment) {
+					loc.Range = lineRange(h.Line, targetLines[h.Line].Text)
+					break
+				}
+			}
+		}
+		return loc
+	}
+	return nil
+}
+
+// linesFor returns the open buffer for uri, falling back to the file on disk.
+func (s *lspServer) linesFor(uri string) []sourceLine {
+	if text, ok := s.docs[uri]; ok {
+		return splitSourceLines([]byte(text))
+	}
+	data, err := os.ReadFile(uriToPath(uri))
+	if err != nil || !isMarkdownPath(uriToPath(uri)) {
+		return nil
+	}
+	return splitSourceLines(data)
+}
+
+// completion offers file paths and heading anchors inside a link
+// destination, i.e. after "](" on the current line.
+func (s *lspServer) completion(uri string, pos lspPosition) []lspCompletionItem {
+	items := []lspCompletionItem{}
+	text := s.docs[uri]
+	lines := splitSourceLines([]byte(text))
+	if pos.Line >= len(lines) {
+		return items
+	}
+	prefix := lines[pos.Line].Text[:byteColumn(lines[pos.Line].Text, pos.Character)]
+	open := strings.LastIndex(prefix, "](")
+	if open < 0 || strings.ContainsAny(prefix[open+2:], ") ") {
+		return items
+	}
+	partial := prefix[open+2:]
+	replaceFrom := func(offset int) lspRange {
+		return lspRange{
+			Start: lspPosition{Line: pos.Line, Character: utf16Column(prefix, offset)},
+			End:   pos,
+		}
+	}
+	docDir := filepath.Dir(uriToPath(uri))
+
+	if file, _, ok := strings.Cut(partial, "#"); ok {
+		targetLines := lines
+		if file != "" {
+			targetLines = s.linesFor(pathToURI(filepath.Join(docDir, filepath.FromSlash(file))))
+		}
+		editRange := replaceFrom(open + 2 + len(file) + 1)
+		for _, h := range headingOutline(targetLines) {
+			items = append(items, lspCompletionItem{
+				Label:    h.Slug,
+				Kind:     lspCompletionKindRef,
+				Detail:   strings.Repeat("#", h.Level) + " " + h.Text,
+				TextEdit: lspTextEdit{Range: editRange, NewText: h.Slug},
+			})
+		}
+		return items
+	}
+
+	dirPart := ""
+	if i := strings.LastIndex(partial, "/"); i >= 0 {
+		dirPart = partial[:i+1]
+	}
+	entries, err := os.ReadDir(filepath.Join(docDir, filepath.FromSlash(dirPart)))
+	if err != nil {
+		return items
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	editRange := replaceFrom(open + 2 + len(dirPart))
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		item := lspCompletionItem{Label: e.Name(), Kind: lspCompletionKindFile}
+		if e.IsDir() {
+			item.Label += "/"
+			item.Kind = lspCompletionKindFolder
+		}
+		item.TextEdit = lspTextEdit{Range: editRange, NewText: item.Label}
+		items = append(items, item)
+	}
+	return items
+}
+
+func lineRange(line int, text string) lspRange {
+	return lspRange{
+		Start: lspPosition{Line: line},
+		End:   lspPosition{Line: line, Character: utf16Column(text, len(text))},
+	}
+}
+
+// utf16Column converts a byte offset in line to the UTF-16 code unit
+// offset that LSP positions use.
+func utf16Column(line string, byteCol int) int {
+	if byteCol > len(line) {
+		byteCol = len(line)
+	}
+	n := 0
+	for _, r := range line[:byteCol] {
+		n += len(utf16.Encode([]rune{r}))
+	}
+	return n
+}
+
+// byteColumn is the inverse of utf16Column.
+func byteColumn(line string, character int) int {
+	n := 0
+	for i, r := range line {
+		if n >= character {
+			return i
+		}
+		n += len(utf16.Encode([]rune{r}))
+	}
+	return len(line)
+}
+
+func uriToPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return uri
+	}
+	path := u.Path
+	// file:///C:/dir becomes /C:/dir; drop the slash before the drive letter.
+	if runtime.GOOS == "windows" && len(path) > 2 && path[0] == '/' && path[2] == ':' {
+		path = path[1:]
+	}
+	return filepath.FromSlash(path)
+}
+
+func pathToURI(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	path = filepath.ToSlash(path)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return (&url.URL{Scheme: "file", Path: path}).String()
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestLSPRejectsInvalidParams(t *testing.T) {
+	s := &lspServer{out: &bytes.Buffer{}, docs: map[string]string{"file:///a.md": "# A\n\n[x](#a)\n"}}
+	tests := []struct {
+		method, params string
+	}{
+		{"textDocument/definition", `{"textDocument":{"uri":"file:///a.md"},"position":{"line":-1,"character":0}}`},
+		{"textDocument/definition", `{"textDocument":{"uri":"file:///a.md"},"position":{"line":2,"character":-3}}`},
+		{"textDocument/completion", `{"textDocument":{"uri":"file:///a.md"},"position":{"line":-1,"character":0}}`},
+		{"markdownPreview/sync", `{"textDocument":{"uri":"file:///a.md"},"position":{"line":-5,"character":0}}`},
+		{"initialize", `{"initializationOptions":{"previewUrl":7}}`},
+		{"textDocument/didClose", `{"textDocument":{"uri":1}}`},
+	}
+	for _, tt := range tests {
+		_, rpcErr := s.handle(&lspIncoming{ID: json.RawMessage("1"), Method: tt.method, Params: json.RawMessage(tt.params)})
+		if rpcErr == nil || rpcErr.Code != lspErrInvalidParams {
+			t.Errorf("%s %s: got %+v, want invalid params", tt.method, tt.params, rpcErr)
+		}
+	}
+	if _, ok := s.docs["file:///a.md"]; !ok {
+		t.Error("malformed didClose closed the document")
+	}
+
+	loc, rpcErr := s.handle(&lspIncoming{ID: json.RawMessage("2"), Method: "textDocument/definition",
+		Params: json.RawMessage(`{"textDocument":{"uri":"file:///a.md"},"position":{"line":2,"character":1}}`)})
+	if rpcErr != nil || loc == nil {
+		t.Errorf("definition at a link: got %v, %+v", loc, rpcErr)
+	}
+}
@@ -1,37 +1,62 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
-	"path/filepath"
+	"os/signal"
 	"runtime"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/fsnotify/fsnotify"
-	"github.com/gomarkdown/markdown"
 	"github.com/gorilla/websocket"
 )
 
 var (
-	port         = flag.String("port", "8080", "HTTP server port")
-	host         = flag.String("host", "localhost", "Host to bind to")
-	maxPort      = flag.Int("max-port", 8180, "Maximum port to try")
-	noOpen       = flag.Bool("no-open", false, "Don't open browser automatically")
-	markdownFile = flag.String("file", "content.md", "Markdown file to preview")
-	uploadDir    = flag.String("upload-dir", "uploads", "Directory for uploaded images")
+	port             = flag.String("port", "8080", "HTTP server port")
+	host             = flag.String("host", "localhost", "Host to bind to")
+	maxPort          = flag.Int("max-port", 8180, "Maximum port to try")
+	noOpen           = flag.Bool("no-open", false, "Don't open browser automatically")
+	printURL         = flag.Bool("print-url", false, "Print the server URL on its own line to stdout once listening")
+	basePathFlag     = flag.String("base-path", "", "Serve every route below this path, e.g. /mdpreview, when behind a reverse proxy")
+	unixSocket       = flag.String("unix-socket", "", "Listen on this Unix domain socket instead of a TCP port")
+	unixSocketMode   = flag.String("unix-socket-mode", "0660", "Permissions for the -unix-socket file")
+	tlsCert          = flag.String("tls-cert", "", "Serve HTTPS with this certificate file (PEM)")
+	tlsKey           = flag.String("tls-key", "", "Private key for -tls-cert (PEM)")
+	autoTLS          = flag.Bool("auto-tls", false, "Serve HTTPS with a certificate from an automatically created local CA")
+	tokenFlag        = flag.String("token", "", "Require this access token; \"auto\" generates one and prints it in the startup URL")
+	htpasswdFile     = flag.String("htpasswd", "", "Require basic auth with the users in this htpasswd file")
+	trustedHostsFlag = flag.String("trusted-hosts", "", "Extra host names, comma-separated, accepted in Host and Origin headers")
+	insecureNoAuth   = flag.Bool("insecure-no-auth", false, "Allow listening on a non-loopback address without -token or -htpasswd")
+	newInstance      = flag.Bool("new-instance", false, "Start a new server even if one is already previewing this directory")
+	markdownFile     = flag.String("file", "content.md", "Markdown file to preview")
+	uploadDir        = flag.String("upload-dir", "uploads", "Directory for uploaded images")
+	assetDir         = flag.String("asset-dir", "", "Save pasted images in this directory beside -file, e.g. images/{doc}, and link them relatively")
+	assetName        = flag.String("asset-name", "{name}-{short}{ext}", "File name template for -asset-dir images")
+	imageMaxSize     = flag.Int("image-max-size", 0, "Downscale uploaded images so neither side exceeds this many pixels (0 keeps the original size)")
+	jpegQuality      = flag.Int("jpeg-quality", 85, "Quality for re-encoded JPEG uploads (1-100)")
+	thumbnails       = flag.String("thumbnails", "320", "Comma-separated thumbnail sizes to generate for uploads (empty for none)")
+	attachTypes      = flag.String("attach-types", "pdf,csv,zip,mp4,webm,mp3,ogg,wav", "Comma-separated file types accepted as attachments")
+	maxAttachMB      = flag.Int("max-attach-mb", 50, "Maximum attachment size in MB")
+	renderCacheMB    = flag.Int("render-cache-mb", 32, "Memory limit for cached renders in MB (0 disables the cache)")
+	maxBodyMB        = flag.Int("max-body-mb", 4, "Maximum request body and WebSocket message size in MB")
+	maxUploadMB      = flag.Int("max-upload-mb", 10, "Maximum image upload size in MB")
+	renderTimeout    = flag.Duration("render-timeout", 5*time.Second, "Maximum time to wait for a render, including queueing")
+	renderWorkers    = flag.Int("render-workers", runtime.NumCPU(), "Maximum number of renders running at once")
+	shutdownTimeout  = flag.Duration("shutdown-timeout", 10*time.Second, "How long to wait for requests and WebSocket clients to finish when stopping")
 )
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	CheckOrigin:     checkWebSocketOrigin,
 }
 
 func init() {
@@ -58,7 +83,10 @@ func openBrowser(url string) error {
 	return exec.Command(cmd, args...).Start()
 }
 
-func findAvailablePort(startPort string, hostname string) (string, string) {
+// findAvailablePort listens on the first free port from startPort up to
+// -max-port and returns the listener, which the server then uses, along
+// with the URL to reach it. Port 0 lets the OS pick.
+func findAvailablePort(startPort string, hostname string) (net.Listener, string) {
 	// Remove ":" prefix if present
 	cleanPort := strings.TrimPrefix(startPort, ":")
 	portNum, err := strconv.Atoi(cleanPort)
@@ -66,89 +94,182 @@ func findAvailablePort(startPort string, hostname string) (string, string) {
 		portNum = 8080 // Default if port is invalid
 	}
 
-	for portNum <= *maxPort {
-		addr := fmt.Sprintf("%s:%d", hostname, portNum)
-		listener, err := net.Listen("tcp", addr)
+	last := *maxPort
+	if portNum == 0 {
+		last = 0
+	}
+	for ; portNum <= last; portNum++ {
+		listener, err := net.Listen("tcp", net.JoinHostPort(hostname, strconv.Itoa(portNum)))
 		if err == nil {
-			listener.Close()
-			return addr, fmt.Sprintf("http://%s:%d", hostname, portNum)
+			return listener, serverURL(hostname, listener.Addr())
 		}
-		portNum++
 	}
 	log.Fatalf("No available ports found between %s and %d", startPort, *maxPort)
-	return "", ""
+	return nil, ""
 }
 
-func handleImageUpload(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// serverURL is the address to open in a browser for a listener bound to
+// hostname. Wildcard binds are reached through localhost.
+func serverURL(hostname string, addr net.Addr) string {
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return "http://" + addr.String()
+	}
+	switch hostname {
+	case "", "0.0.0.0", "::":
+		hostname = "localhost"
+	}
+	return "http://" + net.JoinHostPort(hostname, port)
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "fmt":
+			os.Exit(runFmt(os.Args[2:]))
+		case "lsp":
+			os.Exit(runLSP(os.Args[2:]))
+		case "gc":
+			os.Exit(runGC(os.Args[2:]))
+		case "slides":
+			os.Exit(runSlides(os.Args[2:]))
+		}
 	}
 
-	// Handle file upload
-	file, header, err := r.FormFile("image")
+	flag.Parse()
+	renders.setLimit(int64(*renderCacheMB) << 20)
+	renderPool = newRenderLimiter(*renderWorkers, *renderTimeout)
+	if err := checkAssetTemplates(); err != nil {
+		log.Fatal(err)
+	}
+	sizes, err := parseThumbnailSizes(*thumbnails)
 	if err != nil {
-		http.Error(w, "Invalid file upload", http.StatusBadRequest)
-		return
+		log.Fatal(err)
+	}
+	thumbnailSizes = sizes
+	if allowedAttachments, err = parseAttachTypes(*attachTypes); err != nil {
+		log.Fatal(err)
+	}
+	if basePath, err = normalizeBasePath(*basePathFlag); err != nil {
+		log.Fatal(err)
+	}
+	if err := setupAuth(); err != nil {
+		log.Fatal(err)
+	}
+	if *jpegQuality < 1 || *jpegQuality > 100 {
+		log.Fatalf("-jpeg-quality must be between 1 and 100, got %d", *jpegQuality)
 	}
-	defer file.Close()
 
-	// Generate unique filename
-	ext := filepath.Ext(header.Filename)
-	filename := fmt.Sprintf("%d%s", time.Now().UnixNano(), ext)
-	filepath := filepath.Join(*uploadDir, filename)
+	// Hand the file to a server already running for this directory.
+	if !*newInstance {
+		if url, ok := openInRunningServer(*markdownFile, !*noOpen); ok {
+			log.Printf("Opened %s in the server running at %s", *markdownFile, url)
+			if *printURL {
+				fmt.Println(url)
+			}
+			return
+		}
+	}
 
-	// Create the file
-	dst, err := os.Create(filepath)
+	tlsConfig, err := serverTLSConfig()
 	if err != nil {
-		http.Error(w, "Failed to create file", http.StatusInternalServerError)
-		return
+		log.Fatal(err)
 	}
-	defer dst.Close()
-
-	// Copy the uploaded file
-	if _, err := io.Copy(dst, file); err != nil {
-		http.Error(w, "Failed to save file", http.StatusInternalServerError)
-		return
+	listeners, url := openListeners(tlsConfig)
+	if err := checkExposure(listeners); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Starting server at \u001b[36m%s\u001b[0m", withTokenURL(pageURL(url)))
+	if *printURL {
+		// Logs go to stderr, so scripts can read the URL from stdout.
+		fmt.Println(withTokenURL(pageURL(url)))
 	}
+	log.Printf("Watching file: %s", *markdownFile)
 
-	// Return the markdown image syntax
-	imageURL := fmt.Sprintf("/uploads/%s", filename)
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, `{"markdown": "![%s](%s)"}`, header.Filename, imageURL)
-}
+	setupSecurity(listeners)
 
-func main() {
-	flag.Parse()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	// Find available port
-	addr, url := findAvailablePort(*port, *host)
-	log.Printf("Starting server at \u001b[36m%s\u001b[0m", url)
-	log.Printf("Watching file: %s", *markdownFile)
+	if !*newInstance {
+		release := claimInstance(ctx, url, certFingerprint(tlsConfig))
+		defer release()
+	}
 
-	// Create HTTP server
-	http.HandleFunc("/", handlePreview)
-	http.HandleFunc("/ws", handleWebSocket)
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
-	http.Handle("/uploads/", http.StripPrefix("/uploads/", http.FileServer(http.Dir(*uploadDir))))
-	http.HandleFunc("/convert", handleMarkdownConvert)
-	http.HandleFunc("/upload", handleImageUpload)
-	http.HandleFunc("/guide", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "static/guide.html")
-	})
+	watcherDone := make(chan struct{})
+	go func() {
+		watchMarkdownFile(ctx, *markdownFile)
+		close(watcherDone)
+	}()
 
-	// Open browser automatically unless disabled
-	if !*noOpen {
+	// Open browser automatically unless disabled. A Unix socket is only
+	// reachable through a reverse proxy, so there is nothing to open.
+	if !*noOpen && strings.HasPrefix(url, "http") {
 		go func() {
-			if err := openBrowser(url); err != nil {
+			if err := openBrowser(withTokenURL(pageURL(url))); err != nil {
 				log.Printf("Failed to open browser: %v", err)
 			}
 		}()
 	}
 
-	if err := http.ListenAndServe(addr, nil); err != nil {
+	server := &http.Server{Handler: newHandler()}
+	serveErr := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			serveErr <- server.Serve(l)
+		}(l)
+	}
+
+	select {
+	case err := <-serveErr:
 		log.Fatal(err)
+	case <-ctx.Done():
 	}
+	// A second interrupt kills the process straight away.
+	stop()
+	log.Printf("Shutting down (press Ctrl-C again to force)")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	// Shutdown stops accepting connections and waits for requests in
+	// flight, so uploads, renames and format writes finish before exit.
+	// WebSocket connections are hijacked and closed separately.
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Requests still running after %s: %v", *shutdownTimeout, err)
+		server.Close()
+	}
+	hub.shutdown(shutdownCtx)
+	<-watcherDone
+	log.Println("Server stopped")
+}
+
+// newHandler returns the server's routes wrapped in base path handling,
+// security checks and authentication.
+func newHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handlePreview)
+	mux.HandleFunc("/ws", handleWebSocket)
+	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	mux.Handle("/uploads/", http.StripPrefix("/uploads/", http.FileServer(http.Dir(*uploadDir))))
+	mux.HandleFunc("/convert", handleMarkdownConvert)
+	mux.HandleFunc("/format", handleMarkdownFormat)
+	mux.HandleFunc("/upload", handleImageUpload)
+	mux.HandleFunc("/attach", handleAttachment)
+	mux.HandleFunc("/api/assets", handleAssets)
+	mux.HandleFunc("/api/assets/rename", handleAssetRename)
+	mux.HandleFunc("/buffer", handleBufferPush)
+	mux.HandleFunc("/ws/editor", handleEditorSocket)
+	mux.HandleFunc("/api/open", handleOpen)
+	mux.HandleFunc("/api/shares", handleShares)
+	mux.HandleFunc("/s/", handleShare)
+	mux.HandleFunc("/slides", handleSlides)
+	mux.HandleFunc("/slides/export", handleSlidesExport)
+	mux.HandleFunc("/api/slides", handleSlidesAPI)
+	mux.HandleFunc("/guide", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "static/guide.html")
+	})
+	mux.HandleFunc("/debug/vars", handleCacheStats)
+	return withBasePath(protect(requireAuth(mux)))
 }
 
 func handleMarkdownConvert(w http.ResponseWriter, r *http.Request) {
@@ -157,15 +278,31 @@ func handleMarkdownConvert(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !parseLimitedForm(w, r) {
+		return
+	}
+
 	content := []byte(r.FormValue("markdown"))
 	log.Printf("Converting markdown content (length: %d)", len(content))
 
-	// Convert markdown to HTML
-	html := markdown.ToHTML(content, nil, nil)
-	log.Printf("Generated HTML (length: %d)", len(html))
-
-	// Wrap the HTML in a div for proper rendering
-	wrappedHTML := fmt.Sprintf(`<div class="markdown-body">%s</div>`, html)
+	// Convert markdown to HTML, tagging each block with its source line
+	var wrappedHTML string
+	err := renderPool.do(r.Context(), func(ctx context.Context) (err error) {
+		wrappedHTML, err = renderPreviewHTML(ctx, content)
+		return err
+	})
+	if err != nil {
+		if r.Context().Err() != nil {
+			return
+		}
+		status, message := renderStatus(err)
+		log.Printf("Render failed (length: %d): %v", len(content), err)
+		if status == http.StatusServiceUnavailable {
+			w.Header().Set("Retry-After", "1")
+		}
+		http.Error(w, message, status)
+		return
+	}
 
 	w.Header().Set("Content-Type", "text/html")
 	w.Write([]byte(wrappedHTML))
@@ -173,11 +310,17 @@ func handleMarkdownConvert(w http.ResponseWriter, r *http.Request) {
 }
 
 func handlePreview(w http.ResponseWriter, r *http.Request) {
+	// Anything below / is a file linked relative to the document.
+	if r.URL.Path != "/" {
+		serveDocumentAsset(w, r)
+		return
+	}
+
 	const htmlStart = `<!DOCTYPE html>
 <html>
 <head>
 	<title>Markdown Preview</title>
-	<link rel="stylesheet" href="/static/styles.css">
+	<link rel="stylesheet" href="static/styles.css">
 	<link rel="stylesheet" href="https://cdnjs.cloudflare.com/ajax/libs/prism/1.24.1/themes/prism-tomorrow.min.css">
 	<link rel="stylesheet" href="https://cdn.jsdelivr.net/npm/bootstrap-icons@1.7.2/font/bootstrap-icons.css">
 	<script src="https://cdnjs.cloudflare.com/ajax/libs/prism/1.24.1/prism.min.js"></script>
@@ -190,51 +333,132 @@ func handlePreview(w http.ResponseWriter, r *http.Request) {
 		let isOnline = true;
 		let searchVisible = false;
 		let guideVisible = false;
+		let pendingScrollLine = 0;
+		let problemCount = 0;
+		let participantCount = 0;
+		let socket = null;
+		let socketReady = false;
+		let previewStale = true;
+		let updateSeq = 0;
+		let pendingMarkdown = '';
+
+		// The server sets the CSRF cookie on every response; requests that
+		// change anything echo it in a header.
+		function csrfToken() {
+			const match = document.cookie.match(/(?:^|; )mdp_csrf=([^;]*)/);
+			return match ? match[1] : '';
+		}
 
+		// Render the editor into the preview. While the WebSocket is up the
+		// server answers with a patch touching only the blocks that changed;
+		// otherwise the whole document goes through /convert.
 		function updatePreview() {
 			const markdown = document.getElementById('editor').value;
+			collabSync();
+			if (socket && socketReady) {
+				socket.send(JSON.stringify({
+					v: 1,
+					type: 'update',
+					id: String(++updateSeq),
+					payload: { markdown: markdown, reset: previewStale }
+				}));
+				previewStale = false;
+				pendingMarkdown = markdown;
+				return;
+			}
+
 			const preview = document.getElementById('preview');
 			const formData = new FormData();
 			formData.append('markdown', markdown);
-			
-			preview.innerHTML = '<div class="loading">Converting...</div>';
-			
-			// Add a small delay for better UX
-			setTimeout(() => {
-				fetch('/convert', {
-					method: 'POST',
-					body: formData
-				})
-				.then(response => {
-					if (!response.ok) {
-						throw new Error('Network response was not ok');
-					}
-					return response.text();
-				})
-				.then(html => {
-					// Fade out current content
-					preview.style.opacity = '0';
-					setTimeout(() => {
-						preview.innerHTML = html;
-						preview.style.opacity = '1';
-						document.querySelectorAll('pre code').forEach((block) => {
-							Prism.highlightElement(block);
-						});
-						updateStatus('success', 'Preview updated');
-						updateWordCount();
-						
-						if (markdown !== lastSavedContent) {
-							saveToLocalStorage(markdown);
-							lastSavedContent = markdown;
-						}
-					}, 150);
-				})
-				.catch(error => {
-					preview.innerHTML = '<div class="error">Failed to update preview</div>';
-					updateStatus('error', 'Failed to update preview: ' + error.message);
-					console.error('Preview error:', error);
+			fetch(basePath + '/convert', {
+				method: 'POST',
+				headers: { 'X-CSRF-Token': csrfToken() },
+				body: formData
+			})
+			.then(response => {
+				if (!response.ok) {
+					throw new Error('Network response was not ok');
+				}
+				return response.text();
+			})
+			.then(html => {
+				preview.innerHTML = html;
+				preview.querySelectorAll('pre code').forEach((block) => {
+					Prism.highlightElement(block);
 				});
-			}, 150);
+				previewStale = true;
+				finishRender(markdown);
+			})
+			.catch(error => {
+				preview.innerHTML = '<div class="error">Failed to update preview</div>';
+				updateStatus('error', 'Failed to update preview: ' + error.message);
+				console.error('Preview error:', error);
+			});
+		}
+
+		// Apply a block patch from the server. See PROTOCOL.md.
+		function applyPatch(patch) {
+			const preview = document.getElementById('preview');
+			let body = preview.querySelector('.markdown-body');
+			if (patch.reset || !body) {
+				preview.innerHTML = '<div class="markdown-body"></div>';
+				body = preview.firstChild;
+			}
+
+			const blocks = Array.from(body.children);
+			for (let i = 0; i < patch.delete; i++) {
+				blocks[patch.start + i].remove();
+			}
+			const template = document.createElement('template');
+			template.innerHTML = patch.insert.join('');
+			const inserted = Array.from(template.content.children);
+			body.insertBefore(template.content, blocks[patch.start + patch.delete] || null);
+
+			if (patch.shift) {
+				for (let i = patch.start + patch.delete; i < blocks.length; i++) {
+					blocks[i].dataset.line = parseInt(blocks[i].dataset.line, 10) + patch.shift;
+				}
+			}
+			inserted.forEach(block => {
+				block.querySelectorAll('pre code').forEach(code => Prism.highlightElement(code));
+			});
+			finishRender(pendingMarkdown);
+		}
+
+		function finishRender(markdown) {
+			updateStatus('success', 'Preview updated');
+			updateWordCount();
+			if (isFollowing()) {
+				scrollToPosition(presentation.current);
+			} else if (pendingScrollLine) {
+				scrollToSourceLine(pendingScrollLine);
+				pendingScrollLine = 0;
+			}
+			if (markdown !== lastSavedContent) {
+				saveToLocalStorage(markdown);
+				lastSavedContent = markdown;
+			}
+		}
+
+		// Scroll the preview to the block containing a one-based source line
+		// and move the editor caret there.
+		function scrollToSourceLine(line) {
+			let target = null;
+			document.querySelectorAll('#preview [data-line]').forEach(block => {
+				if (parseInt(block.dataset.line, 10) <= line) {
+					target = block;
+				}
+			});
+			// While following a presenter the preview stays with them.
+			if (target && !isFollowing()) {
+				target.scrollIntoView({ block: 'center' });
+			}
+
+			const editor = document.getElementById('editor');
+			const lines = editor.value.split('\n');
+			const offset = lines.slice(0, line - 1).join('\n').length + (line > 1 ? 1 : 0);
+			editor.selectionStart = editor.selectionEnd = Math.min(offset, editor.value.length);
+			editor.scrollTop = editor.scrollHeight * (line - 1) / Math.max(lines.length, 1);
 		}
 
 		function updateWordCount() {
@@ -242,8 +466,14 @@ func handlePreview(w http.ResponseWriter, r *http.Request) {
 			const words = text.trim().split(/\s+/).filter(word => word.length > 0).length;
 			const chars = text.length;
 			const lines = text.split('\n').length;
-			document.getElementById('word-count').textContent = 
-				words + ' words, ' + chars + ' characters, ' + lines + ' lines';
+			let summary = words + ' words, ' + chars + ' characters, ' + lines + ' lines';
+			if (problemCount) {
+				summary += ', ' + problemCount + (problemCount === 1 ? ' problem' : ' problems');
+			}
+			if (participantCount > 1) {
+				summary += ', ' + participantCount + ' connected';
+			}
+			document.getElementById('word-count').textContent = summary;
 		}
 
 		function insertMarkdown(type) {
@@ -302,6 +532,39 @@ func handlePreview(w http.ResponseWriter, r *http.Request) {
 			updatePreview();
 		}
 
+		function formatDocument() {
+			const editor = document.getElementById('editor');
+			const formData = new FormData();
+			formData.append('markdown', editor.value);
+
+			fetch(basePath + '/format', {
+				method: 'POST',
+				headers: { 'X-CSRF-Token': csrfToken() },
+				body: formData
+			})
+			.then(response => {
+				if (!response.ok) {
+					throw new Error('Network response was not ok');
+				}
+				return response.text();
+			})
+			.then(formatted => {
+				if (formatted === editor.value) {
+					updateStatus('success', 'Already formatted');
+					return;
+				}
+				const cursorPos = Math.min(editor.selectionStart, formatted.length);
+				editor.value = formatted;
+				editor.selectionStart = editor.selectionEnd = cursorPos;
+				editor.dispatchEvent(new Event('input'));
+				updateStatus('success', 'Document formatted');
+			})
+			.catch(error => {
+				updateStatus('error', 'Failed to format document');
+				console.error('Format error:', error);
+			});
+		}
+
 		function toggleSearch() {
 			searchVisible = !searchVisible;
 			const searchBar = document.getElementById('search-bar');
@@ -368,17 +631,523 @@ func handlePreview(w http.ResponseWriter, r *http.Request) {
 			}, 3000);
 		}
 
-		// Handle WebSocket connection
+		// Collaborative editing. The server and every tab keep a replica of
+		// the document as an RGA sequence CRDT, like crdt.go: every character
+		// has an ID made of the session that typed it and a Lamport clock,
+		// and deleted characters stay behind as tombstones. Edits name
+		// characters by ID, so every replica ends up with the same text
+		// whatever order they arrive in. See PROTOCOL.md.
+		const collab = {
+			joined: false,
+			loaded: false,
+			site: '',
+			clock: 0,
+			chars: [],
+			byId: new Map(),
+			pendingInserts: [],
+			pendingDeletes: new Set(),
+			// The editor text the replica last agreed with.
+			text: '',
+			selections: {},
+			selectionTimer: null
+		};
+
+		function idKey(id) {
+			return id.site + ':' + id.clock;
+		}
+
+		function idAfter(a, b) {
+			return a.clock > b.clock || (a.clock === b.clock && a.site > b.site);
+		}
+
+		function visibleText() {
+			return collab.chars.filter(c => !c.deleted).map(c => c.ch).join('');
+		}
+
+		// Place the characters of an insert, or return false if the
+		// character it follows has not arrived yet.
+		function integrateInsert(ins) {
+			let after = -1;
+			if (ins.after.site) {
+				const ref = collab.byId.get(idKey(ins.after));
+				if (!ref) {
+					return false;
+				}
+				after = collab.chars.indexOf(ref);
+			}
+			if (collab.byId.has(idKey(ins.id))) {
+				return true;
+			}
+			let clock = ins.id.clock;
+			for (const ch of Array.from(ins.text)) {
+				const id = { site: ins.id.site, clock: clock++ };
+				// Skip inserts at the same place that sort first, along with
+				// everything typed after them.
+				let i = after + 1;
+				while (i < collab.chars.length && idAfter(collab.chars[i].id, id)) {
+					i++;
+				}
+				const c = { id: id, ch: ch, deleted: collab.pendingDeletes.delete(idKey(id)) };
+				collab.chars.splice(i, 0, c);
+				collab.byId.set(idKey(id), c);
+				after = i;
+			}
+			collab.clock = Math.max(collab.clock, clock - 1);
+			return true;
+		}
+
+		function integrateEdit(edit) {
+			(edit.delete || []).forEach(span => {
+				for (let k = 0; k < span.len; k++) {
+					const key = idKey({ site: span.site, clock: span.clock + k });
+					const c = collab.byId.get(key);
+					if (c) {
+						c.deleted = true;
+					} else {
+						collab.pendingDeletes.add(key);
+					}
+				}
+				collab.clock = Math.max(collab.clock, span.clock + span.len - 1);
+			});
+			collab.pendingInserts.push(...(edit.insert || []));
+			let progress = true;
+			while (progress) {
+				progress = false;
+				collab.pendingInserts = collab.pendingInserts.filter(ins => {
+					if (integrateInsert(ins)) {
+						progress = true;
+						return false;
+					}
+					return true;
+				});
+			}
+		}
+
+		// The ID of the character just before an editor offset, counted in
+		// UTF-16 units like the textarea does.
+		function idAtOffset(offset) {
+			let id = { site: '', clock: 0 };
+			let pos = 0;
+			for (const c of collab.chars) {
+				if (c.deleted) {
+					continue;
+				}
+				if (pos + c.ch.length > offset) {
+					break;
+				}
+				pos += c.ch.length;
+				id = c.id;
+			}
+			return id;
+		}
+
+		function offsetOfId(id) {
+			if (!id.site) {
+				return 0;
+			}
+			const ref = collab.byId.get(idKey(id));
+			let pos = 0;
+			for (const c of collab.chars) {
+				if (!c.deleted) {
+					pos += c.ch.length;
+				}
+				if (c === ref) {
+					return pos;
+				}
+			}
+			return 0;
+		}
+
+		function loadSnapshot(snapshot) {
+			const editor = document.getElementById('editor');
+			const base = collab.text;
+			const rejoin = collab.loaded;
+			collab.chars = [];
+			collab.byId = new Map();
+			collab.pendingInserts = [];
+			collab.pendingDeletes = new Set();
+			collab.clock = 0;
+			snapshot.runs.forEach(run => {
+				let clock = run.id.clock;
+				for (const ch of Array.from(run.text)) {
+					const c = { id: { site: run.id.site, clock: clock++ }, ch: ch, deleted: !!run.deleted };
+					collab.chars.push(c);
+					collab.byId.set(idKey(c.id), c);
+				}
+				collab.clock = Math.max(collab.clock, clock - 1);
+			});
+			collab.text = visibleText();
+			collab.selections = {};
+			snapshot.selections.forEach(sel => {
+				collab.selections[sel.session] = sel;
+			});
+			collab.joined = true;
+			collab.loaded = true;
+
+			if (collab.text === '' || (rejoin && collab.text === base)) {
+				// This tab seeds an empty document, or sends what was typed
+				// while the connection was down.
+				collabSync();
+			} else if (editor.value !== collab.text) {
+				if (rejoin) {
+					updateStatus('info', 'The document changed while offline; showing the shared version');
+				}
+				editor.value = collab.text;
+				editor.dispatchEvent(new Event('input'));
+			}
+			renderRemoteSelections();
+		}
+
+		// Turn whatever changed in the editor since the replica last agreed
+		// with it into an edit, and send it.
+		function collabSync() {
+			const editor = document.getElementById('editor');
+			const oldText = collab.text;
+			const newText = editor.value;
+			if (!collab.joined || oldText === newText) {
+				return;
+			}
+			let start = 0;
+			while (start < oldText.length && start < newText.length && oldText[start] === newText[start]) {
+				start++;
+			}
+			let end = 0;
+			while (end < oldText.length - start && end < newText.length - start &&
+				oldText[oldText.length - 1 - end] === newText[newText.length - 1 - end]) {
+				end++;
+			}
+			// Never split a surrogate pair.
+			if (start > 0 && /[\uD800-\uDBFF]/.test(oldText[start - 1])) {
+				start--;
+			}
+			if (end > 0 && /[\uDC00-\uDFFF]/.test(oldText[oldText.length - end])) {
+				end--;
+			}
+
+			const visible = collab.chars.filter(c => !c.deleted);
+			const edit = { insert: [], delete: [] };
+			let i = 0;
+			for (let pos = 0; pos < start; i++) {
+				pos += visible[i].ch.length;
+			}
+			const after = i > 0 ? visible[i - 1].id : { site: '', clock: 0 };
+			for (let pos = start; pos < oldText.length - end; i++) {
+				const c = visible[i];
+				pos += c.ch.length;
+				c.deleted = true;
+				const last = edit.delete[edit.delete.length - 1];
+				if (last && last.site === c.id.site && last.clock + last.len === c.id.clock) {
+					last.len++;
+				} else {
+					edit.delete.push({ site: c.id.site, clock: c.id.clock, len: 1 });
+				}
+			}
+			const inserted = newText.substring(start, newText.length - end);
+			if (inserted) {
+				const ins = { id: { site: collab.site, clock: collab.clock + 1 }, after: after, text: inserted };
+				integrateInsert(ins);
+				edit.insert.push(ins);
+			}
+			collab.text = newText;
+			socket.send(JSON.stringify({ v: 1, type: 'edit', payload: edit }));
+		}
+
+		function applyRemoteEdit(edit) {
+			const editor = document.getElementById('editor');
+			// Send local changes first so the replica matches the editor.
+			collabSync();
+			const anchor = idAtOffset(editor.selectionStart);
+			const head = idAtOffset(editor.selectionEnd);
+			const scrollTop = editor.scrollTop;
+			integrateEdit(edit);
+			collab.text = visibleText();
+			if (editor.value !== collab.text) {
+				editor.value = collab.text;
+				editor.setSelectionRange(offsetOfId(anchor), offsetOfId(head));
+				editor.scrollTop = scrollTop;
+				editor.dispatchEvent(new Event('input'));
+			}
+			renderRemoteSelections();
+		}
+
+		// Tell the others where the caret is, at most every 50ms.
+		function scheduleSelection() {
+			if (!collab.joined || collab.selectionTimer) {
+				return;
+			}
+			collab.selectionTimer = setTimeout(() => {
+				collab.selectionTimer = null;
+				if (!collab.joined) {
+					return;
+				}
+				const editor = document.getElementById('editor');
+				collabSync();
+				socket.send(JSON.stringify({
+					v: 1,
+					type: 'selection',
+					payload: { anchor: idAtOffset(editor.selectionStart), head: idAtOffset(editor.selectionEnd) }
+				}));
+			}, 50);
+		}
+
+		function escapeHTML(text) {
+			return text.replace(/[&<>"']/g, c => ({ '&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;', "'": '&#39;' })[c]);
+		}
+
+		function sessionColor(session, alpha) {
+			const hue = parseInt(session.substring(0, 6), 16) % 360 || 0;
+			return 'hsla(' + hue + ', 70%, 45%, ' + alpha + ')';
+		}
+
+		// Draw the other editors' carets and selections in a layer over the
+		// textarea that wraps text the same way.
+		function renderRemoteSelections() {
+			const editor = document.getElementById('editor');
+			let layer = document.getElementById('remote-cursors');
+			const sessions = Object.keys(collab.selections);
+			if (!layer) {
+				if (sessions.length === 0) {
+					return;
+				}
+				layer = document.createElement('div');
+				layer.id = 'remote-cursors';
+				layer.className = 'remote-cursors';
+				layer.appendChild(document.createElement('div'));
+				editor.parentNode.appendChild(layer);
+			}
+			const style = getComputedStyle(editor);
+			['paddingTop', 'paddingRight', 'paddingBottom', 'paddingLeft', 'fontFamily', 'fontSize',
+				'lineHeight', 'letterSpacing', 'tabSize'].forEach(prop => {
+				layer.style[prop] = style[prop];
+			});
+			layer.style.left = editor.offsetLeft + 'px';
+			layer.style.top = editor.offsetTop + 'px';
+			layer.style.width = editor.clientWidth + 'px';
+			layer.style.height = editor.clientHeight + 'px';
+
+			const text = editor.value;
+			const marks = sessions.map(session => {
+				const sel = collab.selections[session];
+				const anchor = offsetOfId(sel.anchor);
+				const head = offsetOfId(sel.head);
+				return { session: session, name: sel.name, start: Math.min(anchor, head), end: Math.max(anchor, head), caret: head };
+			});
+			const points = new Set([0, text.length]);
+			marks.forEach(m => {
+				points.add(m.start);
+				points.add(m.end);
+			});
+			const sorted = Array.from(points).sort((a, b) => a - b);
+			let html = '';
+			sorted.forEach((pos, k) => {
+				marks.filter(m => m.caret === pos).forEach(m => {
+					const name = m.name || 'Guest ' + m.session.substring(0, 4);
+					html += '<span class="remote-caret" style="border-color: ' + sessionColor(m.session, 1) + '">' +
+						'<span class="remote-name" style="background: ' + sessionColor(m.session, 1) + '">' +
+						escapeHTML(name) + '</span></span>';
+				});
+				if (k === sorted.length - 1) {
+					return;
+				}
+				const segment = escapeHTML(text.substring(pos, sorted[k + 1]));
+				const cover = marks.find(m => m.start <= pos && sorted[k + 1] <= m.end && m.start !== m.end);
+				html += cover ? '<span style="background: ' + sessionColor(cover.session, 0.25) + '">' + segment + '</span>' : segment;
+			});
+			// A trailing newline only takes up a line in the textarea.
+			layer.firstChild.innerHTML = html + '\u200b';
+			layer.firstChild.style.transform = 'translateY(' + (-editor.scrollTop) + 'px)';
+		}
+
+		function setName() {
+			const name = prompt('Your name, shown to others editing this document:', localStorage.getItem('markdown-preview-name') || '');
+			if (name === null) {
+				return;
+			}
+			localStorage.setItem('markdown-preview-name', name.trim());
+			// The name is sent in the handshake, so reconnect.
+			if (socket) {
+				socket.onclose = null;
+				socket.close();
+			}
+			socketReady = false;
+			collab.joined = false;
+			connectWebSocket();
+		}
+
+		// Presenter mode. The presenter's tab sends where its preview is
+		// scrolled to, as the source line of the block at the top and how
+		// far through it, so followers land on the same content whatever
+		// their window size. Followers break away by scrolling themselves
+		// and can rejoin from the bar at the top of the preview.
+		const presentation = {
+			presenting: false,
+			current: null,
+			following: true,
+			timer: null
+		};
+
+		function previewPosition() {
+			const pane = document.querySelector('.preview-pane');
+			const top = pane.getBoundingClientRect().top;
+			const position = { line: 0, offset: 0, heading: '' };
+			document.querySelectorAll('#preview [data-line]').forEach(block => {
+				const rect = block.getBoundingClientRect();
+				if (rect.top <= top + 1 || !position.line) {
+					position.line = parseInt(block.dataset.line, 10);
+					position.offset = rect.height ? Math.min(Math.max((top - rect.top) / rect.height, 0), 1) : 0;
+				}
+			});
+			// The heading of the section filling the top third of the pane.
+			document.querySelectorAll('#preview h1, #preview h2, #preview h3, #preview h4, #preview h5, #preview h6').forEach(heading => {
+				if (heading.getBoundingClientRect().top <= top + pane.clientHeight / 3) {
+					position.heading = heading.textContent.trim();
+				}
+			});
+			return position;
+		}
+
+		function scrollToPosition(position) {
+			const pane = document.querySelector('.preview-pane');
+			let target = null;
+			document.querySelectorAll('#preview [data-line]').forEach(block => {
+				if (parseInt(block.dataset.line, 10) <= position.line) {
+					target = block;
+				}
+			});
+			if (!target) {
+				return;
+			}
+			const rect = target.getBoundingClientRect();
+			pane.scrollTop += rect.top - pane.getBoundingClientRect().top + rect.height * (position.offset || 0);
+		}
+
+		function isFollowing() {
+			return !!presentation.current && presentation.following;
+		}
+
+		function sendPresentation(active) {
+			if (!socketReady) {
+				return;
+			}
+			socket.send(JSON.stringify({
+				v: 1,
+				type: 'present',
+				payload: Object.assign({ active: active }, active ? previewPosition() : {})
+			}));
+		}
+
+		function togglePresenting() {
+			presentation.presenting = !presentation.presenting;
+			if (presentation.presenting) {
+				presentation.current = null;
+			}
+			sendPresentation(presentation.presenting);
+			renderPresentationBar();
+		}
+
+		function schedulePresentation() {
+			if (!presentation.presenting || presentation.timer) {
+				return;
+			}
+			presentation.timer = setTimeout(() => {
+				presentation.timer = null;
+				if (presentation.presenting) {
+					sendPresentation(true);
+					renderPresentationBar();
+				}
+			}, 100);
+		}
+
+		function applyPresentation(payload) {
+			if (!payload.active) {
+				if (presentation.current && presentation.current.session === payload.session) {
+					presentation.current = null;
+					presentation.following = true;
+				}
+			} else {
+				if (presentation.presenting) {
+					presentation.presenting = false;
+					updateStatus('info', (payload.name || 'Someone') + ' took over presenting');
+				}
+				presentation.current = payload;
+				if (presentation.following) {
+					scrollToPosition(payload);
+				}
+			}
+			renderPresentationBar();
+		}
+
+		function breakAway() {
+			if (isFollowing()) {
+				presentation.following = false;
+				renderPresentationBar();
+			}
+		}
+
+		function rejoinPresentation() {
+			presentation.following = true;
+			if (presentation.current) {
+				scrollToPosition(presentation.current);
+			}
+			renderPresentationBar();
+		}
+
+		function renderPresentationBar() {
+			document.getElementById('present-button').classList.toggle('presenting', presentation.presenting);
+			let bar = document.getElementById('presentation-bar');
+			if (!presentation.presenting && !presentation.current) {
+				if (bar) {
+					bar.remove();
+				}
+				return;
+			}
+			if (!bar) {
+				bar = document.createElement('div');
+				bar.id = 'presentation-bar';
+				bar.className = 'presentation-bar';
+				document.body.appendChild(bar);
+			}
+			let text, button;
+			if (presentation.presenting) {
+				text = 'Presenting';
+				button = '<button onclick="togglePresenting()">Stop</button>';
+			} else {
+				const name = escapeHTML(presentation.current.name || 'Someone');
+				text = presentation.following ? 'Following ' + name : name + ' is presenting';
+				button = presentation.following ?
+					'<button onclick="breakAway()">Break away</button>' :
+					'<button onclick="rejoinPresentation()">Rejoin</button>';
+			}
+			const heading = presentation.presenting ? previewPosition().heading : presentation.current.heading;
+			bar.innerHTML = '<i class="bi bi-broadcast"></i><span>' + text +
+				(heading ? ': <strong>' + escapeHTML(heading) + '</strong>' : '') + '</span>' + button;
+		}
+
+		// Handle WebSocket connection. Every frame is a JSON envelope
+		// {v, type, id, payload}; see PROTOCOL.md.
 		function connectWebSocket() {
-			const ws = new WebSocket('ws://' + window.location.host + '/ws');
+			const scheme = window.location.protocol === 'https:' ? 'wss://' : 'ws://';
+			const ws = new WebSocket(scheme + window.location.host + basePath + '/ws');
+			socket = ws;
 			
 			ws.onopen = () => {
-				isOnline = true;
-				updateStatus('success', 'Connected');
+				ws.send(JSON.stringify({
+					v: 1,
+					type: 'hello',
+					payload: {
+						versions: [1],
+						client: 'browser',
+						name: localStorage.getItem('markdown-preview-name') || ''
+					}
+				}));
 			};
 
 			ws.onclose = () => {
 				isOnline = false;
+				socketReady = false;
+				collab.joined = false;
+				presentation.current = null;
+				renderPresentationBar();
 				updateStatus('error', 'Disconnected');
 				// Try to reconnect after 5 seconds
 				setTimeout(connectWebSocket, 5000);
@@ -390,8 +1159,82 @@ func handlePreview(w http.ResponseWriter, r *http.Request) {
 			};
 
 			ws.onmessage = (event) => {
-				if (event.data === 'reload') {
-					updatePreview();
+				const msg = JSON.parse(event.data);
+				const payload = msg.payload || {};
+				switch (msg.type) {
+					case 'welcome':
+						isOnline = true;
+						socketReady = true;
+						previewStale = true;
+						collab.site = payload.session;
+						updateStatus('success', 'Connected');
+						updatePreview();
+						ws.send(JSON.stringify({ v: 1, type: 'join', id: 'join' }));
+						if (presentation.presenting) {
+							sendPresentation(true);
+						}
+						break;
+					case 'snapshot':
+						loadSnapshot(payload);
+						break;
+					case 'edit':
+						applyRemoteEdit(payload);
+						break;
+					case 'selection':
+						collab.selections[payload.session] = payload;
+						renderRemoteSelections();
+						break;
+					case 'presentation':
+						applyPresentation(payload);
+						break;
+					case 'patch':
+						applyPatch(payload);
+						break;
+					case 'content-changed': {
+						const editor = document.getElementById('editor');
+						if (collab.joined) {
+							// The server merged the text into the shared
+							// document and sent it as an edit.
+							if (payload.line) {
+								scrollToSourceLine(payload.line);
+							}
+						} else if (editor.value !== payload.text) {
+							pendingScrollLine = payload.line || 0;
+							editor.value = payload.text;
+							editor.dispatchEvent(new Event('input'));
+						} else if (payload.line) {
+							scrollToSourceLine(payload.line);
+						}
+						break;
+					}
+					case 'cursor':
+						scrollToSourceLine(payload.line);
+						break;
+					case 'diagnostics':
+						problemCount = payload.diagnostics.length;
+						updateWordCount();
+						break;
+					case 'focus':
+						window.focus();
+						updateStatus('info', 'Opened ' + payload.path);
+						break;
+					case 'presence':
+						participantCount = payload.participants.length;
+						Object.keys(collab.selections).forEach(session => {
+							if (!payload.participants.some(p => p.session === session)) {
+								delete collab.selections[session];
+							}
+						});
+						renderRemoteSelections();
+						updateWordCount();
+						if (document.getElementById('share-panel')) {
+							loadShares();
+						}
+						break;
+					case 'error':
+						updateStatus('error', payload.message);
+						console.error('Protocol error:', payload.code, payload.message);
+						break;
 				}
 			};
 		}
@@ -413,14 +1256,33 @@ func handlePreview(w http.ResponseWriter, r *http.Request) {
 		}
 
 		function handleImageUpload(file) {
+			uploadFile(basePath + '/upload', 'image', file);
+		}
+
+		function handleAttachment(file) {
+			uploadFile(basePath + '/attach', 'file', file);
+		}
+
+		// Post a file and insert the Markdown the server answers with at
+		// the cursor.
+		function uploadFile(url, field, file) {
 			const formData = new FormData();
-			formData.append('image', file);
+			formData.append(field, file);
+			updateStatus('info', 'Uploading ' + (file.name || 'file') + '...');
 
-			fetch('/upload', {
+			fetch(url, {
 				method: 'POST',
+				headers: { 'X-CSRF-Token': csrfToken() },
 				body: formData
 			})
-			.then(response => response.json())
+			.then(response => {
+				if (!response.ok) {
+					return response.text().then(text => {
+						throw new Error(text.trim() || response.statusText);
+					});
+				}
+				return response.json();
+			})
 			.then(data => {
 				const editor = document.getElementById('editor');
 				const cursorPos = editor.selectionStart;
@@ -434,7 +1296,7 @@ func handlePreview(w http.ResponseWriter, r *http.Request) {
 				updatePreview();
 			})
 			.catch(error => {
-				updateStatus('error', 'Failed to upload image');
+				updateStatus('error', 'Failed to upload ' + (file.name || 'file') + ': ' + error.message);
 				console.error('Upload error:', error);
 			});
 		}
@@ -443,12 +1305,17 @@ func handlePreview(w http.ResponseWriter, r *http.Request) {
 			const items = (e.clipboardData || e.originalEvent.clipboardData).items;
 			
 			for (const item of items) {
+				if (item.kind !== 'file') {
+					continue;
+				}
+				e.preventDefault();
+				const file = item.getAsFile();
 				if (item.type.indexOf('image') === 0) {
-					e.preventDefault();
-					const file = item.getAsFile();
 					handleImageUpload(file);
-					return;
+				} else {
+					handleAttachment(file);
 				}
+				return;
 			}
 		}
 
@@ -460,7 +1327,8 @@ func handlePreview(w http.ResponseWriter, r *http.Request) {
 			for (const file of files) {
 				if (file.type.indexOf('image') === 0) {
 					handleImageUpload(file);
-					return;
+				} else {
+					handleAttachment(file);
 				}
 			}
 		}
@@ -475,7 +1343,7 @@ func handlePreview(w http.ResponseWriter, r *http.Request) {
 			if (!guide) {
 				const guideFrame = document.createElement('iframe');
 				guideFrame.id = 'guide';
-				guideFrame.src = '/guide';
+				guideFrame.src = basePath + '/guide';
 				guideFrame.className = 'guide-pane';
 				document.body.appendChild(guideFrame);
 				document.body.classList.add('guide-open');
@@ -487,6 +1355,338 @@ func handlePreview(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
+		function toggleAssets() {
+			const panel = document.getElementById('assets-panel');
+			if (panel) {
+				panel.remove();
+				document.body.classList.remove('assets-open');
+				return;
+			}
+			const share = document.getElementById('share-panel');
+			if (share) {
+				share.remove();
+			}
+			const pane = document.createElement('div');
+			pane.id = 'assets-panel';
+			pane.className = 'assets-pane';
+			pane.innerHTML = '<div class="assets-header"><h2>Assets</h2>' +
+				'<button onclick="toggleAssets()" title="Close"><i class="bi bi-x-lg"></i></button></div>' +
+				'<div id="assets-list" class="assets-list"><div class="loading">Loading assets...</div></div>';
+			document.body.appendChild(pane);
+			document.body.classList.add('assets-open');
+			loadAssets();
+		}
+
+		function loadAssets() {
+			fetch(basePath + '/api/assets')
+			.then(response => {
+				if (!response.ok) {
+					throw new Error('Network response was not ok');
+				}
+				return response.json();
+			})
+			.then(renderAssets)
+			.catch(error => {
+				updateStatus('error', 'Failed to load assets: ' + error.message);
+			});
+		}
+
+		function renderAssets(assets) {
+			const list = document.getElementById('assets-list');
+			if (!list) {
+				return;
+			}
+			list.innerHTML = '';
+			if (assets.length === 0) {
+				list.innerHTML = '<div class="assets-empty">No uploaded assets yet</div>';
+				return;
+			}
+			assets.forEach(asset => {
+				const item = document.createElement('div');
+				item.className = 'asset-item' + (asset.references.length ? '' : ' unused');
+
+				if (asset.width) {
+					const thumb = document.createElement('img');
+					thumb.src = asset.thumbnail || asset.url;
+					thumb.loading = 'lazy';
+					thumb.alt = asset.name;
+					item.appendChild(thumb);
+				} else {
+					const icon = document.createElement('i');
+					icon.className = 'bi bi-file-earmark asset-icon';
+					item.appendChild(icon);
+				}
+
+				const info = document.createElement('div');
+				info.className = 'asset-info';
+				const name = document.createElement('div');
+				name.className = 'asset-name';
+				name.textContent = asset.name;
+				name.title = asset.original || asset.name;
+				const meta = document.createElement('div');
+				meta.className = 'asset-meta';
+				let details = formatBytes(asset.size);
+				if (asset.width) {
+					details += ', ' + asset.width + '\u00d7' + asset.height;
+				}
+				const refs = asset.references.length;
+				details += ', ' + (refs ? refs + (refs === 1 ? ' link' : ' links') : 'unused');
+				meta.textContent = details;
+				meta.title = asset.references.map(ref => ref.doc + ':' + ref.line).join('\n');
+				info.appendChild(name);
+				info.appendChild(meta);
+				item.appendChild(info);
+
+				const actions = document.createElement('div');
+				actions.className = 'asset-actions';
+				[
+					['bi-box-arrow-in-left', 'Insert', () => insertAsset(asset)],
+					['bi-pencil', 'Rename', () => renameAsset(asset)],
+					['bi-trash', 'Delete', () => deleteAsset(asset)]
+				].forEach(([icon, title, action]) => {
+					const button = document.createElement('button');
+					button.title = title;
+					button.innerHTML = '<i class="bi ' + icon + '"></i>';
+					button.onclick = action;
+					actions.appendChild(button);
+				});
+				item.appendChild(actions);
+				list.appendChild(item);
+			});
+		}
+
+		function formatBytes(n) {
+			if (n < 1024) {
+				return n + ' B';
+			}
+			if (n < 1024 * 1024) {
+				return (n / 1024).toFixed(1) + ' KB';
+			}
+			return (n / 1024 / 1024).toFixed(1) + ' MB';
+		}
+
+		function insertAsset(asset) {
+			// Uploads are linked without the base path, which the preview
+			// adds back; assets beside the document are linked relative to it.
+			const url = asset.url.startsWith(basePath + '/uploads/') ? asset.url.substring(basePath.length) : asset.url.substring(basePath.length + 1);
+			const alt = asset.name.replace(/\.[^.]*$/, '').replace(/[-_]+/g, ' ');
+			const editor = document.getElementById('editor');
+			const start = editor.selectionStart;
+			const markdown = (asset.width ? '![' + alt + ']' : '[' + asset.name + ']') + '(' + url + ')';
+			editor.value = editor.value.substring(0, start) + markdown + editor.value.substring(editor.selectionEnd);
+			editor.selectionStart = editor.selectionEnd = start + markdown.length;
+			editor.focus();
+			editor.dispatchEvent(new Event('input'));
+		}
+
+		function renameAsset(asset) {
+			const name = prompt('Rename ' + asset.name + ' to:', asset.name);
+			if (!name || name === asset.name) {
+				return;
+			}
+			fetch(basePath + '/api/assets/rename', {
+				method: 'POST',
+				headers: { 'Content-Type': 'application/json', 'X-CSRF-Token': csrfToken() },
+				body: JSON.stringify({ url: asset.url, name: name })
+			})
+			.then(response => {
+				if (!response.ok) {
+					return response.text().then(text => { throw new Error(text.trim()); });
+				}
+				updateStatus('success', 'Renamed to ' + name);
+				loadAssets();
+			})
+			.catch(error => updateStatus('error', 'Rename failed: ' + error.message));
+		}
+
+		function deleteAsset(asset, force) {
+			if (!force && !confirm('Delete ' + asset.name + '?')) {
+				return;
+			}
+			fetch(basePath + '/api/assets?url=' + encodeURIComponent(asset.url) + (force ? '&force=1' : ''), {
+				method: 'DELETE',
+				headers: { 'X-CSRF-Token': csrfToken() }
+			})
+			.then(response => {
+				if (response.status === 409) {
+					return response.text().then(text => {
+						if (confirm(text.trim() + '. Delete anyway?')) {
+							deleteAsset(asset, true);
+						}
+					});
+				}
+				if (!response.ok) {
+					return response.text().then(text => { throw new Error(text.trim()); });
+				}
+				updateStatus('success', 'Deleted ' + asset.name);
+				loadAssets();
+			})
+			.catch(error => updateStatus('error', 'Delete failed: ' + error.message));
+		}
+
+		// The share panel lists read-only links to this preview and the
+		// viewers connected through them.
+		function toggleShare() {
+			const panel = document.getElementById('share-panel');
+			if (panel) {
+				panel.remove();
+				document.body.classList.remove('assets-open');
+				return;
+			}
+			const assets = document.getElementById('assets-panel');
+			if (assets) {
+				assets.remove();
+			}
+			const pane = document.createElement('div');
+			pane.id = 'share-panel';
+			pane.className = 'assets-pane';
+			pane.innerHTML = '<div class="assets-header"><h2>Share</h2><div>' +
+				'<button onclick="createShare()" title="New read-only link"><i class="bi bi-plus-lg"></i></button>' +
+				'<button onclick="toggleShare()" title="Close"><i class="bi bi-x-lg"></i></button></div></div>' +
+				'<div id="share-list" class="assets-list"><div class="loading">Loading share links...</div></div>';
+			document.body.appendChild(pane);
+			document.body.classList.add('assets-open');
+			loadShares();
+		}
+
+		function loadShares() {
+			fetch(basePath + '/api/shares')
+			.then(response => {
+				if (!response.ok) {
+					throw new Error('Network response was not ok');
+				}
+				return response.json();
+			})
+			.then(renderShares)
+			.catch(error => {
+				updateStatus('error', 'Failed to load share links: ' + error.message);
+			});
+		}
+
+		function shareItem(icon, title, details, actions) {
+			const item = document.createElement('div');
+			item.className = 'asset-item';
+			const i = document.createElement('i');
+			i.className = 'bi ' + icon + ' asset-icon';
+			item.appendChild(i);
+
+			const info = document.createElement('div');
+			info.className = 'asset-info';
+			const name = document.createElement('div');
+			name.className = 'asset-name';
+			name.textContent = title;
+			const meta = document.createElement('div');
+			meta.className = 'asset-meta';
+			meta.textContent = details;
+			info.appendChild(name);
+			info.appendChild(meta);
+			item.appendChild(info);
+
+			const buttons = document.createElement('div');
+			buttons.className = 'asset-actions';
+			actions.forEach(([icon, title, action]) => {
+				const button = document.createElement('button');
+				button.title = title;
+				button.innerHTML = '<i class="bi ' + icon + '"></i>';
+				button.onclick = action;
+				buttons.appendChild(button);
+			});
+			item.appendChild(buttons);
+			return item;
+		}
+
+		function renderShares(data) {
+			const list = document.getElementById('share-list');
+			if (!list) {
+				return;
+			}
+			list.innerHTML = '';
+			const heading = (text) => {
+				const h = document.createElement('h3');
+				h.className = 'share-heading';
+				h.textContent = text;
+				list.appendChild(h);
+			};
+
+			heading('Read-only links');
+			if (data.links.length === 0) {
+				list.insertAdjacentHTML('beforeend', '<div class="assets-empty">No share links yet</div>');
+			}
+			const labels = {};
+			data.links.forEach(link => {
+				labels[link.id] = link.label || 'Untitled link';
+				const count = data.viewers.filter(v => v.share === link.id).length;
+				const details = (count === 1 ? '1 viewer' : count + ' viewers') +
+					', created ' + new Date(link.created).toLocaleTimeString();
+				list.appendChild(shareItem('bi-link-45deg', labels[link.id], details, [
+					['bi-clipboard', 'Copy link', () => copyShareLink(link)],
+					['bi-x-circle', 'Revoke', () => revokeShare(link)]
+				]));
+			});
+
+			heading('Viewers');
+			if (data.viewers.length === 0) {
+				list.insertAdjacentHTML('beforeend', '<div class="assets-empty">Nobody is watching</div>');
+			}
+			data.viewers.forEach(viewer => {
+				const details = (labels[viewer.share] || '') + ', ' + viewer.address +
+					', since ' + new Date(viewer.since).toLocaleTimeString();
+				list.appendChild(shareItem('bi-eye', viewer.name || 'Anonymous viewer', details, []));
+			});
+		}
+
+		function createShare() {
+			const label = prompt('Label for the new read-only link, such as who it is for:', '');
+			if (label === null) {
+				return;
+			}
+			fetch(basePath + '/api/shares', {
+				method: 'POST',
+				headers: { 'Content-Type': 'application/json', 'X-CSRF-Token': csrfToken() },
+				body: JSON.stringify({ label: label })
+			})
+			.then(response => {
+				if (!response.ok) {
+					return response.text().then(text => { throw new Error(text.trim()); });
+				}
+				return response.json();
+			})
+			.then(link => {
+				copyShareLink(link);
+				loadShares();
+			})
+			.catch(error => updateStatus('error', 'Failed to create share link: ' + error.message));
+		}
+
+		function copyShareLink(link) {
+			const url = window.location.origin + link.url;
+			if (!navigator.clipboard) {
+				prompt('Copy the read-only link:', url);
+				return;
+			}
+			navigator.clipboard.writeText(url)
+			.then(() => updateStatus('success', 'Share link copied'))
+			.catch(() => prompt('Copy the read-only link:', url));
+		}
+
+		function revokeShare(link) {
+			if (!confirm('Revoke ' + (link.label || 'this link') + '? Its viewers are disconnected.')) {
+				return;
+			}
+			fetch(basePath + '/api/shares?id=' + encodeURIComponent(link.id), {
+				method: 'DELETE',
+				headers: { 'X-CSRF-Token': csrfToken() }
+			})
+			.then(response => {
+				if (!response.ok) {
+					return response.text().then(text => { throw new Error(text.trim()); });
+				}
+				updateStatus('success', 'Share link revoked');
+				loadShares();
+			})
+			.catch(error => updateStatus('error', 'Revoke failed: ' + error.message));
+		}
+
 		// Initialize
 		document.addEventListener('DOMContentLoaded', function() {
 			const editor = document.getElementById('editor');
@@ -500,11 +1700,35 @@ func handlePreview(w http.ResponseWriter, r *http.Request) {
 				clearTimeout(timeout);
 				timeout = setTimeout(updatePreview, 150);
 				updateWordCount();
+				collabSync();
+				renderRemoteSelections();
+			});
+			['keyup', 'mouseup', 'select', 'focus'].forEach(type => {
+				editor.addEventListener(type, scheduleSelection);
+			});
+			window.addEventListener('resize', renderRemoteSelections);
+
+			// Scrolling the preview moves followers along, or breaks away
+			// from the presenter.
+			const previewPane = document.querySelector('.preview-pane');
+			previewPane.addEventListener('scroll', schedulePresentation);
+			['wheel', 'touchmove'].forEach(type => {
+				previewPane.addEventListener(type, breakAway, { passive: true });
+			});
+			document.addEventListener('keydown', function(e) {
+				const scrollsPreview = e.target === document.body || previewPane.contains(e.target);
+				if (scrollsPreview && ['ArrowUp', 'ArrowDown', 'PageUp', 'PageDown', 'Home', 'End', ' '].includes(e.key)) {
+					breakAway();
+				}
 			});
 
 			// Update line numbers on scroll
 			editor.addEventListener('scroll', function() {
 				document.getElementById('line-numbers').scrollTop = editor.scrollTop;
+				const layer = document.getElementById('remote-cursors');
+				if (layer) {
+					layer.firstChild.style.transform = 'translateY(' + (-editor.scrollTop) + 'px)';
+				}
 			});
 
 			// Initialize line numbers
@@ -668,10 +1892,16 @@ func handlePreview(w http.ResponseWriter, r *http.Request) {
 						<i class="bi bi-image"></i>
 					</button>
 					<input type="file" id="image-input" accept="image/*" style="display: none">
+					<button onclick="toggleAssets()" title="Assets"><i class="bi bi-images"></i></button>
+					<button onclick="toggleShare()" title="Share Read-Only"><i class="bi bi-share"></i></button>
+					<button onclick="formatDocument()" title="Format Document"><i class="bi bi-magic"></i></button>
 					<button onclick="toggleSearch()" title="Search"><i class="bi bi-search"></i></button>
 					<button onclick="toggleGuide()" title="Markdown Guide"><i class="bi bi-question-circle"></i></button>
 				</div>
 				<div class="toolbar-group">
+					<button onclick="setName()" title="Your Name"><i class="bi bi-person-circle"></i></button>
+					<button id="present-button" onclick="togglePresenting()" title="Present"><i class="bi bi-broadcast"></i></button>
+					<button onclick="window.open(basePath + '/slides', 'markdown-preview-slides')" title="Slides"><i class="bi bi-easel"></i></button>
 					<button onclick="toggleTheme()" title="Toggle Dark Mode">
 						<i class="bi bi-moon-stars"></i>
 					</button>
@@ -730,39 +1960,5 @@ func main() {
 </html>`
 
 	w.Header().Set("Content-Type", "text/html")
-	w.Write([]byte(htmlStart + jsCode + htmlEnd))
-}
-
-func handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-	defer conn.Close()
-
-	// Watch for file changes
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		log.Println(err)
-		return
-	}
-	defer watcher.Close()
-
-	err = watcher.Add(*markdownFile)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-
-	for {
-		select {
-		case event := <-watcher.Events:
-			if event.Op&fsnotify.Write == fsnotify.Write {
-				conn.WriteMessage(websocket.TextMessage, []byte("reload"))
-			}
-		case err := <-watcher.Errors:
-			log.Println("error:", err)
-		}
-	}
+	w.Write([]byte(htmlStart + basePathScript() + jsCode + htmlEnd))
 }
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"log"
+
+	"github.com/yourusername/markdown-preview/wsproto"
+)
+
+// present records where c is presenting and relays it to every other
+// client, whose previews follow along. A client that starts presenting
+// takes over from the current presenter; only the presenter can stop.
+func (h *wsHub) present(c *wsClient, p wsproto.Presentation) {
+	p.Session, p.Name = c.session, c.name
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !p.Active {
+		if h.presenter == c {
+			h.stopPresentingLocked()
+		}
+		return
+	}
+	if h.presenter != c {
+		log.Printf("Session %s started presenting", c.session)
+	}
+	h.presenter, h.presentation = c, p
+	h.broadcastPresentationLocked(c)
+}
+
+// stopPresentingLocked ends the presentation and tells everybody.
+func (h *wsHub) stopPresentingLocked() {
+	log.Printf("Session %s stopped presenting", h.presenter.session)
+	h.presentation = wsproto.Presentation{Session: h.presenter.session, Name: h.presenter.name}
+	h.presenter = nil
+	h.broadcastPresentationLocked(nil)
+}
+
+// broadcastPresentationLocked sends the presentation to every client
+// except the given one.
+func (h *wsHub) broadcastPresentationLocked(except *wsClient) {
+	msg, err := wsproto.Encode(wsproto.TypePresentation, "", h.presentation)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for c := range h.clients {
+		if c != except {
+			h.sendLocked(c, msg)
+		}
+	}
+}
+
+// sendPresentationLocked sends the presentation to one client.
+func (h *wsHub) sendPresentationLocked(c *wsClient) {
+	msg, err := wsproto.Encode(wsproto.TypePresentation, "", h.presentation)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	h.sendLocked(c, msg)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// csrfCookie hands the CSRF token to the page's scripts, which echo it
+	// in the csrfHeader of every state-changing request.
+	csrfCookie = "mdp_csrf"
+	csrfHeader = "X-CSRF-Token"
+	csrfField  = "csrf_token"
+)
+
+// contentSecurityPolicy allows the page's own inline scripts and the CDNs
+// it loads Prism and Bootstrap Icons from. Images may come from anywhere,
+// since documents link to them.
+const contentSecurityPolicy = "default-src 'self'; " +
+	"script-src 'self' 'unsafe-inline' https://cdnjs.cloudflare.com; " +
+	"style-src 'self' 'unsafe-inline' https://cdnjs.cloudflare.com https://cdn.jsdelivr.net; " +
+	"font-src 'self' https://cdn.jsdelivr.net; " +
+	"img-src * data: blob:; " +
+	"media-src 'self' blob:; " +
+	"connect-src 'self'; " +
+	"frame-src 'self'; " +
+	"frame-ancestors 'self'; " +
+	"object-src 'none'; " +
+	"base-uri 'self'; " +
+	"form-action 'self'"
+
+// csrfToken is generated once per server run.
+var csrfToken = newSessionID() + newSessionID()
+
+// checkHost enables DNS rebinding protection: while the server only
+// listens on loopback, the Host header must name a loopback address or
+// one of -trusted-hosts.
+var checkHost bool
+
+// trustedHosts holds the extra host names from -trusted-hosts.
+var trustedHosts = map[string]bool{}
+
+// setupSecurity reads -trusted-hosts and decides whether Host headers are
+// checked for the given listeners.
+func setupSecurity(listeners []net.Listener) {
+	for _, h := range strings.Split(*trustedHostsFlag, ",") {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			trustedHosts[h] = true
+		}
+	}
+	checkHost = true
+	for _, l := range listeners {
+		addr, ok := l.Addr().(*net.TCPAddr)
+		if !ok || !addr.IP.IsLoopback() {
+			// Behind a proxy or on the LAN the Host is whatever name
+			// clients use; authentication guards those setups.
+			checkHost = false
+		}
+	}
+}
+
+// protect adds security headers to every response and rejects requests
+// that another site could have triggered: unexpected Host headers,
+// cross-origin state changes and browser form posts without the CSRF
+// token.
+func protect(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := w.Header()
+		header.Set("Content-Security-Policy", contentSecurityPolicy)
+		header.Set("X-Content-Type-Options", "nosniff")
+		header.Set("X-Frame-Options", "SAMEORIGIN")
+		header.Set("Referrer-Policy", "same-origin")
+		if c, err := r.Cookie(csrfCookie); err != nil || c.Value != csrfToken {
+			http.SetCookie(w, &http.Cookie{
+				Name:     csrfCookie,
+				Value:    csrfToken,
+				Path:     basePath + "/",
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteStrictMode,
+			})
+		}
+
+		if checkHost && !allowedHost(r.Host) {
+			log.Printf("Rejected request for host %q", r.Host)
+			http.Error(w, "Unknown host", http.StatusMisdirectedRequest)
+			return
+		}
+		if !isSafeMethod(r.Method) {
+			if !sameOrigin(r) {
+				log.Printf("Rejected cross-origin %s %s", r.Method, r.URL.Path)
+				http.Error(w, "Cross-origin request rejected", http.StatusForbidden)
+				return
+			}
+			if fromBrowser(r) && isFormPost(r) && !validCSRF(r) {
+				log.Printf("Rejected %s %s without a CSRF token", r.Method, r.URL.Path)
+				http.Error(w, "Missing or invalid CSRF token; reload the page", http.StatusForbidden)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// allowedHost reports whether a Host header names this machine.
+func allowedHost(hostport string) bool {
+	host := hostport
+	if h, _, err := net.SplitHostPort(hostport); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") || trustedHosts[host] {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// sameOrigin reports whether r was sent by a page served from this
+// server, judging by Origin, then Referer, then Sec-Fetch-Site. Requests
+// carrying none of them come from tools such as curl or editor plugins,
+// not from a browser, and are allowed.
+func sameOrigin(r *http.Request) bool {
+	source := r.Header.Get("Origin")
+	if source == "null" {
+		// Sandboxed frames and file: pages.
+		return false
+	}
+	if source == "" {
+		source = r.Header.Get("Referer")
+	}
+	if source == "" {
+		return r.Header.Get("Sec-Fetch-Site") != "cross-site"
+	}
+	u, err := url.Parse(source)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return trustedHosts[strings.ToLower(u.Hostname())]
+}
+
+// checkWebSocketOrigin is the upgrader's CheckOrigin.
+func checkWebSocketOrigin(r *http.Request) bool {
+	if sameOrigin(r) {
+		return true
+	}
+	log.Printf("Rejected WebSocket from origin %q", r.Header.Get("Origin"))
+	return false
+}
+
+func fromBrowser(r *http.Request) bool {
+	return r.Header.Get("Origin") != "" || r.Header.Get("Sec-Fetch-Site") != ""
+}
+
+// isFormPost reports whether r has a body type an HTML form on another
+// site could send without a CORS preflight.
+func isFormPost(r *http.Request) bool {
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch ct {
+	case "application/x-www-form-urlencoded", "multipart/form-data", "text/plain":
+		return true
+	}
+	return false
+}
+
+// validCSRF checks the token in the csrfHeader. Plain HTML forms, which
+// cannot set headers, may send it in the csrfField query parameter.
+func validCSRF(r *http.Request) bool {
+	token := r.Header.Get(csrfHeader)
+	if token == "" {
+		token = r.URL.Query().Get(csrfField)
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(csrfToken)) == 1
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const evilOrigin = "https://evil.example"
+
+// newTestServer serves newHandler with one render worker and Host checks
+// on, and puts both settings back when the test ends.
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	oldPool, oldCheckHost := renderPool, checkHost
+	renderPool = newRenderLimiter(1, time.Second)
+	checkHost = true
+	srv := httptest.NewServer(newHandler())
+	t.Cleanup(func() {
+		srv.Close()
+		renderPool, checkHost = oldPool, oldCheckHost
+	})
+	return srv
+}
+
+func postForm(t *testing.T, srv *httptest.Server, path string, header http.Header) *http.Response {
+	t.Helper()
+	body := url.Values{"markdown": {"# Hi"}}.Encode()
+	req, err := http.NewRequest(http.MethodPost, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	srv := newTestServer(t)
+	resp, err := http.Get(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	for name, want := range map[string]string{
+		"X-Content-Type-Options": "nosniff",
+		"X-Frame-Options":        "SAMEORIGIN",
+		"Referrer-Policy":        "same-origin",
+	} {
+		if got := resp.Header.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if csp := resp.Header.Get("Content-Security-Policy"); !strings.Contains(csp, "frame-ancestors 'self'") || !strings.Contains(csp, "object-src 'none'") {
+		t.Errorf("Content-Security-Policy = %q", csp)
+	}
+	var csrf *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == csrfCookie {
+			csrf = c
+		}
+	}
+	if csrf == nil || csrf.Value != csrfToken {
+		t.Errorf("CSRF cookie not set: %v", resp.Cookies())
+	}
+}
+
+func TestCrossOriginRequestsRejected(t *testing.T) {
+	srv := newTestServer(t)
+	for _, path := range []string{"/convert", "/format", "/upload", "/attach", "/buffer", "/api/assets/rename", "/api/open"} {
+		resp := postForm(t, srv, path, http.Header{
+			"Origin":       {evilOrigin},
+			"X-Csrf-Token": {csrfToken},
+		})
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("POST %s from %s: status %d, want 403", path, evilOrigin, resp.StatusCode)
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, srv.URL+"/api/assets?url=/uploads/x.png", nil)
+	req.Header.Set("Origin", evilOrigin)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("cross-origin DELETE: status %d, want 403", resp.StatusCode)
+	}
+}
+
+func TestCrossSiteWithoutOriginRejected(t *testing.T) {
+	srv := newTestServer(t)
+	for name, header := range map[string]http.Header{
+		"referer":        {"Referer": {evilOrigin + "/page"}},
+		"sec-fetch-site": {"Sec-Fetch-Site": {"cross-site"}},
+		"null origin":    {"Origin": {"null"}},
+	} {
+		resp := postForm(t, srv, "/convert", header)
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: status %d, want 403", name, resp.StatusCode)
+		}
+	}
+}
+
+func TestFormPostNeedsCSRFToken(t *testing.T) {
+	srv := newTestServer(t)
+	tests := []struct {
+		name   string
+		path   string
+		header http.Header
+		want   int
+	}{
+		{"no token", "/convert", http.Header{"Origin": {srv.URL}}, http.StatusForbidden},
+		{"wrong token", "/convert", http.Header{"Origin": {srv.URL}, "X-Csrf-Token": {"guess"}}, http.StatusForbidden},
+		{"same-site fetch without token", "/convert", http.Header{"Sec-Fetch-Site": {"same-origin"}}, http.StatusForbidden},
+		{"header token", "/convert", http.Header{"Origin": {srv.URL}, "X-Csrf-Token": {csrfToken}}, http.StatusOK},
+		{"query token", "/convert?" + csrfField + "=" + csrfToken, http.Header{"Origin": {srv.URL}}, http.StatusOK},
+		{"tool without browser headers", "/convert", nil, http.StatusOK},
+	}
+	for _, tt := range tests {
+		resp := postForm(t, srv, tt.path, tt.header)
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, resp.StatusCode, tt.want)
+		}
+	}
+}
+
+func TestTrustedHostOrigin(t *testing.T) {
+	srv := newTestServer(t)
+	trustedHosts["preview.test"] = true
+	defer delete(trustedHosts, "preview.test")
+
+	resp := postForm(t, srv, "/convert", http.Header{"Origin": {"https://preview.test"}, "X-Csrf-Token": {csrfToken}})
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("trusted origin: status %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestUnknownHostRejected(t *testing.T) {
+	srv := newTestServer(t)
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/", nil)
+	// A DNS rebinding attack reaches the loopback server under the
+	// attacker's host name.
+	req.Host = "evil.example"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMisdirectedRequest {
+		t.Errorf("status %d, want 421", resp.StatusCode)
+	}
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	srv := newTestServer(t)
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	for _, path := range []string{"/ws", "/ws/editor"} {
+		_, resp, err := websocket.DefaultDialer.Dial(wsURL+path, http.Header{"Origin": {evilOrigin}})
+		if err == nil {
+			t.Errorf("%s: cross-origin WebSocket was accepted", path)
+			continue
+		}
+		if resp == nil || resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: cross-origin WebSocket: %v", path, err)
+		}
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws", http.Header{"Origin": {srv.URL}})
+	if err != nil {
+		t.Fatalf("same-origin WebSocket rejected: %v", err)
+	}
+	conn.Close()
+}
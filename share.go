@@ -0,0 +1,507 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/yourusername/markdown-preview/wsproto"
+)
+
+// shareCookie lets a viewer page load uploaded images, which the document
+// links by absolute /uploads/ URLs outside the share link's path.
+const shareCookie = "mdp_share"
+
+// closeLinkRevoked is the WebSocket close code sent to viewers whose share
+// link was revoked.
+const closeLinkRevoked = 4403
+
+// shareLink is a read-only link to the live preview. Its token opens the
+// viewer page, the viewer WebSocket and the files the document shows, and
+// nothing else: no editor, uploads or API.
+type shareLink struct {
+	ID      string    `json:"id"`
+	Label   string    `json:"label"`
+	URL     string    `json:"url"`
+	Created time.Time `json:"created"`
+	token   string
+}
+
+// shareStore holds the share links created since the server started.
+type shareStore struct {
+	mu    sync.Mutex
+	links map[string]*shareLink // by token
+}
+
+var shares = &shareStore{links: make(map[string]*shareLink)}
+
+func (s *shareStore) create(label string) *shareLink {
+	token := newSessionID() + newSessionID()
+	link := &shareLink{
+		ID:      newSessionID(),
+		Label:   label,
+		URL:     basePath + "/s/" + token + "/",
+		Created: time.Now(),
+		token:   token,
+	}
+	s.mu.Lock()
+	s.links[token] = link
+	s.mu.Unlock()
+	return link
+}
+
+// lookup returns the link for token, or nil if there is none or it was
+// revoked.
+func (s *shareStore) lookup(token string) *shareLink {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.links[token]
+}
+
+// revoke removes the link with the given ID and returns it, or nil if
+// there is no such link.
+func (s *shareStore) revoke(id string) *shareLink {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for token, link := range s.links {
+		if link.ID == id {
+			delete(s.links, token)
+			return link
+		}
+	}
+	return nil
+}
+
+// list returns the links, oldest first.
+func (s *shareStore) list() []*shareLink {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := []*shareLink{}
+	for _, link := range s.links {
+		out = append(out, link)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Created.Before(out[j].Created)
+	})
+	return out
+}
+
+// shareViewer describes a browser connected through a share link.
+type shareViewer struct {
+	Session string    `json:"session"`
+	Name    string    `json:"name,omitempty"`
+	Share   string    `json:"share"`
+	Address string    `json:"address"`
+	Since   time.Time `json:"since"`
+}
+
+// viewers lists the clients connected through share links, longest
+// connected first.
+func (h *wsHub) viewers() []shareViewer {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := []shareViewer{}
+	for c := range h.clients {
+		if c.share != nil {
+			out = append(out, shareViewer{Session: c.session, Name: c.name, Share: c.share.ID, Address: c.addr, Since: c.joined})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Since.Before(out[j].Since)
+	})
+	return out
+}
+
+// disconnectShare closes the connections of every viewer that joined
+// through link and tells the others they left.
+func (h *wsHub) disconnectShare(link *shareLink) {
+	revoked := websocket.FormatCloseMessage(closeLinkRevoked, "share link revoked")
+	h.mu.Lock()
+	for c := range h.clients {
+		if c.share == link {
+			c.conn.WriteControl(websocket.CloseMessage, revoked, time.Now().Add(time.Second))
+			c.conn.Close()
+			delete(h.clients, c)
+			close(c.send)
+		}
+	}
+	h.mu.Unlock()
+	h.broadcastEvent(wsproto.TypePresence, h.presence())
+}
+
+// currentDocument is what a viewer sees on joining: the buffer an editor
+// pushed last, or else the watched file.
+func currentDocument() (wsproto.ContentChanged, bool) {
+	if content, ok := buffers.current(); ok {
+		return content, true
+	}
+	data, err := os.ReadFile(*markdownFile)
+	if err != nil {
+		return wsproto.ContentChanged{}, false
+	}
+	return wsproto.ContentChanged{Source: "file", Path: *markdownFile, Text: string(data)}, true
+}
+
+// sharedDocument is the Markdown that slides and share links show: the
+// document the browser tabs edit together, or else the pushed buffer or
+// the watched file.
+func sharedDocument() []byte {
+	if text := collab.text(); text != "" {
+		return []byte(text)
+	}
+	content, _ := currentDocument()
+	return []byte(content.Text)
+}
+
+// sharedLink reports whether the shared document links to the file served
+// at urlPath, an escaped path below the base path.
+func sharedLink(urlPath string) bool {
+	doc, err := filepath.Abs(*markdownFile)
+	if err != nil {
+		return false
+	}
+	target, ok := resolveAssetLink(doc, urlPath)
+	if !ok {
+		return false
+	}
+	for _, l := range linksIn(doc, sharedDocument()) {
+		if t, ok := resolveAssetLink(doc, l.destination); ok && t == target {
+			return true
+		}
+	}
+	return false
+}
+
+// handleShares lists share links with their viewers, creates a link from
+// {"label": ...} or revokes the link given by ?id=.
+func handleShares(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Links   []*shareLink  `json:"links"`
+			Viewers []shareViewer `json:"viewers"`
+		}{shares.list(), hub.viewers()})
+	case http.MethodPost:
+		limitBody(w, r)
+		var req struct {
+			Label string `json:"label"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid share request", http.StatusBadRequest)
+			return
+		}
+		link := shares.create(strings.TrimSpace(req.Label))
+		log.Printf("Created share link %s %q", link.ID, link.Label)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(link)
+	case http.MethodDelete:
+		link := shares.revoke(r.URL.Query().Get("id"))
+		if link == nil {
+			http.Error(w, "Share link not found", http.StatusNotFound)
+			return
+		}
+		hub.disconnectShare(link)
+		log.Printf("Revoked share link %s %q", link.ID, link.Label)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// viewerFiles serves what the viewer page loads besides itself: the
+// stylesheet and files the shared document links relative to itself.
+// Other files beside the document stay private.
+var viewerFiles = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/static/") {
+		http.StripPrefix("/static/", http.FileServer(http.Dir("static"))).ServeHTTP(w, r)
+		return
+	}
+	if !sharedLink(r.URL.EscapedPath()) {
+		http.NotFound(w, r)
+		return
+	}
+	serveDocumentAsset(w, r)
+})
+
+// handleShare serves everything below /s/<token>/: the read-only viewer
+// page, its WebSocket and the files it links.
+func handleShare(w http.ResponseWriter, r *http.Request) {
+	token, rest, found := strings.Cut(strings.TrimPrefix(r.URL.Path, "/s/"), "/")
+	link := shares.lookup(token)
+	if link == nil {
+		http.Error(w, "Share link not found or revoked", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch {
+	case !found:
+		http.Redirect(w, r, link.URL, http.StatusMovedPermanently)
+	case rest == "":
+		http.SetCookie(w, &http.Cookie{
+			Name:     shareCookie,
+			Value:    token,
+			Path:     basePath + "/uploads/",
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteStrictMode,
+		})
+		serveViewerPage(w, link)
+	case rest == "ws":
+		serveProtocol(w, r, link)
+	default:
+		http.StripPrefix("/s/"+token, viewerFiles).ServeHTTP(w, r)
+	}
+}
+
+// isSharedUpload reports whether r reads an upload that the shared
+// document links, with the cookie of a live share link.
+func isSharedUpload(r *http.Request) bool {
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) || !strings.HasPrefix(r.URL.Path, "/uploads/") {
+		return false
+	}
+	c, err := r.Cookie(shareCookie)
+	return err == nil && shares.lookup(c.Value) != nil && sharedLink(r.URL.EscapedPath())
+}
+
+func serveViewerPage(w http.ResponseWriter, link *shareLink) {
+	const htmlStart = `<!DOCTYPE html>
+<html>
+<head>
+	<title>Markdown Preview (read-only)</title>
+	<link rel="stylesheet" href="static/styles.css">
+	<link rel="stylesheet" href="https://cdnjs.cloudflare.com/ajax/libs/prism/1.24.1/themes/prism-tomorrow.min.css">
+	<script src="https://cdnjs.cloudflare.com/ajax/libs/prism/1.24.1/prism.min.js"></script>
+	<script src="https://cdnjs.cloudflare.com/ajax/libs/prism/1.24.1/components/prism-go.min.js"></script>
+	<script src="https://cdnjs.cloudflare.com/ajax/libs/prism/1.24.1/components/prism-markdown.min.js"></script>
+	<script>`
+
+	// The viewer has no editor. It keeps the latest document text, asks
+	// the server to render it over the WebSocket and applies the patches
+	// like the editor page does.
+	const jsCode = `
+		let socket = null;
+		let previewStale = true;
+		let updateSeq = 0;
+		// The presentation being followed, if any.
+		let presentation = null;
+		let following = true;
+
+		function setStatus(type, message) {
+			const status = document.getElementById('status');
+			status.textContent = message;
+			status.className = 'status ' + type + ' visible';
+		}
+
+		function render(markdown) {
+			socket.send(JSON.stringify({
+				v: 1,
+				type: 'update',
+				id: String(++updateSeq),
+				payload: { markdown: markdown, reset: previewStale }
+			}));
+			previewStale = false;
+		}
+
+		function applyPatch(patch) {
+			const preview = document.getElementById('preview');
+			let body = preview.querySelector('.markdown-body');
+			if (patch.reset || !body) {
+				preview.innerHTML = '<div class="markdown-body"></div>';
+				body = preview.firstChild;
+			}
+
+			const blocks = Array.from(body.children);
+			for (let i = 0; i < patch.delete; i++) {
+				blocks[patch.start + i].remove();
+			}
+			const template = document.createElement('template');
+			template.innerHTML = patch.insert.join('');
+			const inserted = Array.from(template.content.children);
+			body.insertBefore(template.content, blocks[patch.start + patch.delete] || null);
+
+			if (patch.shift) {
+				for (let i = patch.start + patch.delete; i < blocks.length; i++) {
+					blocks[i].dataset.line = parseInt(blocks[i].dataset.line, 10) + patch.shift;
+				}
+			}
+			inserted.forEach(block => {
+				block.querySelectorAll('pre code').forEach(code => Prism.highlightElement(code));
+			});
+			if (presentation && following) {
+				scrollToPosition(presentation);
+			}
+		}
+
+		// Follow the editor's cursor, unless following a presenter.
+		function scrollToSourceLine(line) {
+			let target = null;
+			document.querySelectorAll('#preview [data-line]').forEach(block => {
+				if (parseInt(block.dataset.line, 10) <= line) {
+					target = block;
+				}
+			});
+			if (target && !(presentation && following)) {
+				target.scrollIntoView({ block: 'center' });
+			}
+		}
+
+		// Scroll to where the presenter is: the block at a source line and
+		// how far through it.
+		function scrollToPosition(position) {
+			const pane = document.querySelector('.preview-pane');
+			let target = null;
+			document.querySelectorAll('#preview [data-line]').forEach(block => {
+				if (parseInt(block.dataset.line, 10) <= position.line) {
+					target = block;
+				}
+			});
+			if (target) {
+				const rect = target.getBoundingClientRect();
+				pane.scrollTop += rect.top - pane.getBoundingClientRect().top + rect.height * (position.offset || 0);
+			}
+		}
+
+		function setFollowing(value) {
+			following = value;
+			if (presentation && following) {
+				scrollToPosition(presentation);
+			}
+			renderPresentationBar();
+		}
+
+		function renderPresentationBar() {
+			let bar = document.getElementById('presentation-bar');
+			if (!presentation) {
+				if (bar) {
+					bar.remove();
+				}
+				return;
+			}
+			if (!bar) {
+				bar = document.createElement('div');
+				bar.id = 'presentation-bar';
+				bar.className = 'presentation-bar';
+				document.body.appendChild(bar);
+			}
+			const name = presentation.name || 'Someone';
+			const label = document.createElement('span');
+			label.textContent = (following ? 'Following ' + name : name + ' is presenting') +
+				(presentation.heading ? ': ' + presentation.heading : '');
+			const button = document.createElement('button');
+			button.textContent = following ? 'Break away' : 'Rejoin';
+			button.onclick = () => setFollowing(!following);
+			bar.replaceChildren(label, button);
+		}
+
+		function connect() {
+			const scheme = window.location.protocol === 'https:' ? 'wss://' : 'ws://';
+			const ws = new WebSocket(scheme + window.location.host + sharePath + '/ws');
+			socket = ws;
+
+			ws.onopen = () => {
+				ws.send(JSON.stringify({
+					v: 1,
+					type: 'hello',
+					payload: {
+						versions: [1],
+						client: 'viewer',
+						name: localStorage.getItem('markdown-preview-name') || ''
+					}
+				}));
+			};
+
+			ws.onclose = (event) => {
+				if (event.code === 4403) {
+					setStatus('error', 'This share link has been revoked');
+					return;
+				}
+				presentation = null;
+				renderPresentationBar();
+				setStatus('error', 'Disconnected, reconnecting...');
+				setTimeout(connect, 5000);
+			};
+
+			ws.onmessage = (event) => {
+				const msg = JSON.parse(event.data);
+				const payload = msg.payload || {};
+				switch (msg.type) {
+					case 'welcome':
+						previewStale = true;
+						setStatus('success', 'Live');
+						break;
+					case 'content-changed':
+						render(payload.text);
+						if (payload.line) {
+							setTimeout(() => scrollToSourceLine(payload.line), 100);
+						}
+						break;
+					case 'patch':
+						applyPatch(payload);
+						break;
+					case 'cursor':
+						scrollToSourceLine(payload.line);
+						break;
+					case 'presentation':
+						if (payload.active) {
+							presentation = payload;
+							if (following) {
+								scrollToPosition(payload);
+							}
+						} else {
+							presentation = null;
+							following = true;
+						}
+						renderPresentationBar();
+						break;
+					case 'error':
+						console.error('Protocol error:', payload.code, payload.message);
+						break;
+				}
+			};
+		}
+
+		document.addEventListener('DOMContentLoaded', function() {
+			document.documentElement.setAttribute('data-theme', localStorage.getItem('theme') || 'light');
+			// Scrolling by hand breaks away from the presenter.
+			const pane = document.querySelector('.preview-pane');
+			['wheel', 'touchmove'].forEach(type => {
+				pane.addEventListener(type, () => {
+					if (presentation && following) {
+						setFollowing(false);
+					}
+				}, { passive: true });
+			});
+			connect();
+		});
+	</script>`
+
+	const htmlEnd = `
+</head>
+<body class="preview-only">
+	<div class="container">
+		<div class="preview-pane">
+			<div id="preview" class="preview">
+				<div class="loading">Waiting for the document...</div>
+			</div>
+		</div>
+		<div id="status" class="status">Connecting...</div>
+	</div>
+</body>
+</html>`
+
+	sharePath, _ := json.Marshal(strings.TrimSuffix(link.URL, "/"))
+	w.Header().Set("Content-Type", "text/html")
+	w.Write([]byte(htmlStart + "\n\t\tconst sharePath = " + string(sharePath) + ";" + jsCode + htmlEnd))
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yourusername/markdown-preview/wsproto"
+)
+
+// shareTestDoc writes a document with linked and unlinked files beside it
+// and returns a share link for it.
+func shareTestDoc(t *testing.T) *shareLink {
+	t.Helper()
+	resetCollab()
+	root := t.TempDir()
+	setFlag(t, markdownFile, filepath.Join(root, "doc.md"))
+	setFlag(t, uploadDir, filepath.Join(root, "uploads"))
+	files := map[string]string{
+		"doc.md":             "# Shared\n\n![a](img/a.png)\n\n![u](/uploads/linked.png)\n\n[data](data/public.csv)\n",
+		"img/a.png":          "a",
+		"img/b.png":          "b",
+		"data/public.csv":    "x,y",
+		"secret.csv":         "password",
+		"uploads/linked.png": "u",
+		"uploads/other.png":  "o",
+	}
+	for name, content := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	link := shares.create("test")
+	t.Cleanup(func() { shares.revoke(link.ID) })
+	return link
+}
+
+func TestShareServesOnlyLinkedFiles(t *testing.T) {
+	link := shareTestDoc(t)
+	// Uploads need the share cookie only when the server asks for a token.
+	oldToken := accessToken
+	accessToken = "secret"
+	t.Cleanup(func() { accessToken = oldToken })
+	srv := newTestServer(t)
+	share := &http.Cookie{Name: shareCookie, Value: link.token}
+
+	for _, tt := range []struct {
+		path string
+		want int
+	}{
+		{link.URL + "img/a.png", http.StatusOK},
+		{link.URL + "data/public.csv", http.StatusOK},
+		{link.URL + "img/b.png", http.StatusNotFound},
+		{link.URL + "secret.csv", http.StatusNotFound},
+		{link.URL + "img/../secret.csv", http.StatusNotFound},
+		{"/uploads/linked.png", http.StatusOK},
+		{"/uploads/other.png", http.StatusUnauthorized},
+	} {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.AddCookie(share)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("GET %s = %d, want %d", tt.path, resp.StatusCode, tt.want)
+		}
+	}
+}
+
+func dialShare(t *testing.T, srv string, link *shareLink) *wsproto.Client {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	url := "ws" + strings.TrimPrefix(srv, "http") + link.URL + "ws"
+	conn, err := wsproto.Dial(ctx, url, nil, wsproto.Hello{Client: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestShareViewerCommands(t *testing.T) {
+	link := shareTestDoc(t)
+	srv := newTestServer(t)
+	conn := dialShare(t, srv.URL, link)
+
+	for _, tt := range []struct {
+		typ       string
+		payload   interface{}
+		forbidden bool
+	}{
+		{wsproto.TypePing, nil, false},
+		{wsproto.TypeRender, wsproto.Render{Markdown: "# Mine"}, false},
+		{wsproto.TypeUpdate, wsproto.Update{Markdown: "# Mine", Reset: true}, false},
+		{wsproto.TypeLint, wsproto.Lint{Path: "/etc/passwd", Markdown: "# Mine"}, true},
+		{wsproto.TypePushBuffer, wsproto.PushBuffer{}, true},
+		{wsproto.TypeJoin, nil, true},
+		{wsproto.TypePresent, wsproto.Presentation{Active: true}, true},
+		{"unknown", nil, true},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		reply, err := conn.Request(ctx, tt.typ, tt.payload)
+		cancel()
+		var e *wsproto.ErrorPayload
+		if forbidden := errors.As(err, &e) && e.Code == wsproto.ErrForbidden; forbidden != tt.forbidden {
+			t.Errorf("%s: err = %v, want forbidden %v", tt.typ, err, tt.forbidden)
+			continue
+		}
+		// Viewers always get the shared document, whatever they send.
+		if err == nil && tt.typ != wsproto.TypePing {
+			if data := string(reply.Payload); strings.Contains(data, "Mine") || !strings.Contains(data, "Shared") {
+				t.Errorf("%s: rendered %s, want the shared document", tt.typ, data)
+			}
+		}
+	}
+}
+
+func TestRevokeShareClosesViewers(t *testing.T) {
+	link := shareTestDoc(t)
+	srv := newTestServer(t)
+	conn := dialShare(t, srv.URL, link)
+	// Commands are read once the viewer is registered.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := conn.Request(ctx, wsproto.TypePing, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(hub.viewers()) != 1 {
+		t.Fatalf("viewers = %v, want one", hub.viewers())
+	}
+
+	hub.disconnectShare(link)
+	if viewers := hub.viewers(); len(viewers) != 0 {
+		t.Errorf("viewers after revoking = %v, want none", viewers)
+	}
+	done := make(chan error, 1)
+	go func() {
+		for {
+			if _, err := conn.Next(); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("viewer connection still open after revoking")
+	}
+}
@@ -0,0 +1,664 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/gomarkdown/markdown"
+)
+
+// Ways of cutting a document into slides.
+const (
+	splitAuto    = "auto"    // on thematic breaks if there are any, else on headings
+	splitRule    = "rule"    // on thematic breaks: ---, *** or ___
+	splitHeading = "heading" // before every H1 and H2
+)
+
+var (
+	thematicBreakPattern = regexp.MustCompile(`^ {0,3}(?:(?:-[ \t]*){3,}|(?:\*[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+	notePattern          = regexp.MustCompile(`(?i)^ {0,3}notes?:[ \t]*`)
+	imageSourcePattern   = regexp.MustCompile(`(<img\b[^>]*?\ssrc=")([^"]+)(")`)
+)
+
+// slide is one slide of a deck, rendered. Notes are the speaker notes
+// written after a "Note:" line.
+type slide struct {
+	Line  int    `json:"line"` // one-based source line the slide starts on
+	Title string `json:"title"`
+	HTML  string `json:"html"`
+	Notes string `json:"notes,omitempty"`
+}
+
+// slideSource is the Markdown of one slide before rendering.
+type slideSource struct {
+	line  int
+	body  []string
+	notes []string
+}
+
+func validSplit(split string) bool {
+	return split == splitAuto || split == splitRule || split == splitHeading
+}
+
+// isThematicBreak reports whether line i is a thematic break rather than
+// code or the underline of a setext heading.
+func isThematicBreak(lines []sourceLine, i int) bool {
+	l := lines[i]
+	if l.InFence || !thematicBreakPattern.MatchString(l.Text) {
+		return false
+	}
+	underline := strings.TrimSpace(l.Text)
+	if i > 0 && strings.Trim(underline, "-") == "" {
+		prev := strings.TrimSpace(lines[i-1].Text)
+		if prev != "" && !lines[i-1].InFence && prev[0] != '#' && prev[0] != '-' && prev[0] != '>' {
+			return false
+		}
+	}
+	return true
+}
+
+// frontMatterLines returns how many lines the document's YAML front
+// matter takes: a first line of --- up to the next line of --- or ....
+// It is zero if there is none.
+func frontMatterLines(lines []sourceLine) int {
+	if len(lines) == 0 || strings.TrimRight(lines[0].Text, " \t") != "---" {
+		return 0
+	}
+	for i := 1; i < len(lines); i++ {
+		if end := strings.TrimRight(lines[i].Text, " \t"); end == "---" || end == "..." {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// splitSlides cuts a document into slides. Front matter is left out rather
+// than becoming a slide of its own. Everything from a "Note:" line to the
+// end of a slide is speaker notes. Slides with nothing on them are left
+// out.
+func splitSlides(src []byte, split string) []slideSource {
+	lines := splitSourceLines(src)
+	skip := frontMatterLines(lines)
+	if split == splitAuto {
+		split = splitHeading
+		for i := skip; i < len(lines); i++ {
+			if isThematicBreak(lines, i) {
+				split = splitRule
+				break
+			}
+		}
+	}
+	starts := map[int]bool{}
+	if split == splitHeading {
+		for _, h := range headingOutline(lines) {
+			if h.Level <= 2 {
+				starts[h.Line] = true
+			}
+		}
+	}
+
+	var slides []slideSource
+	cur := slideSource{line: skip}
+	inNotes := false
+	flush := func(next int) {
+		if strings.TrimSpace(strings.Join(cur.body, "")+strings.Join(cur.notes, "")) != "" {
+			slides = append(slides, cur)
+		}
+		cur = slideSource{line: next}
+		inNotes = false
+	}
+	for i := skip; i < len(lines); i++ {
+		l := lines[i]
+		switch {
+		case split == splitRule && isThematicBreak(lines, i):
+			flush(i + 1)
+			continue
+		case starts[i]:
+			flush(i)
+		case !l.InFence && !inNotes && notePattern.MatchString(l.Text):
+			inNotes = true
+			if rest := notePattern.ReplaceAllString(l.Text, ""); rest != "" {
+				cur.notes = append(cur.notes, rest)
+			}
+			continue
+		}
+		if inNotes {
+			cur.notes = append(cur.notes, l.Text)
+		} else {
+			cur.body = append(cur.body, l.Text)
+		}
+	}
+	flush(len(lines))
+	return slides
+}
+
+// renderSlides splits a document into slides and renders them. Reference
+// definitions anywhere in the document resolve on every slide. Rendering
+// stops between slides once ctx is done.
+func renderSlides(ctx context.Context, src []byte, split string) ([]slide, error) {
+	refs := referenceDefinitions(splitBlocks(src))
+	render := func(lines []string) string {
+		if len(lines) == 0 {
+			return ""
+		}
+		md := []byte(strings.Join(lines, "\n") + "\n" + refs)
+		out, _ := renders.render(renderKey("slide", md), func() (string, error) {
+			return withBasePathLinks(string(markdown.ToHTML(md, nil, nil))), nil
+		})
+		return out
+	}
+
+	slides := []slide{}
+	for _, s := range splitSlides(src, split) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		title := ""
+		if headings := headingOutline(splitSourceLines([]byte(strings.Join(s.body, "\n")))); len(headings) > 0 {
+			title = headings[0].Text
+		}
+		slides = append(slides, slide{
+			Line:  s.line + 1,
+			Title: title,
+			HTML:  render(s.body),
+			Notes: render(s.notes),
+		})
+	}
+	return slides, nil
+}
+
+// inlineImages replaces the local images in rendered slides with data
+// URIs, so an exported deck needs no other files. Paths resolve the way
+// the server serves them: /uploads/ from uploadDir and the rest from the
+// document's directory, after dropping the -base-path that rendering adds
+// to root-relative links. Images that cannot be read are left as they are.
+func inlineImages(slides []slide, docDir, uploadDir string) {
+	inline := func(m string) string {
+		parts := imageSourcePattern.FindStringSubmatch(m)
+		src := html.UnescapeString(parts[2])
+		if strings.HasPrefix(src, "//") || strings.Contains(strings.SplitN(src, "/", 2)[0], ":") {
+			return m
+		}
+		u, err := url.Parse(src)
+		if err != nil {
+			return m
+		}
+		name := path.Clean("/" + u.Path)
+		if rest, ok := strings.CutPrefix(u.Path, basePath+"/"); ok && basePath != "" {
+			name = path.Clean("/" + rest)
+		}
+		file := filepath.Join(docDir, filepath.FromSlash(name))
+		if rest, ok := strings.CutPrefix(name, "/uploads/"); ok {
+			file = filepath.Join(uploadDir, filepath.FromSlash(rest))
+		}
+		typ := mime.TypeByExtension(strings.ToLower(path.Ext(name)))
+		if !strings.HasPrefix(typ, "image/") {
+			return m
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			log.Printf("Export: cannot inline %s: %v", src, err)
+			return m
+		}
+		return parts[1] + "data:" + typ + ";base64," + base64.StdEncoding.EncodeToString(data) + parts[3]
+	}
+	for i := range slides {
+		slides[i].HTML = imageSourcePattern.ReplaceAllStringFunc(slides[i].HTML, inline)
+	}
+}
+
+// deckTitle names a deck after its first slide's title, or else the file.
+func deckTitle(slides []slide, file string) string {
+	if len(slides) > 0 && slides[0].Title != "" {
+		return slides[0].Title
+	}
+	return strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+}
+
+// handleSlidesAPI returns the current document's slides as JSON. ?split=
+// chooses how it is cut: auto, rule or heading.
+func handleSlidesAPI(w http.ResponseWriter, r *http.Request) {
+	slides, ok := loadSlides(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Slides []slide `json:"slides"`
+	}{slides})
+}
+
+// handleSlides serves the slide deck, or with ?view=presenter the presenter
+// window: current and next slide, notes and a timer.
+func handleSlides(w http.ResponseWriter, r *http.Request) {
+	slides, ok := loadSlides(w, r)
+	if !ok {
+		return
+	}
+	view := "deck"
+	if r.URL.Query().Get("view") == "presenter" {
+		view = "presenter"
+	}
+	w.Header().Set("Content-Type", "text/html")
+	writeDeck(w, deckTitle(slides, *markdownFile), slides, view, splitParam(r), true)
+}
+
+// handleSlidesExport downloads the deck as a single HTML file.
+func handleSlidesExport(w http.ResponseWriter, r *http.Request) {
+	slides, ok := loadSlides(w, r)
+	if !ok {
+		return
+	}
+	inlineImages(slides, filepath.Dir(*markdownFile), *uploadDir)
+	name := strings.TrimSuffix(filepath.Base(*markdownFile), filepath.Ext(*markdownFile)) + "-slides.html"
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	writeDeck(w, deckTitle(slides, *markdownFile), slides, "deck", splitParam(r), false)
+}
+
+func splitParam(r *http.Request) string {
+	if split := r.URL.Query().Get("split"); split != "" {
+		return split
+	}
+	return splitAuto
+}
+
+// loadSlides renders the current document's slides for a GET request,
+// writing the error response if that fails.
+func loadSlides(w http.ResponseWriter, r *http.Request) ([]slide, bool) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	split := splitParam(r)
+	if !validSplit(split) {
+		http.Error(w, "Unknown split, use auto, rule or heading", http.StatusBadRequest)
+		return nil, false
+	}
+	var slides []slide
+	err := renderPool.do(r.Context(), func(ctx context.Context) (err error) {
+		slides, err = renderSlides(ctx, sharedDocument(), split)
+		return err
+	})
+	if err != nil {
+		if r.Context().Err() == nil {
+			status, message := renderStatus(err)
+			http.Error(w, message, status)
+		}
+		return nil, false
+	}
+	return slides, true
+}
+
+// runSlides implements the slides subcommand, which exports a Markdown file
+// as a standalone HTML deck.
+func runSlides(args []string) int {
+	fs := flag.NewFlagSet("slides", flag.ContinueOnError)
+	fs.StringVar(uploadDir, "upload-dir", *uploadDir, "Directory /uploads/ images are read from")
+	split := fs.String("split", splitAuto, "Where slides break: auto, rule (---) or heading (H1 and H2)")
+	out := fs.String("o", "", "Write the deck to this file instead of standard output")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s slides [flags] file.md\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 || !validSplit(*split) {
+		fs.Usage()
+		return 2
+	}
+
+	file := fs.Arg(0)
+	src, err := os.ReadFile(file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	slides, err := renderSlides(context.Background(), src, *split)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	inlineImages(slides, filepath.Dir(file), *uploadDir)
+
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	writeDeck(w, deckTitle(slides, file), slides, "deck", *split, false)
+	if *out != "" {
+		fmt.Fprintf(os.Stderr, "wrote %d slide(s) to %s\n", len(slides), *out)
+	}
+	return 0
+}
+
+// writeDeck writes the deck page. A live deck reloads when the document
+// changes and keeps its windows on the same slide over the WebSocket; an
+// exported one carries its slides and works from a file.
+func writeDeck(w io.Writer, title string, slides []slide, view, split string, live bool) {
+	data, _ := json.Marshal(struct {
+		Live   bool    `json:"live"`
+		View   string  `json:"view"`
+		Split  string  `json:"split"`
+		Slides []slide `json:"slides"`
+	}{live, view, split, slides})
+
+	body := deckBody
+	if view == "presenter" {
+		body = presenterBody
+	}
+	io.WriteString(w, `<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<title>`+html.EscapeString(title)+`</title>
+	<style>`+deckCSS+`</style>
+	<link rel="stylesheet" href="https://cdnjs.cloudflare.com/ajax/libs/prism/1.24.1/themes/prism-tomorrow.min.css">
+	<script src="https://cdnjs.cloudflare.com/ajax/libs/prism/1.24.1/prism.min.js"></script>
+	<script src="https://cdnjs.cloudflare.com/ajax/libs/prism/1.24.1/components/prism-go.min.js"></script>
+	<script>`+basePathScript()+"\n\t\tconst deck = "+string(data)+";"+deckJS+`</script>
+</head>
+`+body+`
+</html>
+`)
+}
+
+const deckBody = `<body class="deck-view">
+	<div id="current" class="frame"></div>
+	<div id="counter" class="deck-counter"></div>
+	<div id="notes" class="deck-notes" hidden></div>
+</body>`
+
+const presenterBody = `<body class="presenter-view">
+	<div class="presenter">
+		<div id="current" class="frame"></div>
+		<div class="presenter-side">
+			<div class="presenter-label">Next</div>
+			<div id="next" class="frame"></div>
+			<div class="presenter-clock">
+				<span id="timer">0:00</span>
+				<span id="clock"></span>
+				<button onclick="resetTimer()" title="Reset the timer (R)">Reset</button>
+			</div>
+			<div id="counter" class="presenter-label"></div>
+			<div id="notes" class="presenter-notes"></div>
+		</div>
+	</div>
+</body>`
+
+// Slides are laid out at 1280x720 and scaled to fit their frame, so they
+// look the same in the deck, the presenter window and on a projector.
+const deckCSS = `
+	* { box-sizing: border-box; }
+	html, body { margin: 0; height: 100%; overflow: hidden; background: #111; font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, sans-serif; }
+	.frame { position: relative; overflow: hidden; }
+	.deck-view .frame { width: 100vw; height: 100vh; }
+	.slide { position: absolute; top: 0; left: 0; width: 1280px; height: 720px; padding: 56px 72px; overflow: hidden; transform-origin: 0 0; background: #fff; color: #24292e; font-size: 30px; line-height: 1.4; }
+	[data-theme="dark"] .slide { background: #1e1e1e; color: #e6e6e6; }
+	.slide h1 { font-size: 2.2em; margin: 0 0 0.4em; }
+	.slide h2 { font-size: 1.6em; margin: 0 0 0.4em; }
+	.slide h3 { font-size: 1.25em; margin: 0.6em 0 0.3em; }
+	.slide a { color: #0366d6; }
+	.slide code { font-family: SFMono-Regular, Consolas, "Liberation Mono", Menlo, monospace; font-size: 0.85em; }
+	.slide pre { font-size: 0.75em; padding: 16px 20px; border-radius: 6px; overflow: hidden; }
+	.slide img, .slide video { max-width: 100%; max-height: 560px; }
+	.slide table { border-collapse: collapse; }
+	.slide th, .slide td { border: 1px solid #d0d7de; padding: 6px 14px; }
+	.slide blockquote { margin: 0; padding-left: 1em; border-left: 6px solid #d0d7de; color: #6a737d; }
+	.deck-counter { position: fixed; right: 16px; bottom: 12px; font-size: 14px; color: #888; }
+	.deck-notes { position: fixed; left: 0; right: 0; bottom: 0; max-height: 35vh; overflow: auto; padding: 8px 24px; background: rgba(0, 0, 0, 0.85); color: #eee; font-size: 18px; }
+	.presenter { display: grid; grid-template-columns: 3fr 2fr; gap: 16px; height: 100vh; padding: 16px; color: #eee; }
+	.presenter .frame { background: #000; }
+	.presenter-side { display: flex; flex-direction: column; gap: 12px; min-height: 0; }
+	#next { height: 30vh; flex: none; opacity: 0.8; }
+	.presenter-label { font-size: 13px; text-transform: uppercase; letter-spacing: 0.05em; color: #999; }
+	.presenter-clock { display: flex; align-items: baseline; gap: 16px; font-size: 40px; font-variant-numeric: tabular-nums; }
+	#clock { font-size: 18px; color: #999; }
+	.presenter-clock button { margin-left: auto; padding: 4px 12px; border: 1px solid #555; border-radius: 4px; background: none; color: #ccc; cursor: pointer; }
+	.presenter-notes { flex: 1; overflow: auto; font-size: 22px; line-height: 1.5; }
+	.deck-empty { color: #888; }
+`
+
+// The deck moves with the arrow keys, Page Up and Down, space and Home
+// and End; F toggles full screen. In a live deck S opens the presenter
+// window, and moving in either window moves the other one, and any tab
+// following a presentation, through the present command. In an exported
+// deck S shows the notes instead.
+const deckJS = `
+		let slides = deck.slides;
+		let index = 0;
+		let socket = null;
+		let started = Date.now();
+		let reloadTimer = null;
+
+		function fit(frame) {
+			const el = frame.querySelector('.slide');
+			if (!el) {
+				return;
+			}
+			const scale = Math.min(frame.clientWidth / 1280, frame.clientHeight / 720);
+			el.style.transform = 'translate(' + (frame.clientWidth - 1280 * scale) / 2 + 'px, ' +
+				(frame.clientHeight - 720 * scale) / 2 + 'px) scale(' + scale + ')';
+		}
+
+		function showSlide(frame, s) {
+			if (!frame) {
+				return;
+			}
+			frame.innerHTML = '';
+			if (!s) {
+				return;
+			}
+			const el = document.createElement('div');
+			el.className = 'slide markdown-body';
+			el.innerHTML = s.html;
+			frame.appendChild(el);
+			if (window.Prism) {
+				el.querySelectorAll('pre code').forEach(code => Prism.highlightElement(code));
+			}
+			fit(frame);
+		}
+
+		function render() {
+			const s = slides[index];
+			showSlide(document.getElementById('current'), s || { html: '<p class="deck-empty">The document has no slides yet.</p>' });
+			showSlide(document.getElementById('next'), slides[index + 1]);
+			document.getElementById('counter').textContent = slides.length ? (index + 1) + ' / ' + slides.length : '';
+			document.getElementById('notes').innerHTML = s && s.notes ? s.notes : '<p class="deck-empty">No notes for this slide.</p>';
+		}
+
+		function go(n) {
+			n = Math.max(0, Math.min(n, slides.length - 1));
+			if (n === index) {
+				return;
+			}
+			index = n;
+			render();
+			const s = slides[index];
+			if (socket && socket.readyState === WebSocket.OPEN) {
+				socket.send(JSON.stringify({
+					v: 1,
+					type: 'present',
+					payload: { active: true, slide: index + 1, line: s.line, heading: s.title }
+				}));
+			}
+		}
+
+		function resetTimer() {
+			started = Date.now();
+			tick();
+		}
+
+		function tick() {
+			const timer = document.getElementById('timer');
+			if (!timer) {
+				return;
+			}
+			const seconds = Math.floor((Date.now() - started) / 1000);
+			const h = Math.floor(seconds / 3600);
+			const m = Math.floor(seconds / 60) % 60;
+			const s = seconds % 60;
+			timer.textContent = (h ? h + ':' + String(m).padStart(2, '0') : m) + ':' + String(s).padStart(2, '0');
+			document.getElementById('clock').textContent = new Date().toLocaleTimeString([], { hour: '2-digit', minute: '2-digit' });
+		}
+
+		function toggleSpeakerView() {
+			if (deck.view === 'presenter') {
+				return;
+			}
+			if (!deck.live) {
+				const notes = document.getElementById('notes');
+				notes.hidden = !notes.hidden;
+				return;
+			}
+			window.open(window.location.pathname + '?view=presenter&split=' + encodeURIComponent(deck.split),
+				'markdown-preview-presenter', 'width=1100,height=700');
+		}
+
+		function toggleFullscreen() {
+			if (document.fullscreenElement) {
+				document.exitFullscreen();
+			} else {
+				document.documentElement.requestFullscreen();
+			}
+		}
+
+		function handleKey(e) {
+			if (e.ctrlKey || e.metaKey || e.altKey) {
+				return;
+			}
+			switch (e.key) {
+				case 'ArrowRight':
+				case 'ArrowDown':
+				case 'PageDown':
+				case ' ':
+					go(index + 1);
+					break;
+				case 'ArrowLeft':
+				case 'ArrowUp':
+				case 'PageUp':
+				case 'Backspace':
+					go(index - 1);
+					break;
+				case 'Home':
+					go(0);
+					break;
+				case 'End':
+					go(slides.length - 1);
+					break;
+				case 'f':
+					toggleFullscreen();
+					break;
+				case 's':
+					toggleSpeakerView();
+					break;
+				case 'r':
+					resetTimer();
+					break;
+				default:
+					return;
+			}
+			e.preventDefault();
+		}
+
+		// Reload the slides a moment after the document changes.
+		function scheduleReload() {
+			clearTimeout(reloadTimer);
+			reloadTimer = setTimeout(() => {
+				fetch(basePath + '/api/slides?split=' + encodeURIComponent(deck.split))
+					.then(response => response.ok ? response.json() : Promise.reject(new Error(response.statusText)))
+					.then(data => {
+						slides = data.slides;
+						index = Math.max(0, Math.min(index, slides.length - 1));
+						render();
+					})
+					.catch(err => console.error('Reloading slides failed:', err));
+			}, 300);
+		}
+
+		// The deck joins the shared document only to hear about edits.
+		function connect() {
+			const scheme = window.location.protocol === 'https:' ? 'wss://' : 'ws://';
+			const ws = new WebSocket(scheme + window.location.host + basePath + '/ws');
+			socket = ws;
+
+			ws.onopen = () => {
+				ws.send(JSON.stringify({
+					v: 1,
+					type: 'hello',
+					payload: {
+						versions: [1],
+						client: deck.view === 'presenter' ? 'presenter' : 'slides',
+						name: localStorage.getItem('markdown-preview-name') || ''
+					}
+				}));
+			};
+
+			ws.onclose = () => {
+				setTimeout(connect, 5000);
+			};
+
+			ws.onmessage = (event) => {
+				const msg = JSON.parse(event.data);
+				const payload = msg.payload || {};
+				switch (msg.type) {
+					case 'welcome':
+						ws.send(JSON.stringify({ v: 1, type: 'join', id: 'join' }));
+						break;
+					case 'snapshot':
+					case 'edit':
+					case 'content-changed':
+						scheduleReload();
+						break;
+					case 'presentation':
+						if (payload.active && payload.slide) {
+							index = Math.max(0, Math.min(payload.slide - 1, slides.length - 1));
+							render();
+						}
+						break;
+				}
+			};
+		}
+
+		document.addEventListener('DOMContentLoaded', function() {
+			try {
+				document.documentElement.setAttribute('data-theme', localStorage.getItem('theme') || 'light');
+			} catch (e) {
+				// Files opened from disk may not have storage.
+			}
+			render();
+			document.addEventListener('keydown', handleKey);
+			window.addEventListener('resize', () => {
+				document.querySelectorAll('.frame').forEach(fit);
+			});
+			if (deck.view === 'presenter') {
+				tick();
+				setInterval(tick, 1000);
+			}
+			if (deck.live) {
+				connect();
+			}
+		});
+`
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitSlides(t *testing.T) {
+	for _, tt := range []struct {
+		name, split, src string
+		want             []slideSource
+	}{
+		{
+			name:  "thematic breaks",
+			split: splitRule,
+			src:   "# One\n\n---\n\n# Two\n***\nThree",
+			want: []slideSource{
+				{line: 0, body: []string{"# One", ""}},
+				{line: 3, body: []string{"", "# Two"}},
+				{line: 6, body: []string{"Three"}},
+			},
+		},
+		{
+			name:  "setext underline is not a break",
+			split: splitRule,
+			src:   "Title\n---\n\nText\n\n---\n\nMore",
+			want: []slideSource{
+				{line: 0, body: []string{"Title", "---", "", "Text", ""}},
+				{line: 6, body: []string{"", "More"}},
+			},
+		},
+		{
+			name:  "break inside a fence",
+			split: splitRule,
+			src:   "```\n---\n```\n---\nAfter",
+			want: []slideSource{
+				{line: 0, body: []string{"```", "---", "```"}},
+				{line: 4, body: []string{"After"}},
+			},
+		},
+		{
+			name:  "notes",
+			split: splitRule,
+			src:   "Slide\nNote: say this\nand this\n\n---\nNext",
+			want: []slideSource{
+				{line: 0, body: []string{"Slide"}, notes: []string{"say this", "and this", ""}},
+				{line: 5, body: []string{"Next"}},
+			},
+		},
+		{
+			name:  "note line inside a fence",
+			split: splitRule,
+			src:   "```\nNote: code\n```",
+			want: []slideSource{
+				{line: 0, body: []string{"```", "Note: code", "```"}},
+			},
+		},
+		{
+			name:  "headings",
+			split: splitHeading,
+			src:   "Intro\n# One\n### Sub\n## Two",
+			want: []slideSource{
+				{line: 0, body: []string{"Intro"}},
+				{line: 1, body: []string{"# One", "### Sub"}},
+				{line: 3, body: []string{"## Two"}},
+			},
+		},
+		{
+			name:  "auto splits on breaks when there are any",
+			split: splitAuto,
+			src:   "# One\n## Two\n---\n# Three",
+			want: []slideSource{
+				{line: 0, body: []string{"# One", "## Two"}},
+				{line: 3, body: []string{"# Three"}},
+			},
+		},
+		{
+			name:  "auto splits on headings otherwise",
+			split: splitAuto,
+			src:   "# One\nTitle\n---",
+			want: []slideSource{
+				{line: 0, body: []string{"# One"}},
+				{line: 1, body: []string{"Title", "---"}},
+			},
+		},
+		{
+			name:  "front matter is left out",
+			split: splitAuto,
+			src:   "---\ntitle: Talk\n---\n# One\n---\n# Two",
+			want: []slideSource{
+				{line: 3, body: []string{"# One"}},
+				{line: 5, body: []string{"# Two"}},
+			},
+		},
+		{
+			name:  "front matter with headings",
+			split: splitAuto,
+			src:   "---\ntitle: Talk\n...\n# One\n# Two",
+			want: []slideSource{
+				{line: 3, body: []string{"# One"}},
+				{line: 4, body: []string{"# Two"}},
+			},
+		},
+		{
+			name:  "unclosed front matter is a break",
+			split: splitAuto,
+			src:   "---\n# One",
+			want: []slideSource{
+				{line: 1, body: []string{"# One"}},
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitSlides([]byte(tt.src), tt.split)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInlineImages(t *testing.T) {
+	old := basePath
+	basePath = "/mdp"
+	t.Cleanup(func() { basePath = old })
+	docDir, uploads := t.TempDir(), t.TempDir()
+	for _, f := range []string{filepath.Join(docDir, "img", "a.png"), filepath.Join(uploads, "u.png")} {
+		if err := os.MkdirAll(filepath.Dir(f), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(f, []byte("png"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	const inlined = `src="data:image/png;base64,cG5n"`
+
+	for _, tt := range []struct {
+		name, src string
+		want      bool
+	}{
+		{"upload below base path", "/mdp/uploads/u.png", true},
+		{"upload", "/uploads/u.png", true},
+		{"relative", "img/a.png", true},
+		{"root-relative below base path", "/mdp/img/a.png", true},
+		{"missing", "/mdp/uploads/missing.png", false},
+		{"remote", "https://example.com/a.png", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			slides := []slide{{HTML: renderBlock(sourceBlock{Text: "![x](" + tt.src + ")\n"}, "")}}
+			inlineImages(slides, docDir, uploads)
+			if got := strings.Contains(slides[0].HTML, inlined); got != tt.want {
+				t.Errorf("inlined = %v, want %v: %s", got, tt.want, slides[0].HTML)
+			}
+		})
+	}
+}
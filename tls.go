@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	caValidity     = 10 * 365 * 24 * time.Hour
+	serverValidity = 365 * 24 * time.Hour
+	// renewBefore is how close to expiry a cached server certificate is
+	// replaced.
+	renewBefore = 30 * 24 * time.Hour
+)
+
+// serverTLSConfig returns the TLS configuration from -tls-cert/-tls-key or
+// -auto-tls, or nil to serve plain HTTP.
+func serverTLSConfig() (*tls.Config, error) {
+	var cert tls.Certificate
+	switch {
+	case *tlsCert != "" || *tlsKey != "":
+		if *tlsCert == "" || *tlsKey == "" {
+			return nil, errors.New("-tls-cert and -tls-key must be given together")
+		}
+		if *autoTLS {
+			return nil, errors.New("-auto-tls cannot be combined with -tls-cert")
+		}
+		var err error
+		if cert, err = tls.LoadX509KeyPair(*tlsCert, *tlsKey); err != nil {
+			return nil, err
+		}
+	case *autoTLS:
+		dir, err := tlsDir()
+		if err != nil {
+			return nil, err
+		}
+		if cert, err = localCertificate(dir, certHosts()); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, nil
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
+
+// tlsDir is where -auto-tls keeps its CA and server certificate.
+func tlsDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "markdown-preview", "tls"), nil
+}
+
+// certHosts lists the names a generated certificate covers: loopback,
+// -host, this machine's host name and the private addresses of its
+// interfaces, so the preview can be opened from other devices on the LAN.
+// Public addresses are left out since the local CA may not sign for them.
+func certHosts() []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	switch *host {
+	case "", "0.0.0.0", "::", "localhost":
+	default:
+		if ip := net.ParseIP(*host); ip != nil && !localIP(ip) {
+			log.Printf("-auto-tls cannot cover the public address %s; use -tls-cert instead", *host)
+		} else {
+			hosts = append(hosts, *host)
+		}
+	}
+	if name, err := os.Hostname(); err == nil && name != "" {
+		hosts = append(hosts, name)
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && localIP(ipnet.IP) {
+				hosts = append(hosts, ipnet.IP.String())
+			}
+		}
+	}
+	return hosts
+}
+
+// caIPRanges are the addresses the local CA may sign for: loopback and
+// the private ranges of RFC 1918 and RFC 4193.
+var caIPRanges = []*net.IPNet{
+	mustCIDR("127.0.0.0/8"),
+	mustCIDR("::1/128"),
+	mustCIDR("10.0.0.0/8"),
+	mustCIDR("172.16.0.0/12"),
+	mustCIDR("192.168.0.0/16"),
+	mustCIDR("fc00::/7"),
+}
+
+func mustCIDR(s string) *net.IPNet {
+	_, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return ipnet
+}
+
+// localIP reports whether ip is in one of caIPRanges.
+func localIP(ip net.IP) bool {
+	for _, r := range caIPRanges {
+		if r.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// localCertificate returns a server certificate for hosts signed by the
+// local CA in dir, creating the CA on first use. The certificate is cached
+// and only reissued when it no longer covers hosts or is about to expire.
+func localCertificate(dir string, hosts []string) (tls.Certificate, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return tls.Certificate{}, err
+	}
+	ca, caKey, err := loadOrCreateCA(dir, hosts)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	certFile := filepath.Join(dir, "server.pem")
+	keyFile := filepath.Join(dir, "server-key.pem")
+	if cert, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+		if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil && certUsable(leaf, ca, hosts) {
+			return cert, nil
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl, err := certTemplate("markdown-preview", serverValidity)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, key.Public(), caKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := writePEM(certFile, "CERTIFICATE", der, 0644); err != nil {
+		return tls.Certificate{}, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := writePEM(keyFile, "PRIVATE KEY", keyDER, 0600); err != nil {
+		return tls.Certificate{}, err
+	}
+	log.Printf("Issued a certificate for %v", hosts)
+	return tls.LoadX509KeyPair(certFile, keyFile)
+}
+
+// certUsable reports whether a cached server certificate was signed by ca,
+// covers every host and is not about to expire.
+func certUsable(leaf, ca *x509.Certificate, hosts []string) bool {
+	if leaf.CheckSignatureFrom(ca) != nil || time.Until(leaf.NotAfter) < renewBefore {
+		return false
+	}
+	for _, h := range hosts {
+		if leaf.VerifyHostname(h) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// loadOrCreateCA reads the local CA from dir, or creates one. The CA
+// certificate is the file to import into a browser or OS trust store, so
+// it is name-constrained: it can only vouch for hosts and the loopback
+// and private address ranges, never for other sites. A CA that cannot
+// sign for every host is replaced.
+func loadOrCreateCA(dir string, hosts []string) (*x509.Certificate, crypto.Signer, error) {
+	certFile := filepath.Join(dir, "ca.pem")
+	keyFile := filepath.Join(dir, "ca-key.pem")
+	if pair, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+		ca, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		signer, ok := pair.PrivateKey.(crypto.Signer)
+		if ok && time.Now().Before(ca.NotAfter) && caPermits(ca, hosts) {
+			return ca, signer, nil
+		}
+		if ok && time.Now().Before(ca.NotAfter) {
+			log.Printf("The local CA in %s is not limited to %v; replacing it", dir, hosts)
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	name, _ := os.Hostname()
+	tmpl, err := certTemplate("markdown-preview local CA ("+name+")", caValidity)
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl.IsCA = true
+	tmpl.BasicConstraintsValid = true
+	tmpl.MaxPathLenZero = true
+	tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	tmpl.PermittedDNSDomainsCritical = true
+	tmpl.PermittedIPRanges = caIPRanges
+	for _, h := range hosts {
+		if net.ParseIP(h) == nil {
+			tmpl.PermittedDNSDomains = append(tmpl.PermittedDNSDomains, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := writePEM(keyFile, "PRIVATE KEY", keyDER, 0600); err != nil {
+		return nil, nil, err
+	}
+	if err := writePEM(certFile, "CERTIFICATE", der, 0644); err != nil {
+		return nil, nil, err
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Printf("Created a local CA. Import %s into your browser to trust the preview", certFile)
+	return ca, key, nil
+}
+
+// caPermits reports whether ca is name-constrained and its constraints
+// allow every host.
+func caPermits(ca *x509.Certificate, hosts []string) bool {
+	if !ca.PermittedDNSDomainsCritical || len(ca.PermittedIPRanges) == 0 {
+		return false
+	}
+	for _, h := range hosts {
+		if !caPermitsHost(ca, h) {
+			return false
+		}
+	}
+	return true
+}
+
+func caPermitsHost(ca *x509.Certificate, h string) bool {
+	if ip := net.ParseIP(h); ip != nil {
+		for _, r := range ca.PermittedIPRanges {
+			if r.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	h = strings.ToLower(h)
+	for _, d := range ca.PermittedDNSDomains {
+		d = strings.ToLower(d)
+		if h == d || strings.HasSuffix(h, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+func certTemplate(commonName string, validity time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"markdown-preview"}},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(validity),
+	}, nil
+}
+
+func writePEM(path, typ string, der []byte, perm os.FileMode) error {
+	var buf bytes.Buffer
+	if err := pem.Encode(&buf, &pem.Block{Type: typ, Bytes: der}); err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf.Bytes(), perm)
+}
+
+// certFingerprint is the SHA-256 of the serving certificate, recorded in
+// the instance control file so a later invocation can verify it is
+// talking to this server without trusting the local CA.
+func certFingerprint(cfg *tls.Config) string {
+	if cfg == nil || len(cfg.Certificates) == 0 || len(cfg.Certificates[0].Certificate) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(cfg.Certificates[0].Certificate[0])
+	return hex.EncodeToString(sum[:])
+}
+
+// pinnedTLSConfig accepts exactly the certificate with the given
+// fingerprint.
+func pinnedTLSConfig(fingerprint string) *tls.Config {
+	return &tls.Config{
+		// Verification is done against the pinned fingerprint instead.
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("no certificate")
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			if hex.EncodeToString(sum[:]) != fingerprint {
+				return errors.New("certificate does not match the running server's")
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"net"
+	"testing"
+	"time"
+)
+
+// issue signs a server certificate for hosts with the CA in dir.
+func issue(t *testing.T, dir string, hosts ...string) *x509.Certificate {
+	t.Helper()
+	ca, caKey, err := loadOrCreateCA(dir, []string{"localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl, _ := certTemplate("test", time.Hour)
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, key.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return leaf
+}
+
+func TestLocalCANameConstraints(t *testing.T) {
+	dir := t.TempDir()
+	hosts := []string{"localhost", "127.0.0.1", "::1", "devbox", "192.168.1.20", "fd00::5"}
+	cert, err := localCertificate(dir, hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _, err := loadOrCreateCA(dir, hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ca.PermittedDNSDomainsCritical {
+		t.Error("name constraints are not critical")
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	for _, h := range hosts {
+		if _, err := leaf.Verify(x509.VerifyOptions{Roots: roots, DNSName: h}); err != nil {
+			t.Errorf("%s: %v", h, err)
+		}
+	}
+
+	// Even with its key, the CA cannot vouch for other sites.
+	for _, h := range []string{"example.com", "localhost.example.com", "8.8.8.8", "devbox.evil.test"} {
+		forged := issue(t, dir, h)
+		if _, err := forged.Verify(x509.VerifyOptions{Roots: roots, DNSName: h}); err == nil {
+			t.Errorf("CA signed a usable certificate for %s", h)
+		}
+	}
+}
+
+func TestLocalCAReplacedForNewHosts(t *testing.T) {
+	dir := t.TempDir()
+	old, _, err := loadOrCreateCA(dir, []string{"localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A new host name outside the constraints needs a new CA.
+	ca, _, err := loadOrCreateCA(dir, []string{"localhost", "devbox"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca.Equal(old) {
+		t.Error("kept a CA that cannot sign for devbox")
+	}
+	again, _, err := loadOrCreateCA(dir, []string{"localhost", "devbox", "10.0.0.7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again.Equal(ca) {
+		t.Error("replaced a CA that covers every host")
+	}
+}
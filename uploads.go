@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// imageTypes maps the sniffed content types we accept to the extension
+// the stored file gets. The client's filename and Content-Type are never
+// trusted.
+var imageTypes = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// maxAltTextLen bounds the alt text derived from an upload's filename.
+const maxAltTextLen = 100
+
+func handleImageUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Leave room for the multipart framing around the file itself.
+	maxUpload := int64(*maxUploadMB) << 20
+	r.Body = http.MaxBytesReader(w, r.Body, maxUpload+64<<10)
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("Image larger than %d MB", *maxUploadMB), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Invalid file upload", http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	// Handle file upload
+	file, header, err := r.FormFile("image")
+	if err != nil {
+		http.Error(w, "Invalid file upload", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	if header.Size > maxUpload {
+		http.Error(w, fmt.Sprintf("Image larger than %d MB", *maxUploadMB), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// Sniff the real type from the first bytes
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		http.Error(w, "Invalid file upload", http.StatusBadRequest)
+		return
+	}
+	head = head[:n]
+	contentType := http.DetectContentType(head)
+	if _, ok := imageTypes[contentType]; !ok {
+		if looksLikeSVG(head) {
+			// SVG can carry scripts that run when the file is opened directly.
+			http.Error(w, "SVG images are not accepted", http.StatusUnsupportedMediaType)
+			return
+		}
+		http.Error(w, "Unsupported image type (allowed: PNG, JPEG, GIF, WebP)", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	data, err := io.ReadAll(io.MultiReader(bytes.NewReader(head), file))
+	if err != nil {
+		http.Error(w, "Invalid file upload", http.StatusBadRequest)
+		return
+	}
+	// An image that cannot be processed would be stored with its
+	// metadata, so it is refused instead.
+	data, err = processImage(data, contentType)
+	if errors.Is(err, errImageTooLarge) {
+		http.Error(w, fmt.Sprintf("Image larger than %d megapixels", maxImagePixels/1_000_000), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		log.Printf("Rejected upload %q: %v", header.Filename, err)
+		http.Error(w, "Invalid image file", http.StatusBadRequest)
+		return
+	}
+
+	imageURL, path, err := storeUpload(bytes.NewReader(data), contentType, imageTypes[contentType], header.Filename)
+	if err != nil {
+		log.Printf("Failed to save upload: %v", err)
+		http.Error(w, "Failed to save file", http.StatusInternalServerError)
+		return
+	}
+	if len(thumbnailsOf(path)) == 0 {
+		if _, err := writeThumbnails(path, data, contentType, thumbnailSizes); err != nil {
+			log.Printf("Failed to create thumbnails for %s: %v", path, err)
+		}
+	}
+
+	// Return the markdown image syntax
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"markdown": fmt.Sprintf("![%s](%s)", altText(header.Filename), imageURL),
+	})
+}
+
+// uploadRecord is the sidecar stored next to each upload as
+// "<file>.json". It describes the first upload of the content.
+type uploadRecord struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Type     string    `json:"type"`
+	Width    int       `json:"width,omitempty"`
+	Height   int       `json:"height,omitempty"`
+	Uploaded time.Time `json:"uploaded"`
+}
+
+func sidecarPath(path string) string {
+	return path + ".json"
+}
+
+// storeUpload saves an upload whose type has been checked and returns the
+// URL to insert into the document and the stored file's path. By default
+// files go to -upload-dir under the hex SHA-256 of their content; with
+// -asset-dir they go beside the document and the URL is relative to it.
+// Either way a sidecar record is written next to a new file. Upload URLs
+// leave out -base-path so documents don't depend on where the server is
+// mounted; rendering adds it back.
+func storeUpload(src io.Reader, contentType, ext, originalName string) (string, string, error) {
+	dir := *uploadDir
+	if *assetDir != "" {
+		dir = filepath.Join(filepath.Dir(*markdownFile), expandAssetTemplate(*assetDir, assetVars{}))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", "", err
+		}
+	}
+
+	tmp, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		return "", "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), src)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return "", "", err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+
+	if *assetDir != "" {
+		path, err := placeAsset(tmp.Name(), dir, expandAssetTemplate(*assetName, assetVars{
+			name: originalName,
+			hash: sum,
+			ext:  ext,
+		}), sum)
+		if err != nil {
+			return "", "", err
+		}
+		// The sidecar marks the file as ours, so gc never touches files
+		// the user put beside the document.
+		if _, err := os.Stat(sidecarPath(path)); os.IsNotExist(err) {
+			if err := writeSidecar(path, originalName, contentType, size); err != nil {
+				return "", "", err
+			}
+		}
+		u, err := relativeAssetURL(path)
+		return u, path, err
+	}
+
+	filename := sum + ext
+	path := filepath.Join(dir, filename)
+	if _, err := os.Stat(path); err == nil {
+		log.Printf("Upload %q matches existing %s", originalName, filename)
+		return "/uploads/" + filename, path, nil
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", "", err
+	}
+	if err := writeSidecar(path, originalName, contentType, size); err != nil {
+		return "", "", err
+	}
+	return "/uploads/" + filename, path, nil
+}
+
+// writeSidecar records the upload stored at path.
+func writeSidecar(path, originalName, contentType string, size int64) error {
+	rec := uploadRecord{
+		Name:     filepath.Base(strings.ReplaceAll(originalName, `\`, "/")),
+		Size:     size,
+		Type:     contentType,
+		Uploaded: time.Now().UTC(),
+	}
+	if f, err := os.Open(path); err == nil {
+		if cfg, _, err := image.DecodeConfig(f); err == nil {
+			rec.Width, rec.Height = cfg.Width, cfg.Height
+		}
+		f.Close()
+	}
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(sidecarPath(path), data, 0644)
+}
+
+// placeAsset moves the temporary file tmp to dir/name. If a different
+// file already has that name, "-2", "-3", ... is added before the
+// extension; if the same content is already there it is reused.
+func placeAsset(tmp, dir, name, sum string) (string, error) {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		path := filepath.Join(dir, name)
+		existing, err := fileSHA256(path)
+		if os.IsNotExist(err) {
+			return path, os.Rename(tmp, path)
+		}
+		if err != nil {
+			return "", err
+		}
+		if existing == sum {
+			return path, nil
+		}
+		name = fmt.Sprintf("%s-%d%s", base, i+1, ext)
+	}
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// relativeAssetURL returns the link to path from the document's directory,
+// with each segment escaped so that names with spaces still work.
+func relativeAssetURL(path string) (string, error) {
+	rel, err := filepath.Rel(filepath.Dir(*markdownFile), path)
+	if err != nil {
+		return "", err
+	}
+	return escapePath(filepath.ToSlash(rel)), nil
+}
+
+// escapePath escapes each segment of a slash-separated path for use in
+// a URL.
+func escapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, seg := range segments {
+		segments[i] = url.PathEscape(seg)
+	}
+	return strings.Join(segments, "/")
+}
+
+// assetVars are the values available to -asset-dir and -asset-name.
+type assetVars struct {
+	name string // original filename
+	hash string // hex SHA-256 of the content
+	ext  string // extension for the sniffed type, with the dot
+	doc  string // Markdown file the upload belongs to; -file if empty
+}
+
+// expandAssetTemplate fills in {doc}, {name}, {hash}, {short}, {date} and
+// {ext}. Substituted values are reduced to safe filename characters.
+func expandAssetTemplate(tmpl string, v assetVars) string {
+	if v.doc == "" {
+		v.doc = *markdownFile
+	}
+	short := v.hash
+	if len(short) > 12 {
+		short = short[:12]
+	}
+	return strings.NewReplacer(
+		"{doc}", docSlug(v.doc),
+		"{name}", assetSlug(altText(v.name), "image"),
+		"{hash}", v.hash,
+		"{short}", short,
+		"{date}", time.Now().Format("2006-01-02"),
+		"{ext}", v.ext,
+	).Replace(tmpl)
+}
+
+// docSlug is the value of {doc} for the Markdown file doc.
+func docSlug(doc string) string {
+	doc = filepath.Base(doc)
+	return assetSlug(strings.TrimSuffix(doc, filepath.Ext(doc)), "document")
+}
+
+// assetSlug lowercases s and replaces runs of anything other than letters
+// and digits with a single hyphen.
+func assetSlug(s, fallback string) string {
+	var b strings.Builder
+	hyphen := false
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if hyphen && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			hyphen = false
+		} else {
+			hyphen = true
+		}
+	}
+	if b.Len() == 0 {
+		return fallback
+	}
+	return b.String()
+}
+
+// checkAssetTemplates rejects templates that would write outside the
+// document's directory or produce names containing a path separator.
+func checkAssetTemplates() error {
+	if *assetDir == "" {
+		return nil
+	}
+	dir := filepath.Clean(expandAssetTemplate(*assetDir, assetVars{}))
+	if filepath.IsAbs(dir) || dir == ".." || strings.HasPrefix(dir, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("-asset-dir %q must stay inside the document's directory", *assetDir)
+	}
+	name := expandAssetTemplate(*assetName, assetVars{name: "x.png", hash: strings.Repeat("0", 64), ext: ".png"})
+	if name == "" || strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return fmt.Errorf("-asset-name %q must produce a plain file name", *assetName)
+	}
+	return nil
+}
+
+// documentAssetTypes are the file types served from the document's
+// directory so that relative links in the preview resolve. Anything else,
+// including the Markdown sources themselves, is not exposed.
+var documentAssetTypes = map[string]bool{
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".webp": true,
+	".mp4": true, ".webm": true, ".mp3": true, ".ogg": true, ".wav": true,
+	".pdf": true, ".csv": true, ".txt": true, ".zip": true,
+}
+
+// serveDocumentAsset serves a file linked relative to the document.
+func serveDocumentAsset(w http.ResponseWriter, r *http.Request) {
+	name := path.Clean(r.URL.Path)
+	if !documentAssetTypes[strings.ToLower(path.Ext(name))] {
+		http.NotFound(w, r)
+		return
+	}
+	for _, seg := range strings.Split(name, "/") {
+		if strings.HasPrefix(seg, ".") && seg != thumbsDir {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	http.ServeFile(w, r, filepath.Join(filepath.Dir(*markdownFile), filepath.FromSlash(name)))
+}
+
+// looksLikeSVG reports whether a sniffed prefix is an SVG document, which
+// http.DetectContentType reports only as XML or text.
+func looksLikeSVG(head []byte) bool {
+	return bytes.Contains(bytes.ToLower(head), []byte("<svg"))
+}
+
+// altText derives Markdown-safe alt text from an uploaded filename:
+// "my_photo-2.PNG" becomes "my photo 2". Characters that would end the
+// alt text or the image syntax are dropped.
+func altText(filename string) string {
+	name := filepath.Base(strings.ReplaceAll(filename, `\`, "/"))
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r == '_' || r == '-' || r == '.' || unicode.IsSpace(r):
+			b.WriteRune(' ')
+		case strings.ContainsRune("[]()<>\\`*!", r), unicode.IsControl(r):
+		default:
+			b.WriteRune(r)
+		}
+	}
+	alt := strings.Join(strings.Fields(b.String()), " ")
+	if len(alt) > maxAltTextLen {
+		alt = strings.TrimSpace(strings.ToValidUTF8(alt[:maxAltTextLen], ""))
+	}
+	if alt == "" || alt == "." {
+		return "image"
+	}
+	return alt
+}
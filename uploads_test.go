@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// postFile sends data as the multipart field of a POST to handler.
+func postFile(t *testing.T, handler http.HandlerFunc, field, filename string, data []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile(field, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(data)
+	mw.Close()
+	req := httptest.NewRequest(http.MethodPost, "/", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+func TestUploadSniffsContent(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		filename string
+		data     []byte
+		want     int
+	}{
+		{"svg", "logo.svg", []byte(`<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`), http.StatusUnsupportedMediaType},
+		{"svg named png", "logo.png", []byte(`<svg onload="alert(1)"/>`), http.StatusUnsupportedMediaType},
+		{"html named png", "page.png", []byte("<!DOCTYPE html><html><script>alert(1)</script></html>"), http.StatusUnsupportedMediaType},
+		{"png named svg", "logo.svg", testPNG(t, 2, 2), http.StatusOK},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, uploadDir, t.TempDir())
+			rec := postFile(t, handleImageUpload, "image", tt.filename, tt.data)
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			entries, _ := os.ReadDir(*uploadDir)
+			for _, e := range entries {
+				// The stored name comes from the sniffed type.
+				if ext := filepath.Ext(strings.TrimSuffix(e.Name(), ".json")); ext != ".png" {
+					t.Errorf("stored %s", e.Name())
+				}
+			}
+			if tt.want != http.StatusOK && len(entries) > 0 {
+				t.Errorf("stored %d file(s) for a rejected upload", len(entries))
+			}
+		})
+	}
+}
+
+func TestUploadDeduplicates(t *testing.T) {
+	setFlag(t, uploadDir, t.TempDir())
+	data := testPNG(t, 3, 2)
+	sum := sha256.Sum256(data)
+	want := "/uploads/" + hex.EncodeToString(sum[:]) + ".png"
+
+	for _, name := range []string{"first.png", "second.png"} {
+		rec := postFile(t, handleImageUpload, "image", name, data)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d: %s", name, rec.Code, rec.Body)
+		}
+		var resp struct{ Markdown string }
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		if !strings.HasSuffix(resp.Markdown, "("+want+")") {
+			t.Errorf("%s: markdown = %q, want a link to %s", name, resp.Markdown, want)
+		}
+	}
+
+	entries, err := os.ReadDir(*uploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("stored %d files, want the image and its sidecar", len(entries))
+	}
+	raw, err := os.ReadFile(sidecarPath(filepath.Join(*uploadDir, path.Base(want))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec uploadRecord
+	if err := json.Unmarshal(raw, &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Name != "first.png" || rec.Size != int64(len(data)) || rec.Type != "image/png" || rec.Width != 3 || rec.Height != 2 {
+		t.Errorf("sidecar = %+v, want the first upload's details", rec)
+	}
+}
+
+func TestUploadToAssetDir(t *testing.T) {
+	root := t.TempDir()
+	setFlag(t, markdownFile, filepath.Join(root, "My Notes.md"))
+	setFlag(t, assetDir, "images/{doc}")
+	setFlag(t, assetName, "{name}{ext}")
+
+	a, b := testPNG(t, 2, 2), testPNG(t, 3, 3)
+	for _, tt := range []struct {
+		filename string
+		data     []byte
+		want     string
+	}{
+		{"Photo One.png", a, "images/my-notes/photo-one.png"},
+		{"photo_one.png", b, "images/my-notes/photo-one-2.png"},
+		{"photo one.PNG", a, "images/my-notes/photo-one.png"},
+	} {
+		rec := postFile(t, handleImageUpload, "image", tt.filename, tt.data)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d: %s", tt.filename, rec.Code, rec.Body)
+		}
+		var resp struct{ Markdown string }
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		if !strings.HasSuffix(resp.Markdown, "("+tt.want+")") {
+			t.Errorf("%s: markdown = %q, want a link to %s", tt.filename, resp.Markdown, tt.want)
+		}
+		if _, err := os.Stat(sidecarPath(filepath.Join(root, filepath.FromSlash(tt.want)))); err != nil {
+			t.Errorf("%s: %v", tt.filename, err)
+		}
+	}
+
+	entries, _ := os.ReadDir(filepath.Join(root, "images", "my-notes"))
+	if len(entries) != 4 {
+		t.Errorf("asset dir holds %d files, want two images and their sidecars", len(entries))
+	}
+
+	u, err := relativeAssetURL(filepath.Join(root, "my images", "a b.png"))
+	if err != nil || u != "my%20images/a%20b.png" {
+		t.Errorf("relativeAssetURL = %q, %v", u, err)
+	}
+}
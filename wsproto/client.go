@@ -0,0 +1,152 @@
+package wsproto
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Client is a protocol-level connection to a preview server. Next and
+// Request may not be called concurrently with each other; sending is safe
+// from any goroutine.
+type Client struct {
+	conn    *websocket.Conn
+	welcome Welcome
+
+	writeMu sync.Mutex
+	nextID  int
+	pending []*Message // events read while waiting for a reply
+}
+
+// Dial connects to url (for example "ws://localhost:8080/ws") and performs
+// the handshake. If hello.Versions is empty the current Version is offered.
+// Header may carry cookies or an Authorization header.
+func Dial(ctx context.Context, url string, header http.Header, hello Hello) (*Client, error) {
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, url, header)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{conn: conn}
+	if len(hello.Versions) == 0 {
+		hello.Versions = []int{Version}
+	}
+	if err := c.Send(TypeHello, "", hello); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetReadDeadline(deadline)
+		defer conn.SetReadDeadline(time.Time{})
+	}
+	msg, err := c.read()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	switch msg.Type {
+	case TypeWelcome:
+		if err := msg.Decode(&c.welcome); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return c, nil
+	case TypeError:
+		var e ErrorPayload
+		msg.Decode(&e)
+		conn.Close()
+		return nil, &e
+	}
+	conn.Close()
+	return nil, fmt.Errorf("wsproto: expected %s, got %s", TypeWelcome, msg.Type)
+}
+
+// Welcome returns the server's handshake reply.
+func (c *Client) Welcome() Welcome {
+	return c.welcome
+}
+
+// Send writes one message. An empty id sends a message that expects no reply.
+func (c *Client) Send(typ, id string, payload interface{}) error {
+	frame, err := Encode(typ, id, payload)
+	if err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.conn.WriteMessage(websocket.TextMessage, frame)
+}
+
+// Next returns the next message from the server, starting with any events
+// that arrived while Request was waiting for its reply.
+func (c *Client) Next() (*Message, error) {
+	if len(c.pending) > 0 {
+		msg := c.pending[0]
+		c.pending = c.pending[1:]
+		return msg, nil
+	}
+	return c.read()
+}
+
+// Request sends a command and waits for the reply carrying the same id.
+// An error reply is returned as *ErrorPayload.
+func (c *Client) Request(ctx context.Context, typ string, payload interface{}) (*Message, error) {
+	c.writeMu.Lock()
+	c.nextID++
+	id := strconv.Itoa(c.nextID)
+	c.writeMu.Unlock()
+
+	if err := c.Send(typ, id, payload); err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		c.conn.SetReadDeadline(deadline)
+		defer c.conn.SetReadDeadline(time.Time{})
+	}
+	for {
+		msg, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		if msg.ID != id {
+			c.pending = append(c.pending, msg)
+			continue
+		}
+		if msg.Type == TypeError {
+			var e ErrorPayload
+			if err := msg.Decode(&e); err != nil {
+				return nil, err
+			}
+			return nil, &e
+		}
+		return msg, nil
+	}
+}
+
+// Close sends a normal close frame and closes the connection.
+func (c *Client) Close() error {
+	c.writeMu.Lock()
+	c.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(time.Second))
+	c.writeMu.Unlock()
+	return c.conn.Close()
+}
+
+func (c *Client) read() (*Message, error) {
+	_, data, err := c.conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	var msg Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, fmt.Errorf("wsproto: decoding frame: %w", err)
+	}
+	return &msg, nil
+}
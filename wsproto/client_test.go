@@ -0,0 +1,139 @@
+package wsproto
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// stubServer accepts one handshake the way the preview server does: it
+// picks the highest offered version it supports and then echoes every
+// command back as an ack, preceded by an unrelated event.
+func stubServer(t *testing.T, supported ...int) string {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reply := func(typ, id string, payload interface{}) {
+			frame, _ := Encode(typ, id, payload)
+			conn.WriteMessage(websocket.TextMessage, frame)
+		}
+
+		var first Message
+		var hello Hello
+		if conn.ReadJSON(&first) != nil || first.Type != TypeHello || first.Decode(&hello) != nil {
+			reply(TypeError, "", ErrorPayload{Code: ErrHandshakeRequired, Message: "first message must be hello"})
+			return
+		}
+		version := 0
+		for _, v := range hello.Versions {
+			for _, s := range supported {
+				if v == s && v > version {
+					version = v
+				}
+			}
+		}
+		if version == 0 {
+			reply(TypeError, "", ErrorPayload{Code: ErrUnsupportedVersion, Message: "no common version"})
+			return
+		}
+		reply(TypeWelcome, "", Welcome{Version: version, Session: hello.Client, Server: "stub"})
+
+		for {
+			var msg Message
+			if conn.ReadJSON(&msg) != nil {
+				return
+			}
+			reply(TypeCursor, "", Cursor{Line: 1})
+			if msg.Type == TypeRender {
+				reply(TypeError, msg.ID, ErrorPayload{Code: ErrUnknownCommand, Message: msg.Type})
+				continue
+			}
+			reply(TypeAck, msg.ID, nil)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func dialTimeout() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), 5*time.Second)
+}
+
+func TestDialNegotiatesVersion(t *testing.T) {
+	ctx, cancel := dialTimeout()
+	defer cancel()
+
+	c, err := Dial(ctx, stubServer(t, 1), nil, Hello{Client: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if w := c.Welcome(); w.Version != Version || w.Session != "test" {
+		t.Errorf("welcome %+v, want version %d", w, Version)
+	}
+
+	c2, err := Dial(ctx, stubServer(t, 1, 2), nil, Hello{Versions: []int{2, 1}, Client: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	if v := c2.Welcome().Version; v != 2 {
+		t.Errorf("negotiated version %d, want 2", v)
+	}
+}
+
+func TestDialRejectedVersion(t *testing.T) {
+	ctx, cancel := dialTimeout()
+	defer cancel()
+
+	_, err := Dial(ctx, stubServer(t, 1), nil, Hello{Versions: []int{99}, Client: "test"})
+	var e *ErrorPayload
+	if !errors.As(err, &e) || e.Code != ErrUnsupportedVersion {
+		t.Fatalf("got %v, want %s", err, ErrUnsupportedVersion)
+	}
+}
+
+func TestRequestQueuesEvents(t *testing.T) {
+	ctx, cancel := dialTimeout()
+	defer cancel()
+	c, err := Dial(ctx, stubServer(t, 1), nil, Hello{Client: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	reply, err := c.Request(ctx, TypePing, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Type != TypeAck || reply.ID != "1" {
+		t.Errorf("reply %+v, want ack 1", reply)
+	}
+	_, err = c.Request(ctx, TypeRender, Render{Markdown: "# Hi"})
+	var e *ErrorPayload
+	if !errors.As(err, &e) || e.Code != ErrUnknownCommand {
+		t.Errorf("got %v, want %s", err, ErrUnknownCommand)
+	}
+
+	// The cursor events sent ahead of both replies are kept for Next.
+	for i := 0; i < 2; i++ {
+		msg, err := c.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type != TypeCursor {
+			t.Errorf("event %d: got %s, want %s", i, msg.Type, TypeCursor)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+// Package wsproto defines the JSON message protocol spoken over the
+// preview server's /ws endpoint and provides a small client for tests and
+// editor integrations.
+//
+// Every frame is a JSON envelope:
+//
+//	{"v": 1, "type": "content-changed", "id": "7", "payload": {...}}
+//
+// A client opens the conversation with a hello message listing the
+// protocol versions it understands; the server answers with welcome (or
+// an error and a close frame). After that the server streams events and
+// answers commands, echoing the command's id in its reply. See
+// PROTOCOL.md in the repository root for the full message catalogue.
+package wsproto
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Version is the protocol version implemented by this package.
+const Version = 1
+
+// Message types. Events flow from server to client; commands flow from
+// client to server.
+const (
+	// Handshake.
+	TypeHello   = "hello"
+	TypeWelcome = "welcome"
+
+	// Events.
+	TypeContentChanged = "content-changed"
+	TypeCursor         = "cursor"
+	TypeRendered       = "rendered"
+	TypePatch          = "patch"
+	TypeDiagnostics    = "diagnostics"
+	TypePresence       = "presence"
+	TypeFocus          = "focus"
+	TypeError          = "error"
+	TypeAck            = "ack" // reply to a command that returns no data
+	TypePong           = "pong"
+	TypeSnapshot       = "snapshot"
+	TypePresentation   = "presentation"
+
+	// Commands.
+	TypeRender     = "render"
+	TypeUpdate     = "update"
+	TypeLint       = "lint"
+	TypePushBuffer = "push-buffer"
+	TypePing       = "ping"
+	TypeJoin       = "join"
+	TypePresent    = "present"
+
+	// Collaborative editing, sent by clients and relayed by the server.
+	TypeEdit      = "edit"
+	TypeSelection = "selection"
+)
+
+// Error codes carried in ErrorPayload.Code.
+const (
+	ErrHandshakeRequired  = "handshake_required"
+	ErrUnsupportedVersion = "unsupported_version"
+	ErrBadMessage         = "bad_message"
+	ErrUnknownCommand     = "unknown_command"
+	ErrTooLarge           = "too_large"
+	ErrOverloaded         = "overloaded"
+	ErrTimeout            = "timeout"
+	ErrInternal           = "internal"
+	ErrForbidden          = "forbidden"
+)
+
+// Message is the envelope for every frame.
+type Message struct {
+	V       int             `json:"v"`
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Decode unmarshals the message payload into v.
+func (m *Message) Decode(v interface{}) error {
+	if len(m.Payload) == 0 {
+		return nil
+	}
+	return json.Unmarshal(m.Payload, v)
+}
+
+// Encode builds a frame of the given type. A nil payload is omitted.
+func Encode(typ, id string, payload interface{}) ([]byte, error) {
+	msg := Message{V: Version, Type: typ, ID: id}
+	if payload != nil {
+		raw, err := json.Marshal(payload)
+		if err != nil {
+			return nil, fmt.Errorf("wsproto: encoding %s payload: %w", typ, err)
+		}
+		msg.Payload = raw
+	}
+	return json.Marshal(msg)
+}
+
+// Hello opens the handshake.
+type Hello struct {
+	Versions []int  `json:"versions"`
+	Client   string `json:"client"`         // e.g. "browser", "nvim", "test"
+	Name     string `json:"name,omitempty"` // shown to other participants
+}
+
+// Welcome completes the handshake.
+type Welcome struct {
+	Version int    `json:"version"`
+	Session string `json:"session"`
+	Server  string `json:"server"`
+}
+
+// ContentChanged announces new document text, either pushed by an editor
+// (Source "buffer") or read from the watched file (Source "file").
+type ContentChanged struct {
+	Source string `json:"source"`
+	Path   string `json:"path,omitempty"`
+	Text   string `json:"text"`
+	Line   int    `json:"line,omitempty"` // one-based cursor line, 0 if unknown
+}
+
+// Cursor moves the followed cursor without changing the text.
+type Cursor struct {
+	Path string `json:"path,omitempty"`
+	Line int    `json:"line"`
+}
+
+// Focus asks one browser tab to come to the front because the document at
+// Path was opened again from the command line.
+type Focus struct {
+	Path string `json:"path,omitempty"`
+}
+
+// Render asks the server to render Markdown; the reply is Rendered.
+type Render struct {
+	Markdown string `json:"markdown"`
+}
+
+// Rendered carries HTML produced for a Render command.
+type Rendered struct {
+	HTML string `json:"html"`
+}
+
+// Update sends the full editor text; the reply is a Patch against the
+// blocks the server last rendered for this connection. Reset asks for a
+// full render, for example after the preview was redrawn some other way.
+type Update struct {
+	Markdown string `json:"markdown"`
+	Reset    bool   `json:"reset,omitempty"`
+}
+
+// Patch edits the list of top-level block elements in the preview: remove
+// Delete blocks at index Start, insert the Insert HTML fragments there, and
+// add Shift to the data-line of every block after them. Reset means the
+// preview must be cleared first (Start and Delete are then zero).
+type Patch struct {
+	Reset  bool     `json:"reset,omitempty"`
+	Start  int      `json:"start"`
+	Delete int      `json:"delete"`
+	Insert []string `json:"insert"`
+	Shift  int      `json:"shift,omitempty"`
+}
+
+// Lint asks for diagnostics; the reply is Diagnostics. Path, if set, is
+// used to resolve relative links.
+type Lint struct {
+	Path     string `json:"path,omitempty"`
+	Markdown string `json:"markdown"`
+}
+
+// Diagnostic is one problem in a document. Line and Col are one-based.
+type Diagnostic struct {
+	Line     int    `json:"line"`
+	Col      int    `json:"col"`
+	Severity string `json:"severity"` // "error", "warning" or "info"
+	Source   string `json:"source"`
+	Message  string `json:"message"`
+}
+
+// Diagnostics is sent in reply to Lint and whenever pushed content changes.
+type Diagnostics struct {
+	Path        string       `json:"path,omitempty"`
+	Diagnostics []Diagnostic `json:"diagnostics"`
+}
+
+// PushBuffer replaces the shared buffer, as the /buffer HTTP route does.
+// A nil Text moves the cursor only.
+type PushBuffer struct {
+	Path string  `json:"path,omitempty"`
+	Text *string `json:"text,omitempty"`
+	Line int     `json:"line,omitempty"`
+}
+
+// Participant describes one connected client.
+type Participant struct {
+	Session string `json:"session"`
+	Client  string `json:"client"`
+	Name    string `json:"name,omitempty"`
+}
+
+// Presence lists everyone connected; it is broadcast on every join and leave.
+type Presence struct {
+	Participants []Participant `json:"participants"`
+}
+
+// CharID identifies one character of the shared document by the session
+// that typed it and the Lamport clock it got. The zero CharID stands for
+// the start of the document.
+type CharID struct {
+	Site  string `json:"site"`
+	Clock uint64 `json:"clock"`
+}
+
+// Insert adds Text after the character After. Its characters, one per
+// Unicode code point, get ID and the clocks following it.
+type Insert struct {
+	ID    CharID `json:"id"`
+	After CharID `json:"after"`
+	Text  string `json:"text"`
+}
+
+// Span names Len characters typed by Site with consecutive clocks from
+// Clock.
+type Span struct {
+	Site  string `json:"site"`
+	Clock uint64 `json:"clock"`
+	Len   int    `json:"len"`
+}
+
+// Edit is a batch of changes to the shared document. Session is set on
+// edits the server relays.
+type Edit struct {
+	Session string   `json:"session,omitempty"`
+	Insert  []Insert `json:"insert,omitempty"`
+	Delete  []Span   `json:"delete,omitempty"`
+}
+
+// Run is a stretch of a Snapshot: characters from one site with
+// consecutive clocks from ID, each following the one before.
+type Run struct {
+	ID      CharID `json:"id"`
+	Text    string `json:"text"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+// Snapshot is the reply to Join: the whole shared document in order,
+// deleted characters included, and everybody's selection.
+type Snapshot struct {
+	Runs       []Run       `json:"runs"`
+	Selections []Selection `json:"selections"`
+}
+
+// Selection is a participant's caret or selected range. Anchor and Head
+// are the characters just before each end, so they stay put while others
+// edit. Session and Name are set by the server.
+type Selection struct {
+	Session string `json:"session,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Anchor  CharID `json:"anchor"`
+	Head    CharID `json:"head"`
+}
+
+// Presentation is where a presenter is in the preview. Line is the
+// one-based source line of the block at the top of their preview and
+// Offset how far, from 0 to 1, they have scrolled through it. Heading is
+// the heading of the section they are in. Slide is the one-based slide
+// shown when presenting a slide deck. A client sends it with the present
+// command; the server relays it as a presentation event with Session and
+// Name set. Active is false once the presenter stops.
+type Presentation struct {
+	Session string  `json:"session,omitempty"`
+	Name    string  `json:"name,omitempty"`
+	Active  bool    `json:"active"`
+	Line    int     `json:"line,omitempty"`
+	Offset  float64 `json:"offset,omitempty"`
+	Heading string  `json:"heading,omitempty"`
+	Slide   int     `json:"slide,omitempty"`
+}
+
+// ErrorPayload reports a failed command or a protocol violation.
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *ErrorPayload) Error() string {
+	return e.Code + ": " + e.Message
+}
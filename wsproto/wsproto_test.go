@@ -0,0 +1,63 @@
+package wsproto
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	text := "# Hi"
+	tests := []struct {
+		typ     string
+		payload interface{}
+		into    interface{}
+	}{
+		{TypeHello, Hello{Versions: []int{1, 2}, Client: "test", Name: "Ada"}, &Hello{}},
+		{TypeWelcome, Welcome{Version: 1, Session: "abc", Server: "markdown-preview"}, &Welcome{}},
+		{TypePushBuffer, PushBuffer{Path: "a.md", Text: &text, Line: 3}, &PushBuffer{}},
+		{TypeEdit, Edit{Insert: []Insert{{ID: CharID{Site: "s", Clock: 4}, Text: "xy"}}, Delete: []Span{{Site: "t", Clock: 1, Len: 2}}}, &Edit{}},
+		{TypeError, ErrorPayload{Code: ErrBadMessage, Message: "nope"}, &ErrorPayload{}},
+	}
+	for _, tt := range tests {
+		frame, err := Encode(tt.typ, "7", tt.payload)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.typ, err)
+		}
+		var msg Message
+		if err := json.Unmarshal(frame, &msg); err != nil {
+			t.Fatalf("%s: %v", tt.typ, err)
+		}
+		if msg.V != Version || msg.Type != tt.typ || msg.ID != "7" {
+			t.Errorf("%s: envelope %+v", tt.typ, msg)
+		}
+		if err := msg.Decode(tt.into); err != nil {
+			t.Fatalf("%s: %v", tt.typ, err)
+		}
+		if got := reflect.ValueOf(tt.into).Elem().Interface(); !reflect.DeepEqual(got, tt.payload) {
+			t.Errorf("%s: decoded %+v, want %+v", tt.typ, got, tt.payload)
+		}
+	}
+}
+
+func TestEncodeNilPayload(t *testing.T) {
+	frame, err := Encode(TypePing, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(frame), `{"v":1,"type":"ping"}`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	var msg Message
+	json.Unmarshal(frame, &msg)
+	var p Presence
+	if err := msg.Decode(&p); err != nil {
+		t.Errorf("decoding an empty payload: %v", err)
+	}
+}
+
+func TestEncodeUnmarshalablePayload(t *testing.T) {
+	if _, err := Encode(TypeRender, "1", make(chan int)); err == nil {
+		t.Error("encoding a channel succeeded")
+	}
+}